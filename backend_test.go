@@ -0,0 +1,614 @@
+package pg_stories
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	textOID = 25
+	int4OID = 23
+)
+
+var (
+	// valuesQueryPattern matches the only queries that memoryBackend answers with rows, e.g.
+	// SELECT * FROM (VALUES('baa'), ($1)) t
+	valuesQueryPattern = regexp.MustCompile(`(?is)^SELECT\s+\*\s+FROM\s+\(\s*VALUES\s*(.+)\)\s*(?:AS\s+)?\w+$`)
+	// valuePattern matches a value of a VALUES list: a string, a parameter, an integer or NULL
+	valuePattern = regexp.MustCompile(`(?i)^\s*('(?:[^']|'')*'|\$\d+|-?\d+|NULL)\s*`)
+)
+
+// memoryStatement is a statement that memoryBackend prepared
+type memoryStatement struct {
+	// command is the tag of a transaction control statement, empty for a VALUES query
+	command string
+	// empty tells whether the statement has no query at all
+	empty bool
+	// rows holds the values of the VALUES query, where a parameter $n is written as nil and its index
+	// is in params
+	rows   [][][]byte
+	params [][]int
+	// oids holds the types of the parameters and fields describes the rows
+	oids   []uint32
+	fields []pgproto3.FieldDescription
+}
+
+// memoryPortal is a statement that memoryBackend bound to parameters
+type memoryPortal struct {
+	stmt *memoryStatement
+	rows [][][]byte
+	// sent is the number of rows that were sent, and done tells whether the portal ran to completion
+	sent int
+	done bool
+}
+
+// memoryBackend is an in-process backend that implements enough of the protocol to run the stories of
+// this package without a postgres server: the startup sequence, simple and extended queries of literal
+// VALUES lists, transaction blocks, and the errors of unknown statements and portals. Like postgres, it
+// buffers its responses until Sync, Flush or the end of a simple query
+type memoryBackend struct {
+	conn       net.Conn
+	out        *bytes.Buffer
+	backend    *pgproto3.Backend
+	statements map[string]*memoryStatement
+	portals    map[string]*memoryPortal
+	status     byte
+	// failed tells whether an error in an extended query discards the messages until the next Sync
+	failed bool
+}
+
+// serveMemoryBackend answers the frontend on the other side of conn with a memoryBackend
+func serveMemoryBackend(conn net.Conn) error {
+	out := &bytes.Buffer{}
+	backend, err := pgproto3.NewBackend(conn, out)
+	if err != nil {
+		return err
+	}
+	b := &memoryBackend{
+		conn:       conn,
+		out:        out,
+		backend:    backend,
+		statements: make(map[string]*memoryStatement),
+		portals:    make(map[string]*memoryPortal),
+		status:     TxStatusIdle,
+	}
+	return b.serve()
+}
+
+// memoryError returns an ErrorResponse with code
+func memoryError(code, format string, args ...interface{}) *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (b *memoryBackend) send(messages ...pgproto3.BackendMessage) error {
+	for _, msg := range messages {
+		if err := b.backend.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the buffered responses to the connection
+func (b *memoryBackend) flush() error {
+	_, err := b.conn.Write(b.out.Bytes())
+	b.out.Reset()
+	return err
+}
+
+func (b *memoryBackend) serve() error {
+	if _, err := b.backend.ReceiveStartupMessage(); err != nil {
+		return err
+	}
+	err := b.send(
+		&pgproto3.Authentication{Type: pgproto3.AuthTypeOk},
+		&pgproto3.ParameterStatus{Name: "server_version", Value: "10.0"},
+		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
+		&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1},
+		&pgproto3.ReadyForQuery{TxStatus: b.status},
+	)
+	if err != nil {
+		return err
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := b.receive()
+		if err != nil {
+			b.fatal(err.Error())
+			return err
+		}
+		if _, ok := msg.(*pgproto3.Sync); b.failed && !ok {
+			// postgres flushes the error right away, so it is not held back by a Query that is discarded
+			if _, ok := msg.(*pgproto3.Query); ok {
+				if err := b.flush(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			err = b.query(m.String)
+		case *pgproto3.Parse:
+			err = b.parse(m)
+		case *pgproto3.Bind:
+			err = b.bind(m)
+		case *pgproto3.Describe:
+			err = b.describe(m)
+		case *pgproto3.Execute:
+			err = b.execute(m)
+		case *pgproto3.Close:
+			if m.ObjectType == 'S' {
+				delete(b.statements, m.Name)
+			} else {
+				delete(b.portals, m.Name)
+			}
+			err = b.send(&pgproto3.CloseComplete{})
+		case *pgproto3.Sync:
+			b.failed = false
+			err = b.ready()
+		case *pgproto3.Flush:
+			err = b.flush()
+		case *pgproto3.Terminate:
+			return nil
+		default:
+			b.fatal(fmt.Sprintf("unexpected message %T", msg))
+			return fmt.Errorf("unexpected message %T", msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fatal sends a fatal protocol violation error before the connection is closed. The buffered responses
+// are dropped, since the commands that they answer will never be synced
+func (b *memoryBackend) fatal(message string) {
+	b.out.Reset()
+	b.send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "08P01", Message: message})
+	b.flush()
+}
+
+// receive receives the next message. pgproto3 panics on messages of invalid length, which postgres
+// reports as a fatal error like any other invalid message
+func (b *memoryBackend) receive() (msg pgproto3.FrontendMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid message length: %v", r)
+		}
+	}()
+	return b.backend.Receive()
+}
+
+// abortedError returns the error of a statement in a failed transaction block
+func abortedError() *pgproto3.ErrorResponse {
+	return memoryError("25P02", "current transaction is aborted, commands ignored until end of transaction block")
+}
+
+// allowed tells whether stmt can run in the current transaction status. A failed transaction block
+// only allows to end it
+func (b *memoryBackend) allowed(stmt *memoryStatement) bool {
+	return b.status != TxStatusFailed || stmt.command == "COMMIT" || stmt.command == "ROLLBACK"
+}
+
+// ready ends the implicit transaction, if there is no transaction block, and sends ReadyForQuery with
+// the buffered responses
+func (b *memoryBackend) ready() error {
+	if b.status == TxStatusIdle {
+		b.portals = make(map[string]*memoryPortal)
+	}
+	if err := b.send(&pgproto3.ReadyForQuery{TxStatus: b.status}); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// fail sends e and discards the messages of the extended query until Sync
+func (b *memoryBackend) fail(e *pgproto3.ErrorResponse) error {
+	b.failed = true
+	return b.abort(e)
+}
+
+// abort sends e and fails the transaction block, if there is one
+func (b *memoryBackend) abort(e *pgproto3.ErrorResponse) error {
+	if b.status == TxStatusInTransaction {
+		b.status = TxStatusFailed
+	}
+	return b.send(e)
+}
+
+func (b *memoryBackend) query(q string) error {
+	delete(b.statements, "")
+	delete(b.portals, "")
+	queries := splitQueries(q)
+	if len(queries) == 0 {
+		if err := b.send(&pgproto3.EmptyQueryResponse{}); err != nil {
+			return err
+		}
+		return b.ready()
+	}
+	for _, sql := range queries {
+		stmt, e := parseMemoryStatement(sql, nil)
+		if e != nil {
+			if err := b.abort(e); err != nil {
+				return err
+			}
+			break
+		}
+		if len(stmt.oids) > 0 {
+			if err := b.abort(memoryError("42P02", "there is no parameter $1")); err != nil {
+				return err
+			}
+			break
+		}
+		portal := &memoryPortal{stmt: stmt, rows: stmt.rows}
+		if stmt.command == "" {
+			if err := b.send(&pgproto3.RowDescription{Fields: stmt.fields}); err != nil {
+				return err
+			}
+		}
+		if e := b.run(portal, 0); e != nil {
+			if err := b.abort(e); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return b.ready()
+}
+
+func (b *memoryBackend) parse(m *pgproto3.Parse) error {
+	if _, ok := b.statements[m.Name]; ok && m.Name != "" {
+		return b.fail(memoryError("42P05", "prepared statement %q already exists", m.Name))
+	}
+	queries := splitQueries(m.Query)
+	if len(queries) > 1 {
+		return b.fail(memoryError("42601", "cannot insert multiple commands into a prepared statement"))
+	}
+	stmt := &memoryStatement{empty: true}
+	if len(queries) == 1 {
+		var e *pgproto3.ErrorResponse
+		if stmt, e = parseMemoryStatement(queries[0], m.ParameterOIDs); e != nil {
+			return b.fail(e)
+		}
+	}
+	if !b.allowed(stmt) {
+		return b.fail(abortedError())
+	}
+	b.statements[m.Name] = stmt
+	return b.send(&pgproto3.ParseComplete{})
+}
+
+func (b *memoryBackend) bind(m *pgproto3.Bind) error {
+	stmt, ok := b.statements[m.PreparedStatement]
+	if !ok {
+		return b.fail(memoryError("26000", "prepared statement %q does not exist", m.PreparedStatement))
+	}
+	if len(m.Parameters) != len(stmt.oids) {
+		return b.fail(memoryError("08P01", "bind message supplies %d parameters, but prepared statement %q requires %d",
+			len(m.Parameters), m.PreparedStatement, len(stmt.oids)))
+	}
+	if _, ok := b.portals[m.DestinationPortal]; ok && m.DestinationPortal != "" {
+		return b.fail(memoryError("42P03", "cursor %q already exists", m.DestinationPortal))
+	}
+	if !b.allowed(stmt) {
+		return b.fail(abortedError())
+	}
+
+	portal := &memoryPortal{stmt: stmt}
+	for i, row := range stmt.rows {
+		values := make([][]byte, len(row))
+		for j, value := range row {
+			if n := stmt.params[i][j]; n > 0 {
+				value = m.Parameters[n-1]
+			}
+			if value != nil {
+				values[j] = append([]byte{}, value...)
+			}
+		}
+		portal.rows = append(portal.rows, values)
+	}
+	b.portals[m.DestinationPortal] = portal
+	return b.send(&pgproto3.BindComplete{})
+}
+
+func (b *memoryBackend) describe(m *pgproto3.Describe) error {
+	var stmt *memoryStatement
+	if m.ObjectType == 'S' {
+		s, ok := b.statements[m.Name]
+		if !ok {
+			return b.fail(memoryError("26000", "prepared statement %q does not exist", m.Name))
+		}
+		if err := b.send(&pgproto3.ParameterDescription{ParameterOIDs: s.oids}); err != nil {
+			return err
+		}
+		stmt = s
+	} else {
+		portal, ok := b.portals[m.Name]
+		if !ok {
+			return b.fail(memoryError("34000", "portal %q does not exist", m.Name))
+		}
+		stmt = portal.stmt
+	}
+	if stmt.command != "" || stmt.empty {
+		return b.send(&pgproto3.NoData{})
+	}
+	return b.send(&pgproto3.RowDescription{Fields: stmt.fields})
+}
+
+func (b *memoryBackend) execute(m *pgproto3.Execute) error {
+	portal, ok := b.portals[m.Portal]
+	if !ok {
+		return b.fail(memoryError("34000", "portal %q does not exist", m.Portal))
+	}
+	if e := b.run(portal, m.MaxRows); e != nil {
+		return b.fail(e)
+	}
+	return nil
+}
+
+// run sends up to maxRows rows of portal, or all of them if maxRows is 0, and updates the transaction
+// status with its command. The returned ErrorResponse is not sent. The responses are only buffered, so
+// sending them can not fail
+func (b *memoryBackend) run(portal *memoryPortal, maxRows uint32) *pgproto3.ErrorResponse {
+	stmt := portal.stmt
+	if !b.allowed(stmt) {
+		return abortedError()
+	}
+	if stmt.empty {
+		b.send(&pgproto3.EmptyQueryResponse{})
+		return nil
+	}
+	if stmt.command != "" {
+		tag := stmt.command
+		if !portal.done {
+			switch {
+			case tag == "BEGIN":
+				b.status = TxStatusInTransaction
+			case tag == "COMMIT" && b.status == TxStatusFailed:
+				tag = "ROLLBACK"
+				fallthrough
+			default:
+				b.status = TxStatusIdle
+			}
+			portal.done = true
+		}
+		b.send(&pgproto3.CommandComplete{CommandTag: tag})
+		return nil
+	}
+
+	rows := portal.rows[portal.sent:]
+	if maxRows > 0 && int(maxRows) < len(rows) {
+		rows = rows[:maxRows]
+	}
+	for _, values := range rows {
+		b.send(&pgproto3.DataRow{Values: values})
+	}
+	portal.sent += len(rows)
+	if maxRows > 0 && len(rows) == int(maxRows) {
+		b.send(&pgproto3.PortalSuspended{})
+		return nil
+	}
+	portal.done = true
+	b.send(&pgproto3.CommandComplete{CommandTag: fmt.Sprintf("SELECT %d", len(rows))})
+	return nil
+}
+
+// splitQueries splits q to its SQL statements, skipping the empty ones
+func splitQueries(q string) []string {
+	var queries []string
+	quoted, start := false, 0
+	for i := 0; i <= len(q); i++ {
+		if i < len(q) && q[i] == '\'' {
+			quoted = !quoted
+		}
+		if i == len(q) || q[i] == ';' && !quoted {
+			if sql := strings.TrimSpace(q[start:i]); sql != "" {
+				queries = append(queries, sql)
+			}
+			start = i + 1
+		}
+	}
+	return queries
+}
+
+// parseMemoryStatement parses sql, which is a transaction control statement or a SELECT of a VALUES
+// list, with the types of its parameters in oids
+func parseMemoryStatement(sql string, oids []uint32) (*memoryStatement, *pgproto3.ErrorResponse) {
+	switch strings.ToUpper(strings.Join(strings.Fields(sql), " ")) {
+	case "BEGIN", "START TRANSACTION":
+		return &memoryStatement{command: "BEGIN", oids: oids}, nil
+	case "COMMIT", "END":
+		return &memoryStatement{command: "COMMIT", oids: oids}, nil
+	case "ROLLBACK", "ABORT":
+		return &memoryStatement{command: "ROLLBACK", oids: oids}, nil
+	}
+	match := valuesQueryPattern.FindStringSubmatch(sql)
+	if match == nil {
+		return nil, memoryError("42601", "syntax error in %q", sql)
+	}
+
+	stmt := &memoryStatement{oids: append([]uint32{}, oids...)}
+	list := match[1]
+	for {
+		list = strings.TrimSpace(list)
+		if !strings.HasPrefix(list, "(") {
+			return nil, memoryError("42601", "syntax error at %q", list)
+		}
+		list = list[1:]
+		var row [][]byte
+		var params []int
+		for {
+			value := valuePattern.FindStringSubmatch(list)
+			if value == nil {
+				return nil, memoryError("42601", "syntax error at %q", list)
+			}
+			list = list[len(value[0]):]
+			param, oid, literal := 0, uint32(textOID), []byte(nil)
+			switch v := value[1]; {
+			case v[0] == '\'':
+				literal = []byte(strings.Replace(v[1:len(v)-1], "''", "'", -1))
+			case v[0] == '$':
+				param, _ = strconv.Atoi(v[1:])
+				if param == 0 {
+					return nil, memoryError("42P02", "there is no parameter $0")
+				}
+				for len(stmt.oids) < param {
+					stmt.oids = append(stmt.oids, 0)
+				}
+			case strings.EqualFold(v, "NULL"):
+			default:
+				literal, oid = []byte(v), int4OID
+			}
+			row = append(row, literal)
+			params = append(params, param)
+			if len(stmt.rows) == 0 {
+				stmt.fields = append(stmt.fields, pgproto3.FieldDescription{
+					Name:         fmt.Sprintf("column%d", len(row)),
+					DataTypeOID:  oid,
+					DataTypeSize: -1,
+					TypeModifier: -1,
+				})
+			}
+			if strings.HasPrefix(list, ")") {
+				break
+			}
+			if !strings.HasPrefix(list, ",") {
+				return nil, memoryError("42601", "syntax error at %q", list)
+			}
+			list = list[1:]
+		}
+		if len(stmt.rows) > 0 && len(row) != len(stmt.rows[0]) {
+			return nil, memoryError("42601", "VALUES lists must all be the same length")
+		}
+		stmt.rows = append(stmt.rows, row)
+		stmt.params = append(stmt.params, params)
+		list = strings.TrimSpace(list[1:])
+		if list == "" {
+			break
+		}
+		if !strings.HasPrefix(list, ",") {
+			return nil, memoryError("42601", "syntax error at %q", list)
+		}
+		list = list[1:]
+	}
+
+	// parameters of unknown types are resolved to text, and the columns of parameters take their types
+	for i, oid := range stmt.oids {
+		if oid == 0 {
+			stmt.oids[i] = textOID
+		}
+	}
+	for i, n := range stmt.params[0] {
+		if n > 0 {
+			stmt.fields[i].DataTypeOID = stmt.oids[n-1]
+		}
+	}
+	for i := range stmt.fields {
+		if stmt.fields[i].DataTypeOID == int4OID {
+			stmt.fields[i].DataTypeSize = 4
+		}
+	}
+	return stmt, nil
+}
+
+func TestMemoryBackend(t *testing.T) {
+	run := func(t *testing.T, lines ...string) {
+		story, _, err := NewBuilder(strings.NewReader(strings.Join(append(append(
+			[]string{"=== " + t.Name(), TokenSimulate}, lines...), "==="), "\n")), startupSeq()...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if story.Session, err = connectSession(); err != nil {
+			t.Fatal(err)
+		}
+		defer story.Session.Close()
+		story.Ignore = append(story.Ignore, Ignore('S', 'K'))
+		story.Validate = true
+		story.StepTimeout = time.Second * 2
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("test values", func(t *testing.T) {
+		run(t,
+			`-> Q "SELECT * FROM (VALUES('a''b', 1), (NULL, -2)) AS t; SELECT * FROM (VALUES('c')) t"`,
+			`<- T ["column1","column2"] [25,23]`,
+			`<- D ["a'b","1"]`,
+			`<- D [NULL,"-2"]`,
+			`<- C "SELECT 2"`,
+			`<- T ["column1"] [25]`,
+			`<- D ["c"]`,
+			`<- C "SELECT 1"`,
+			`-> P "" "SELECT * FROM (VALUES($2, $1)) t" [23]`,
+			`-> D S ""`,
+			`-> B "" "" ["1","a"]`,
+			`-> D P ""`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- t`,
+			`<- T ["column1","column2"] [25,23]`,
+			`<- T`,
+			`<- D ["a","1"]`,
+			`<- C "SELECT 1"`,
+		)
+	})
+
+	t.Run("test errors", func(t *testing.T) {
+		run(t,
+			`-> Q "SELEC 1"`,
+			`<- E {code=42601}`,
+			`-> Q ""`,
+			`<- I`,
+			TokenPipeline,
+			`-> P "" "SELECT * FROM (VALUES($1)) t" []`,
+			`-> B "" "" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`-> P "baa" "BEGIN; COMMIT" []`,
+			`-> S`,
+			TokenEnd,
+			`<- E {code=42601}`,
+		)
+	})
+
+	t.Run("test transaction blocks", func(t *testing.T) {
+		run(t,
+			`-> Q "BEGIN"`,
+			`<- C "BEGIN"`,
+			`-> Q "SELEC 1"`,
+			`<- E {code=42601}`,
+			`-> P "" "SELECT * FROM (VALUES(1)) t" []`,
+			`-> B "" "" []`,
+			`-> S`,
+			`<- E {code=25P02}`,
+			`-> Q "COMMIT"`,
+			`<- C "ROLLBACK"`,
+			`-> P "" "START TRANSACTION" []`,
+			`-> B "" "" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- C "BEGIN"`,
+			TokenPipeline,
+			`-> P "" "SELECT * FROM (VALUES(1)) t" []`,
+			`-> B "" "" []`,
+			`-> S`,
+			`-> E "" 0`,
+			`-> S`,
+			TokenEnd,
+			`<- D ["1"]`,
+			`<- C "SELECT 1"`,
+		)
+	})
+}
@@ -0,0 +1,306 @@
+package pg_stories
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// Benchmark runs a story repeatedly over concurrent connections to measure the performance of the backend
+type Benchmark struct {
+	// Story is the scenario of every iteration. Its Steps, Filter, Ignore, Lines and StepTimeout are used
+	Story *Story
+	// Connect opens a new session with the backend. It is called for every connection, and again after
+	// an iteration fails, since the state of the session is unknown
+	Connect func() (*Session, error)
+	// StartupSeq is the sequence of Commands that is sent once on every new session. It is not measured
+	StartupSeq []Step
+	// Connections is the number of concurrent connections. Zero means one
+	Connections int
+	// Duration is the time to start new iterations for. Zero means there is no time limit
+	Duration time.Duration
+	// Iterations is the total number of iterations over all the connections. Zero means there is no limit
+	Iterations int
+	// Timeout is the maximum time to wait for ReadyForQuery during the startup sequence. Zero waits forever
+	Timeout time.Duration
+}
+
+// StepStats holds the measurements of a single step over all the iterations of a benchmark
+type StepStats struct {
+	// Step is the index of the step in the story
+	Step int
+	// Line is the line in the transcript that defines the step, or 0 if there is none
+	Line int
+	// Description is the step as it is defined in a transcript
+	Description string
+	// Count is the number of times the step ran
+	Count int
+	// Errors is the number of times the step failed
+	Errors int
+
+	latencies []time.Duration
+	sorted    bool
+}
+
+// Percentile returns the latency that p percent of the runs of the step did not exceed, e.g. 95
+func (s *StepStats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	if !s.sorted {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		s.sorted = true
+	}
+	i := int(float64(len(s.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.latencies) {
+		i = len(s.latencies) - 1
+	}
+	return s.latencies[i]
+}
+
+// ErrorRate returns the fraction of the runs of the step that failed
+func (s *StepStats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+func (s *StepStats) add(elapsed time.Duration, err error) {
+	s.Count++
+	s.sorted = false
+	s.latencies = append(s.latencies, elapsed)
+	if err != nil {
+		s.Errors++
+	}
+}
+
+// BenchmarkResult is the outcome of a Benchmark
+type BenchmarkResult struct {
+	// Iterations is the number of iterations that ran
+	Iterations int
+	// Errors is the number of iterations that failed
+	Errors int
+	// Elapsed is the time it took to run all the iterations
+	Elapsed time.Duration
+	// Steps holds the measurements of every step of the story
+	Steps []*StepStats
+
+	// story holds the measurements of the whole story, one for every iteration
+	story StepStats
+}
+
+// Throughput returns the number of iterations per second
+func (r *BenchmarkResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Iterations) / r.Elapsed.Seconds()
+}
+
+// ErrorRate returns the fraction of the iterations that failed
+func (r *BenchmarkResult) ErrorRate() float64 {
+	if r.Iterations == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Iterations)
+}
+
+// Percentile returns the latency of the whole story that p percent of the iterations did not exceed, e.g. 95
+func (r *BenchmarkResult) Percentile(p float64) time.Duration {
+	return r.story.Percentile(p)
+}
+
+// Write writes a summary of the result followed by a table of the latencies of every step to w
+func (r *BenchmarkResult) Write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "iterations: %d, errors: %d (%.2f%%), elapsed: %s, throughput: %.2f/s\n",
+		r.Iterations, r.Errors, r.ErrorRate()*100, r.Elapsed, r.Throughput()); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "step\tline\tmessage\tcount\terrors\tp50\tp95\tp99")
+	for _, s := range r.Steps {
+		line := "-"
+		if s.Line > 0 {
+			line = fmt.Sprint(s.Line)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", s.Step, line, s.Description, s.Count, s.Errors,
+			s.Percentile(50), s.Percentile(95), s.Percentile(99))
+	}
+	return tw.Flush()
+}
+
+func newBenchmarkResult(s *Story) *BenchmarkResult {
+	r := &BenchmarkResult{}
+	for i, step := range s.Steps {
+		stats := &StepStats{Step: i, Description: describeStep(step)}
+		if i < len(s.Lines) {
+			stats.Line = s.Lines[i]
+		}
+		r.Steps = append(r.Steps, stats)
+	}
+	return r
+}
+
+// merge adds the measurements of other to r
+func (r *BenchmarkResult) merge(other *BenchmarkResult) {
+	r.Iterations += other.Iterations
+	r.Errors += other.Errors
+	r.story.latencies = append(r.story.latencies, other.story.latencies...)
+	r.story.sorted = false
+	for i, s := range other.Steps {
+		r.Steps[i].Count += s.Count
+		r.Steps[i].Errors += s.Errors
+		r.Steps[i].latencies = append(r.Steps[i].latencies, s.latencies...)
+		r.Steps[i].sorted = false
+	}
+}
+
+// startup opens a new session and sends the startup sequence over it
+func (bm *Benchmark) startup() (*Session, error) {
+	session, err := bm.Connect()
+	if err != nil {
+		return nil, err
+	}
+	state := &syncState{}
+	for _, step := range bm.StartupSeq {
+		cmd, ok := commandOf(step)
+		if !ok {
+			continue
+		}
+		ready := state.sent(cmd.FrontendMessage)
+		if err := session.Frontend.Send(cmd.FrontendMessage); err != nil {
+			session.Close()
+			return nil, err
+		}
+		if !ready {
+			continue
+		}
+		if _, err := session.untilReady(bm.Timeout, nil, state); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// worker runs iterations over a single connection as long as next allows it
+func (bm *Benchmark) worker(next func() bool) (*BenchmarkResult, error) {
+	result := newBenchmarkResult(bm.Story)
+	var session *Session
+	defer func() {
+		if session != nil {
+			session.Close()
+		}
+	}()
+
+	for next() {
+		if session == nil {
+			var err error
+			if session, err = bm.startup(); err != nil {
+				return result, err
+			}
+		}
+		story := &Story{
+			Session:     session,
+			Steps:       bm.Story.Steps,
+			Lines:       bm.Story.Lines,
+			Filter:      bm.Story.Filter,
+			Ignore:      bm.Story.Ignore,
+			StepTimeout: bm.Story.StepTimeout,
+		}
+		r := newRunner(story, func(string, ...interface{}) {}, nil)
+		r.observe = func(i int, elapsed time.Duration, err error) {
+			result.Steps[i].add(elapsed, err)
+		}
+		result.Iterations++
+		started := time.Now()
+		err := r.run()
+		result.story.add(time.Since(started), err)
+		if err != nil {
+			result.Errors++
+			session.Close()
+			session = nil
+		}
+	}
+	return result, nil
+}
+
+// Run runs the story until Duration passes or Iterations were started, whichever comes first,
+// and returns the measurements. Iterations that already started when Duration passes are completed.
+func (bm *Benchmark) Run() (*BenchmarkResult, error) {
+	if bm.Duration <= 0 && bm.Iterations <= 0 {
+		return nil, fmt.Errorf("benchmark requires a duration or a number of iterations")
+	}
+	connections := bm.Connections
+	if connections <= 0 {
+		connections = 1
+	}
+
+	var mu sync.Mutex
+	started := 0
+	begin := time.Now()
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if bm.Iterations > 0 && started >= bm.Iterations {
+			return false
+		}
+		if bm.Duration > 0 && time.Since(begin) >= bm.Duration {
+			return false
+		}
+		started++
+		return true
+	}
+
+	results := make([]*BenchmarkResult, connections)
+	errs := make([]error, connections)
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = bm.worker(next)
+		}(i)
+	}
+	wg.Wait()
+
+	result := newBenchmarkResult(bm.Story)
+	result.Elapsed = time.Since(begin)
+	for i := range results {
+		result.merge(results[i])
+	}
+	for _, err := range errs {
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// RunB runs b.N iterations of the story and reports the throughput, the error rate and the
+// latency percentiles of the whole story to b
+func (bm *Benchmark) RunB(b *testing.B) {
+	benchmark := *bm
+	benchmark.Duration = 0
+	benchmark.Iterations = b.N
+	b.ResetTimer()
+	result, err := benchmark.Run()
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportMetric(result.Throughput(), "stories/s")
+	b.ReportMetric(result.ErrorRate(), "errors/story")
+	b.ReportMetric(float64(result.Percentile(50).Nanoseconds()), "p50-ns/story")
+	b.ReportMetric(float64(result.Percentile(95).Nanoseconds()), "p95-ns/story")
+	b.ReportMetric(float64(result.Percentile(99).Nanoseconds()), "p99-ns/story")
+}
@@ -0,0 +1,115 @@
+package pg_stories
+
+import (
+	"bytes"
+	"github.com/jackc/pgx/pgproto3"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeSession returns a session that is connected through net.Pipe to a backend served by serve
+func pipeSession(serve func(*pgproto3.Backend) error) (*Session, error) {
+	frontendConn, backendConn := net.Pipe()
+	backend, err := pgproto3.NewBackend(backendConn, backendConn)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		serve(backend)
+		backendConn.Close()
+	}()
+	return NewSession(frontendConn)
+}
+
+func benchmarkStory() *Story {
+	return &Story{
+		Steps: []Step{
+			&Command{&pgproto3.Query{String: SimpleQuery}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		},
+		StepTimeout: time.Second,
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+
+	t.Run("test iterations", func(t *testing.T) {
+		b := &Benchmark{
+			Story: benchmarkStory(),
+			Connect: func() (*Session, error) {
+				return pipeSession(answerQueries(
+					&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+					&pgproto3.ReadyForQuery{TxStatus: 'I'},
+				))
+			},
+			Connections: 4,
+			Iterations:  40,
+		}
+		result, err := b.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Iterations != 40 || result.Errors != 0 {
+			t.Fatalf("expected 40 iterations without errors. got %d iterations with %d errors", result.Iterations, result.Errors)
+		}
+		for _, s := range result.Steps {
+			if s.Count != 40 {
+				t.Fatalf("expected step #%d to run 40 times. got %d", s.Step, s.Count)
+			}
+			if s.Percentile(50) > s.Percentile(99) {
+				t.Fatalf("expected p50 of step #%d to not exceed its p99", s.Step)
+			}
+			if result.Percentile(50) < s.Percentile(50) {
+				t.Fatalf("expected p50 of the story to include the latency of step #%d", s.Step)
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := result.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), `-> Q "SELECT * FROM (VALUES('baa')) t;"`) {
+			t.Fatalf("expected the result to describe the steps. got:\n%s", buf)
+		}
+	})
+
+	t.Run("test errors", func(t *testing.T) {
+		b := &Benchmark{
+			Story: benchmarkStory(),
+			Connect: func() (*Session, error) {
+				return pipeSession(answerQueries(
+					&pgproto3.ErrorResponse{Code: ErrorInvalidSqlStatementName},
+					&pgproto3.ReadyForQuery{TxStatus: 'I'},
+				))
+			},
+			Duration: time.Millisecond * 50,
+		}
+		result, err := b.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Iterations == 0 || result.ErrorRate() != 1 {
+			t.Fatalf("expected every iteration to fail. got %d of %d", result.Errors, result.Iterations)
+		}
+		if result.Steps[1].Errors != result.Iterations || result.Steps[2].Count != 0 {
+			t.Fatalf("expected every iteration to fail on step #1")
+		}
+	})
+
+}
+
+func BenchmarkStory(b *testing.B) {
+	bm := &Benchmark{
+		Story: benchmarkStory(),
+		Connect: func() (*Session, error) {
+			return pipeSession(answerQueries(
+				&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			))
+		},
+		Connections: 2,
+	}
+	bm.RunB(b)
+}
@@ -7,8 +7,11 @@ import (
 	"github.com/jackc/pgx/pgproto3"
 	"io"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type UnknownMessageType struct {
@@ -53,13 +56,23 @@ func (e *UnexpectedTokenError) Error() string {
 }
 
 const (
-	TokenBackendMessage      = "<-"
-	TokenFrontendMessage     = "->"
-	TokenStoryDelimiter      = "==="
-	WhiteSpaceChars          = "\t "
-	TokenDelimiterString     = '"'
-	TokenDelimiterArrayStart = '['
-	TokenDelimiterArrayEnd   = ']'
+	TokenBackendMessage       = "<-"
+	TokenFrontendMessage      = "->"
+	TokenStoryDelimiter       = "==="
+	WhiteSpaceChars           = "\t "
+	TokenDelimiterString      = '"'
+	TokenDelimiterArrayStart  = '['
+	TokenDelimiterArrayEnd    = ']'
+	TokenCellDelimiter        = '|'
+	TokenDelimiterObjectStart = '{'
+	TokenDelimiterObjectEnd   = '}'
+	TokenWithin               = "within"
+	TokenNone                 = "none"
+	TokenPipeline             = "@pipeline"
+	TokenEnd                  = "@end"
+	TokenRows                 = "rows"
+	TokenOrdered              = "ordered"
+	TokenUnordered            = "unordered"
 )
 
 type tokenParser struct {
@@ -81,6 +94,296 @@ func (t *tokenParser) readToken(start, end byte) (s string, e error) {
 	return
 }
 
+// more tells whether there are tokens left to read
+func (t *tokenParser) more() bool {
+	for {
+		c, err := t.r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if strings.IndexByte(WhiteSpaceChars, c) < 0 {
+			t.r.UnreadByte()
+			return true
+		}
+	}
+}
+
+// readString reads the next quoted string. A quote, a backslash or a new line inside
+// the string are escaped with a backslash.
+func (t *tokenParser) readString() (string, error) {
+	_, err := t.r.ReadString(TokenDelimiterString)
+	if err != nil {
+		return "", err
+	}
+	sb := strings.Builder{}
+	for {
+		c, err := t.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case TokenDelimiterString:
+			return sb.String(), nil
+		case '\\':
+			next, err := t.r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			switch next {
+			case TokenDelimiterString, '\\':
+				c = next
+			case 'n':
+				c = '\n'
+			default:
+				t.r.UnreadByte()
+			}
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// arrayItem is a single item of an array token
+type arrayItem struct {
+	value  string
+	quoted bool
+	null   bool
+}
+
+// readArray reads the next array. Items are separated by commas and may be quoted strings,
+// in which case they can contain commas. An unquoted NULL is a null item.
+func (t *tokenParser) readArray() ([]arrayItem, error) {
+	_, err := t.r.ReadString(TokenDelimiterArrayStart)
+	if err != nil {
+		return nil, err
+	}
+	var items []arrayItem
+	for {
+		if !t.more() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		c, _ := t.r.ReadByte()
+		if c == TokenDelimiterArrayEnd && len(items) == 0 {
+			return items, nil
+		}
+		var item arrayItem
+		if c == TokenDelimiterString {
+			t.r.UnreadByte()
+			item.value, err = t.readString()
+			if err != nil {
+				return nil, err
+			}
+			item.quoted = true
+			t.more()
+			c, err = t.r.ReadByte()
+		} else {
+			sb := strings.Builder{}
+			for ; err == nil && c != ',' && c != TokenDelimiterArrayEnd; c, err = t.r.ReadByte() {
+				sb.WriteByte(c)
+			}
+			item.value = strings.Trim(sb.String(), WhiteSpaceChars)
+			item.null = item.value == "NULL"
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		switch c {
+		case TokenDelimiterArrayEnd:
+			return items, nil
+		case ',':
+		default:
+			return nil, fmt.Errorf("unexpected character in array: %c", c)
+		}
+	}
+}
+
+// readRegexp reads the next regular expression. It is delimited by slashes, and a slash inside it is
+// escaped with a backslash. A leading tilde makes the regular expression match part of the text.
+func (t *tokenParser) readRegexp() (*RegexpMatcher, error) {
+	m := &RegexpMatcher{}
+	c, err := t.r.ReadByte()
+	if err == nil && c == '~' {
+		m.Partial = true
+		c, err = t.r.ReadByte()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c != '/' {
+		return nil, fmt.Errorf("unexpected character in regular expression: %c", c)
+	}
+	sb := strings.Builder{}
+	for {
+		c, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == '/' {
+			break
+		}
+		if c == '\\' {
+			next, err := t.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if next != '/' {
+				sb.WriteByte(c)
+			}
+			c = next
+		}
+		sb.WriteByte(c)
+	}
+	m.Regexp, err = regexp.Compile(sb.String())
+	return m, err
+}
+
+// isRegexp tells whether the next token is a regular expression
+func (t *tokenParser) isRegexp() bool {
+	c, err := t.r.Peek(1)
+	return err == nil && (c[0] == '/' || c[0] == '~')
+}
+
+// objectItem is a single key=value item of an object token
+type objectItem struct {
+	key   string
+	value string
+}
+
+// readObject reads the next object, e.g. {code=23505, message="a, b"}. Values may be quoted strings,
+// in which case they can contain commas.
+func (t *tokenParser) readObject() ([]objectItem, error) {
+	_, err := t.r.ReadString(TokenDelimiterObjectStart)
+	if err != nil {
+		return nil, err
+	}
+	var items []objectItem
+	for {
+		if !t.more() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		c, _ := t.r.ReadByte()
+		if c == TokenDelimiterObjectEnd && len(items) == 0 {
+			return items, nil
+		}
+		t.r.UnreadByte()
+		key, err := t.r.ReadString('=')
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		item := objectItem{key: strings.Trim(key[:len(key)-1], WhiteSpaceChars)}
+		if !t.more() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		c, _ = t.r.ReadByte()
+		if c == TokenDelimiterString {
+			t.r.UnreadByte()
+			if item.value, err = t.readString(); err != nil {
+				return nil, err
+			}
+			t.more()
+			c, err = t.r.ReadByte()
+		} else {
+			sb := strings.Builder{}
+			for ; err == nil && c != ',' && c != TokenDelimiterObjectEnd; c, err = t.r.ReadByte() {
+				sb.WriteByte(c)
+			}
+			item.value = strings.Trim(sb.String(), WhiteSpaceChars)
+		}
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		items = append(items, item)
+		switch c {
+		case TokenDelimiterObjectEnd:
+			return items, nil
+		case ',':
+		default:
+			return nil, fmt.Errorf("unexpected character in object: %c", c)
+		}
+	}
+}
+
+// isObject tells whether the next token is an object
+func (t *tokenParser) isObject() bool {
+	c, err := t.r.Peek(1)
+	return err == nil && c[0] == TokenDelimiterObjectStart
+}
+
+// readRow reads the cells of a row, which are delimited by pipes and may be quoted strings.
+// An unquoted NULL is a null cell.
+func (t *tokenParser) readRow() ([][]byte, error) {
+	c, err := t.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if c != TokenCellDelimiter {
+		return nil, fmt.Errorf("unexpected character in row: %c", c)
+	}
+	values := [][]byte{}
+	for t.more() {
+		c, _ := t.r.ReadByte()
+		var value []byte
+		if c == TokenDelimiterString {
+			t.r.UnreadByte()
+			s, err := t.readString()
+			if err != nil {
+				return nil, err
+			}
+			value = []byte(s)
+			t.more()
+			c, err = t.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			sb := strings.Builder{}
+			for ; err == nil && c != TokenCellDelimiter; c, err = t.r.ReadByte() {
+				sb.WriteByte(c)
+			}
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if s := strings.Trim(sb.String(), WhiteSpaceChars); s != "NULL" {
+				value = []byte(s)
+			}
+		}
+		if c != TokenCellDelimiter {
+			return nil, fmt.Errorf("unexpected character in row: %c", c)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// isString tells whether the next token is a string
+func (t *tokenParser) isString() bool {
+	c, err := t.r.Peek(1)
+	return err == nil && c[0] == TokenDelimiterString
+}
+
+// isRow tells whether the next token is a row
+func (t *tokenParser) isRow() bool {
+	c, err := t.r.Peek(1)
+	return err == nil && c[0] == TokenCellDelimiter
+}
+
+// readUints reads the next array as a list of unsigned integers
+func (t *tokenParser) readUints(bitSize int) ([]uint64, error) {
+	items, err := t.readArray()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]uint64, 0, len(items))
+	for _, item := range items {
+		i, err := strconv.ParseUint(item.value, 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, i)
+	}
+	return values, nil
+}
+
 func NewBuilder(r io.Reader, startupSeq ...Step) *Builder {
 	return &Builder{r: bufio.NewReader(r), startupSeq: startupSeq}
 }
@@ -88,61 +391,125 @@ func NewBuilder(r io.Reader, startupSeq ...Step) *Builder {
 type Builder struct {
 	r          *bufio.Reader
 	startupSeq []Step
+	line       int
+	// ignore holds the rules that are defined before the stories and apply to all of the following ones
+	ignore IgnoreRules
+}
+
+// isIgnoreDirective tells whether line is an ignore directive
+func isIgnoreDirective(line string) bool {
+	return line == TokenIgnore || strings.HasPrefix(line, TokenIgnore+" ")
 }
 
-func (b *Builder) parseResponse(msgType byte, parser *tokenParser) (res *Response, err error) {
-	var msg pgproto3.BackendMessage
+// newBackendMessage returns an empty BackendMessage of the provided type or nil if the type is unknown
+func newBackendMessage(msgType byte) pgproto3.BackendMessage {
 	switch msgType {
 	case '1':
-		msg = &pgproto3.ParseComplete{}
+		return &pgproto3.ParseComplete{}
 	case '2':
-		msg = &pgproto3.BindComplete{}
+		return &pgproto3.BindComplete{}
 	case '3':
-		msg = &pgproto3.CloseComplete{}
+		return &pgproto3.CloseComplete{}
 	case 'A':
-		msg = &pgproto3.NotificationResponse{}
+		return &pgproto3.NotificationResponse{}
 	case 'c':
-		msg = &pgproto3.CopyDone{}
+		return &pgproto3.CopyDone{}
 	case 'f':
-		msg = &pgproto3.CopyFail{}
+		return &pgproto3.CopyFail{}
 	case 'C':
-		msg = &pgproto3.CommandComplete{}
+		return &pgproto3.CommandComplete{}
 	case 'd':
-		msg = &pgproto3.CopyData{}
+		return &pgproto3.CopyData{}
 	case 'D':
-		msg = &pgproto3.DataRow{}
+		return &pgproto3.DataRow{}
 	case 'E':
-		msg = &pgproto3.ErrorResponse{}
+		return &pgproto3.ErrorResponse{}
 	case 'G':
-		msg = &pgproto3.CopyInResponse{}
+		return &pgproto3.CopyInResponse{}
 	case 'H':
-		msg = &pgproto3.CopyOutResponse{}
+		return &pgproto3.CopyOutResponse{}
 	case 'I':
-		msg = &pgproto3.EmptyQueryResponse{}
+		return &pgproto3.EmptyQueryResponse{}
 	case 'K':
-		msg = &pgproto3.BackendKeyData{}
+		return &pgproto3.BackendKeyData{}
 	case 'n':
-		msg = &pgproto3.NoData{}
+		return &pgproto3.NoData{}
 	case 'N':
-		msg = &pgproto3.NoticeResponse{}
+		return &pgproto3.NoticeResponse{}
 	case 'R':
-		msg = &pgproto3.Authentication{}
+		return &pgproto3.Authentication{}
 	case 'S':
-		msg = &pgproto3.ParameterStatus{}
+		return &pgproto3.ParameterStatus{}
 	case 't':
-		msg = &pgproto3.ParameterDescription{}
+		return &pgproto3.ParameterDescription{}
 	case 'T':
-		msg = &pgproto3.RowDescription{}
+		return &pgproto3.RowDescription{}
 	case 'V':
-		msg = &pgproto3.FunctionCallResponse{}
+		return &pgproto3.FunctionCallResponse{}
 	case 'W':
-		msg = &pgproto3.CopyBothResponse{}
+		return &pgproto3.CopyBothResponse{}
 	case 'Z':
-		msg = &pgproto3.ReadyForQuery{}
+		return &pgproto3.ReadyForQuery{}
 	case 's':
-		msg = &pgproto3.PortalSuspended{}
-	default:
+		return &pgproto3.PortalSuspended{}
+	}
+	return nil
+}
+
+func (b *Builder) parseResponse(msgType byte, parser *tokenParser) (res *Response, matchers []Matcher, err error) {
+	msg := newBackendMessage(msgType)
+	if msg == nil {
 		err = &UnknownMessageType{msgType: msgType}
+		return
+	}
+
+	if parser.more() && parser.isRegexp() {
+		if _, ok := messageText(msg); !ok {
+			err = &InvalidArgError{msgType: msgType}
+			return
+		}
+		var m *RegexpMatcher
+		if m, err = parser.readRegexp(); err != nil {
+			return
+		}
+		matchers = append(matchers, m)
+		if parser.more() {
+			err = &InvalidArgCountError{msgType: msgType}
+			return
+		}
+	} else if parser.more() {
+		switch m := msg.(type) {
+		case *pgproto3.CommandComplete:
+			m.CommandTag, err = parser.readString()
+		case *pgproto3.DataRow:
+			var items []arrayItem
+			items, err = parser.readArray()
+			m.Values = make([][]byte, 0, len(items))
+			for _, item := range items {
+				if item.null {
+					m.Values = append(m.Values, nil)
+				} else {
+					m.Values = append(m.Values, []byte(item.value))
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			err = parseErrorFields(m, parser)
+		case *pgproto3.NoticeResponse:
+			err = parseErrorFields((*pgproto3.ErrorResponse)(m), parser)
+		case *pgproto3.ParameterDescription:
+			var oids []uint64
+			oids, err = parser.readUints(32)
+			m.ParameterOIDs = make([]uint32, 0, len(oids))
+			for _, oid := range oids {
+				m.ParameterOIDs = append(m.ParameterOIDs, uint32(oid))
+			}
+		case *pgproto3.RowDescription:
+			err = parseRowDescription(m, parser)
+		case *pgproto3.ReadyForQuery:
+			m.TxStatus, err = parseTxStatus(parser)
+		default:
+			err = &InvalidArgCountError{msgType: msgType}
+		}
 	}
 
 	if err != nil {
@@ -154,51 +521,128 @@ func (b *Builder) parseResponse(msgType byte, parser *tokenParser) (res *Respons
 	return
 }
 
+// parseRowDescription reads the field names followed by optional arrays of type OIDs and format codes
+func parseRowDescription(msg *pgproto3.RowDescription, parser *tokenParser) error {
+	names, err := parser.readArray()
+	if err != nil {
+		return err
+	}
+	msg.Fields = make([]pgproto3.FieldDescription, len(names))
+	for i, name := range names {
+		msg.Fields[i].Name = name.value
+	}
+	if !parser.more() {
+		return nil
+	}
+	oids, err := parser.readUints(32)
+	if err != nil {
+		return err
+	}
+	if len(oids) != len(names) {
+		return &InvalidArgCountError{msgType: 'T'}
+	}
+	for i, oid := range oids {
+		msg.Fields[i].DataTypeOID = uint32(oid)
+	}
+	if !parser.more() {
+		return nil
+	}
+	formats, err := parser.readUints(16)
+	if err != nil {
+		return err
+	}
+	if len(formats) != len(names) {
+		return &InvalidArgCountError{msgType: 'T'}
+	}
+	for i, format := range formats {
+		msg.Fields[i].Format = int16(format)
+	}
+	return nil
+}
+
+// parseTxStatus reads the transaction status of ReadyForQuery
+func parseTxStatus(parser *tokenParser) (byte, error) {
+	status, err := parser.readToken(0, ' ')
+	if err != nil && err.Error() != "EOF" {
+		return 0, err
+	}
+	if parser.more() {
+		return 0, &InvalidArgCountError{msgType: 'Z'}
+	}
+	switch status {
+	case string(TxStatusIdle), string(TxStatusInTransaction), string(TxStatusFailed):
+		return status[0], nil
+	}
+	return 0, &InvalidArgError{msgType: 'Z'}
+}
+
+// parseObjectType reads the object type of Describe and Close
+func parseObjectType(msgType byte, parser *tokenParser) (byte, string, error) {
+	t, err := parser.readToken(0, ' ')
+	if err != nil {
+		return 0, "", err
+	}
+	if t != "S" && t != "P" {
+		return 0, "", &InvalidArgError{msgType: msgType}
+	}
+	name, err := parser.readString()
+	if err != nil && err.Error() != "EOF" {
+		return 0, "", err
+	}
+	return t[0], name, nil
+}
+
 func (b *Builder) parseCommand(msgType byte, parser *tokenParser) (*Command, error) {
 	var msg pgproto3.FrontendMessage
 	switch msgType {
 	case 'B':
-		name, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		name, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
-		stmt, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		stmt, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
 		bind := pgproto3.Bind{DestinationPortal: name, PreparedStatement: stmt}
-		params, err := parser.readToken(TokenDelimiterArrayStart, TokenDelimiterArrayEnd)
+		params, err := parser.readArray()
 		if err != nil {
 			return nil, err
 		}
-		for _, p := range strings.Split(params, ",") {
-			i, err := strconv.ParseFloat(p, 64)
-			if err != nil {
-				bind.Parameters = append(bind.Parameters, []byte(p))
+		numeric := make([]bool, len(params))
+		for i, p := range params {
+			if p.null {
+				bind.Parameters = append(bind.Parameters, nil)
+				continue
+			}
+			f, err := strconv.ParseFloat(p.value, 64)
+			if err != nil || p.quoted {
+				bind.Parameters = append(bind.Parameters, []byte(p.value))
 			} else {
-				buf := make([]byte, 8)
-				binary.LittleEndian.PutUint64(buf, math.Float64bits(i))
-				bind.Parameters = append(bind.Parameters, buf)
+				bind.Parameters = append(bind.Parameters, numberParameter(f))
+				numeric[i] = true
 			}
 		}
+		setNumericParameters(&bind, numeric)
 		msg = &bind
 	case 'C':
-		msg = &pgproto3.Close{}
+		closeMsg := pgproto3.Close{}
+		if parser.more() {
+			var err error
+			closeMsg.ObjectType, closeMsg.Name, err = parseObjectType(msgType, parser)
+			if err != nil {
+				return nil, err
+			}
+		}
+		msg = &closeMsg
 	case 'D':
-		t, err := parser.readToken(0, ' ')
+		t, name, err := parseObjectType(msgType, parser)
 		if err != nil {
 			return nil, err
 		}
-		if t != "S" && t != "P" {
-			return nil, &InvalidArgError{}
-		}
-		name, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
-		if err != nil && err.Error() != "EOF" {
-			return nil, err
-		}
-		msg = &pgproto3.Describe{Name: name, ObjectType: t[0]}
+		msg = &pgproto3.Describe{Name: name, ObjectType: t}
 	case 'E':
-		portal, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		portal, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
@@ -218,33 +662,37 @@ func (b *Builder) parseCommand(msgType byte, parser *tokenParser) (*Command, err
 	case 'H':
 		msg = &pgproto3.Flush{}
 	case 'P':
-		name, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		name, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
-		query, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		query, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
 		parse := pgproto3.Parse{Name: name, Query: query}
-		params, err := parser.readToken(TokenDelimiterArrayStart, TokenDelimiterArrayEnd)
-		if err != nil {
-			return nil, err
-		}
-		if params != "" {
-			for _, p := range strings.Split(params, ",") {
-				i, err := strconv.ParseUint(p, 10, 32)
-				if err != nil {
-					return nil, &InvalidArgError{msgType: msgType}
-				}
-				parse.ParameterOIDs = append(parse.ParameterOIDs, uint32(i))
+		if parser.more() {
+			oids, err := parser.readUints(32)
+			if err != nil {
+				return nil, &InvalidArgError{msgType: msgType}
+			}
+			for _, oid := range oids {
+				parse.ParameterOIDs = append(parse.ParameterOIDs, uint32(oid))
 			}
 		}
 		msg = &parse
 	case 'p':
-		msg = &pgproto3.PasswordMessage{}
+		password := pgproto3.PasswordMessage{}
+		if parser.more() {
+			var err error
+			password.Password, err = parser.readString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		msg = &password
 	case 'Q':
-		query, err := parser.readToken(TokenDelimiterString, TokenDelimiterString)
+		query, err := parser.readString()
 		if err != nil {
 			return nil, err
 		}
@@ -260,7 +708,91 @@ func (b *Builder) parseCommand(msgType byte, parser *tokenParser) (*Command, err
 	return &Command{FrontendMessage: msg}, nil
 }
 
+// numericParameters holds which parameters of a Bind were written as numbers, by the Bind that the Builder
+// or a document created, so they are written as numbers again. The number is only known from how it was
+// written, since small integers encode as valid text as well. Only Binds with such parameters are held
+var numericParameters = struct {
+	sync.Mutex
+	m map[*pgproto3.Bind][]bool
+}{m: make(map[*pgproto3.Bind][]bool)}
+
+// setNumericParameters records which parameters of bind were written as numbers
+func setNumericParameters(bind *pgproto3.Bind, numeric []bool) {
+	for _, ok := range numeric {
+		if ok {
+			numericParameters.Lock()
+			defer numericParameters.Unlock()
+			numericParameters.m[bind] = numeric
+			return
+		}
+	}
+}
+
+// numericParameter returns the number of parameter i of bind if it was written as a number
+func numericParameter(bind *pgproto3.Bind, i int) (float64, bool) {
+	numericParameters.Lock()
+	numeric := numericParameters.m[bind]
+	numericParameters.Unlock()
+	p := bind.Parameters[i]
+	if i >= len(numeric) || !numeric[i] || len(p) != 8 {
+		return 0, false
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(p)), true
+}
+
+// numberParameter returns a parameter of Bind that is written as the number f, which is sent as float64
+// in little endian
+func numberParameter(f float64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+	return buf
+}
+
+// splitWithin splits a trailing "within $duration" from the step definition in txt
+func splitWithin(txt string) (string, time.Duration, error) {
+	i := strings.LastIndex(txt, " "+TokenWithin+" ")
+	if i < 0 || strings.ContainsAny(txt[i:], `"]/|`) {
+		return txt, 0, nil
+	}
+	d, err := time.ParseDuration(strings.Trim(txt[i+len(TokenWithin)+2:], WhiteSpaceChars))
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimRight(txt[:i], WhiteSpaceChars), d, nil
+}
+
 func (b *Builder) parseStep(txt string) (Step, error) {
+	if strings.HasPrefix(txt, TokenAssert+" ") {
+		return parseAssertion(txt)
+	}
+	txt, within, err := splitWithin(txt)
+	if err != nil {
+		return nil, err
+	}
+	step, err := b.parseMessage(txt)
+	if err != nil || within == 0 {
+		return step, err
+	}
+	switch s := step.(type) {
+	case *Response:
+		return &Expectation{Response: s, Within: within}, nil
+	case *Expectation:
+		s.Within = within
+		return s, nil
+	case *Row:
+		s.Within = within
+		return s, nil
+	case *Notification:
+		s.Within = within
+		return s, nil
+	case *Parameter:
+		s.Within = within
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s is allowed only for responses", TokenWithin)
+}
+
+func (b *Builder) parseMessage(txt string) (Step, error) {
 	if len(txt) == 0 {
 		return nil, fmt.Errorf("empty step definition")
 	}
@@ -274,6 +806,10 @@ func (b *Builder) parseStep(txt string) (Step, error) {
 	}
 	direction = strings.Trim(direction, WhiteSpaceChars)
 	msgType, err := parser.readToken(0, ' ')
+	// skip repeated spaces between the direction and the message type
+	for err == nil && msgType == "" {
+		msgType, err = parser.readToken(0, ' ')
+	}
 	if err != nil {
 		if err.Error() != "EOF" || msgType == "" {
 			return nil, err
@@ -282,7 +818,32 @@ func (b *Builder) parseStep(txt string) (Step, error) {
 	msgType = strings.Trim(msgType, WhiteSpaceChars)
 	switch direction {
 	case TokenBackendMessage:
-		return b.parseResponse(msgType[0], parser)
+		if msgType == TokenNone {
+			d, err := time.ParseDuration(strings.Trim(txt[strings.Index(txt, TokenNone)+len(TokenNone):], WhiteSpaceChars))
+			// a silence without a duration would wait forever
+			if err != nil || d <= 0 {
+				return nil, &InvalidArgError{msgType: msgType[0]}
+			}
+			return &Silence{Duration: d}, nil
+		}
+		if msgType == "A" {
+			return parseNotification(parser)
+		}
+		if msgType == "S" && parser.more() {
+			return parseParameter(parser)
+		}
+		if msgType == "D" && parser.more() && parser.isRow() {
+			values, err := parser.readRow()
+			if err != nil {
+				return nil, err
+			}
+			return &Row{Values: values}, nil
+		}
+		res, matchers, err := b.parseResponse(msgType[0], parser)
+		if err != nil || len(matchers) == 0 {
+			return res, err
+		}
+		return &Expectation{Response: res, Matchers: matchers}, nil
 	case TokenFrontendMessage:
 		return b.parseCommand(msgType[0], parser)
 	}
@@ -290,7 +851,30 @@ func (b *Builder) parseStep(txt string) (Step, error) {
 }
 
 func (b *Builder) ParseNext() (story *Story, name string, err error) {
-	i := 0
+	pipeline, simulate := false, false
+	var rows *rowsBlock
+	// flushRows adds the steps of the rows block that was just closed
+	flushRows := func() error {
+		if rows == nil {
+			return nil
+		}
+		steps, lines, err := rows.steps()
+		story.Steps = append(story.Steps, steps...)
+		story.Lines = append(story.Lines, lines...)
+		rows = nil
+		return err
+	}
+	defer func() {
+		if err == nil && story != nil {
+			err = flushRows()
+		}
+		if err == nil && simulate {
+			var issues []LintIssue
+			if story, issues = Simulate(story); len(issues) > 0 {
+				err = &SimulationError{issues}
+			}
+		}
+	}()
 	for {
 		var line string
 		line, err = b.r.ReadString('\n')
@@ -301,36 +885,118 @@ func (b *Builder) ParseNext() (story *Story, name string, err error) {
 			}
 			return
 		}
-		i++
+		b.line++
 		line = strings.Trim(line, " \t\n")
 		if line == "" {
 			continue
 		}
 		if story == nil {
-			if line[:3] != TokenStoryDelimiter {
+			if isIgnoreDirective(line) {
+				var rule IgnoreRule
+				if rule, err = parseIgnoreRule(line, b.line); err != nil {
+					return
+				}
+				b.ignore = append(b.ignore, rule)
+				continue
+			}
+			if !strings.HasPrefix(line, TokenStoryDelimiter) {
 				err = &UnexpectedTokenError{
-					actual:   line[:3],
-					line:     i,
+					actual:   line,
+					line:     b.line,
 					expected: []string{TokenStoryDelimiter},
 				}
+				return
 			}
 			name = strings.Trim(line[3:], WhiteSpaceChars)
-			story = &Story{Steps: b.startupSeq}
+			story = &Story{
+				Name:   name,
+				Steps:  append([]Step(nil), b.startupSeq...),
+				Lines:  make([]int, len(b.startupSeq)),
+				Ignore: append(IgnoreRules(nil), b.ignore...),
+			}
+			continue
+		}
+		if rows != nil && line[0] == TokenCellDelimiter {
+			if err = rows.add(line, b.line); err != nil {
+				return
+			}
 			continue
 		}
+		if err = flushRows(); err != nil {
+			return
+		}
 		if len(line) == 3 && line == TokenStoryDelimiter {
+			if pipeline {
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{TokenEnd}}
+				return
+			}
 			if len(story.Steps) == 0 {
 				err = &EmptyStoryError{}
 				return
 			}
 			break
 		}
+		if line == TokenPipeline || line == TokenEnd {
+			if pipeline == (line == TokenPipeline) {
+				expected := TokenPipeline
+				if pipeline {
+					expected = TokenEnd
+				}
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{expected}}
+				return
+			}
+			pipeline = line == TokenPipeline
+			continue
+		}
+		if line == TokenSimulate {
+			if pipeline {
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{TokenFrontendMessage, TokenEnd}}
+				return
+			}
+			simulate = true
+			continue
+		}
+		if isIgnoreDirective(line) {
+			if pipeline {
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{TokenFrontendMessage, TokenEnd}}
+				return
+			}
+			var rule IgnoreRule
+			if rule, err = parseIgnoreRule(line, b.line); err != nil {
+				return
+			}
+			// rules that precede the first step apply to the whole story, including the startup sequence
+			if len(story.Steps) > len(b.startupSeq) {
+				rule.From = len(story.Steps)
+			}
+			story.Ignore = append(story.Ignore, rule)
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == TokenBackendMessage && fields[1] == TokenRows {
+			if pipeline {
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{TokenFrontendMessage, TokenEnd}}
+				return
+			}
+			if rows, err = parseRowsHeader(fields[2:], b.line); err != nil {
+				return
+			}
+			continue
+		}
 		var step Step
 		step, err = b.parseStep(line)
 		if err != nil {
 			return
 		}
+		if pipeline {
+			cmd, ok := step.(*Command)
+			if !ok {
+				err = &UnexpectedTokenError{actual: line, line: b.line, expected: []string{TokenFrontendMessage, TokenEnd}}
+				return
+			}
+			step = &Pipelined{cmd}
+		}
 		story.Steps = append(story.Steps, step)
+		story.Lines = append(story.Lines, b.line)
 	}
 	return
 }
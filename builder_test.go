@@ -7,6 +7,7 @@ import (
 	"math"
 	"strings"
 	"testing"
+	"time"
 )
 
 func createBuilder(name string, steps ...string) *Builder {
@@ -217,4 +218,416 @@ func TestBuilder_ParseNext(t *testing.T) {
 		}
 	})
 
+	t.Run("test response arguments", func(t *testing.T) {
+		builder := createBuilder(t.Name(),
+			`<- C "SELECT 1"`,
+			`<- D ["baa",NULL,"a,\"b\""]`,
+			`<- T ["id","name"] [23,25]`,
+			`<- E "26000"`,
+		)
+		story, _, err := builder.ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag := story.Steps[0].(*Response).BackendMessage.(*pgproto3.CommandComplete).CommandTag; tag != "SELECT 1" {
+			t.Fatalf("expected command tag to be 'SELECT 1'. actual: %s", tag)
+		}
+		values := story.Steps[1].(*Response).BackendMessage.(*pgproto3.DataRow).Values
+		if len(values) != 3 || string(values[0]) != "baa" || values[1] != nil || string(values[2]) != `a,"b"` {
+			t.Fatalf("expected values to be [baa NULL a,\"b\"]. actual: %q", values)
+		}
+		fields := story.Steps[2].(*Response).BackendMessage.(*pgproto3.RowDescription).Fields
+		if len(fields) != 2 || fields[1].Name != "name" || fields[1].DataTypeOID != 25 {
+			t.Fatalf("expected fields id:23 and name:25. actual: %#v", fields)
+		}
+		if code := story.Steps[3].(*Response).BackendMessage.(*pgproto3.ErrorResponse).Code; code != "26000" {
+			t.Fatalf("expected error code to be 26000. actual: %s", code)
+		}
+	})
+
+	t.Run("test format round trip", func(t *testing.T) {
+		lines := []string{
+			`-> P "stmt" "SELECT \"baa\", $1" [0]`,
+			`-> B "" "stmt" [1.5,"1.5",NULL]`,
+			`-> D P ""`,
+			`-> C S "stmt"`,
+			`-> E "" 10`,
+			`-> S`,
+			`<- T ["baa"] [25]`,
+			`<- D ["baa"]`,
+			`<- C "SELECT 1"`,
+			`<- Z`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+	})
+
+	t.Run("test timing", func(t *testing.T) {
+		builder := createBuilder(t.Name(), `<- C "SELECT within 2s" within 200ms`, `<- none 100ms`, `<- n`)
+		story, _, err := builder.ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectation, ok := story.Steps[0].(*Expectation)
+		if !ok {
+			t.Fatalf("expected first step to be an expectation. actual: %T", story.Steps[0])
+		}
+		if expectation.Within != time.Millisecond*200 {
+			t.Fatalf("expected within to be 200ms. actual: %s", expectation.Within)
+		}
+		if tag := expectation.BackendMessage.(*pgproto3.CommandComplete).CommandTag; tag != "SELECT within 2s" {
+			t.Fatalf("expected command tag to be 'SELECT within 2s'. actual: %s", tag)
+		}
+		silence, ok := story.Steps[1].(*Silence)
+		if !ok || silence.Duration != time.Millisecond*100 {
+			t.Fatalf("expected second step to be silence of 100ms. actual: %#v", story.Steps[1])
+		}
+		if _, ok := story.Steps[2].(*Response).BackendMessage.(*pgproto3.NoData); !ok {
+			t.Fatalf("expected third step to be NoData. actual: %#v", story.Steps[2])
+		}
+		if _, _, err := createBuilder(t.Name(), `<- none 0s`).ParseNext(); err == nil {
+			t.Fatal("expected an error for a silence of 0s")
+		}
+	})
+
+	t.Run("test pipeline", func(t *testing.T) {
+		lines := []string{
+			TokenPipeline,
+			`-> Q "SELECT 1"`,
+			`-> Q "SELECT 2"`,
+			TokenEnd,
+			`<- Z`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, ok := story.Steps[i].(*Pipelined); !ok {
+				t.Fatalf("expected step #%d to be pipelined. actual: %T", i, story.Steps[i])
+			}
+		}
+		if _, ok := story.Steps[2].(*Response); !ok {
+			t.Fatalf("expected step #2 to be a response. actual: %T", story.Steps[2])
+		}
+		buf := &strings.Builder{}
+		if err := WriteStory(buf, t.Name(), story.Steps); err != nil {
+			t.Fatal(err)
+		}
+		expected := "=== " + t.Name() + "\n" + strings.Join(lines, "\n") + "\n===\n\n"
+		if buf.String() != expected {
+			t.Fatalf("expected pipeline to be written as:\n%s\nactual:\n%s", expected, buf)
+		}
+
+		invalid := [][]string{
+			{TokenPipeline, `<- Z`, TokenEnd},
+			{TokenPipeline, `-> S`},
+			{TokenEnd},
+			{TokenPipeline, TokenPipeline},
+		}
+		for _, lines := range invalid {
+			if _, _, err := createBuilder(t.Name(), lines...).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %v", lines)
+			}
+		}
+	})
+
+	t.Run("test matchers", func(t *testing.T) {
+		lines := []string{
+			`<- E ~/relation .* does not exist/`,
+			`<- C /INSERT 0 \d+/ within 1s`,
+			`<- N /a \/ b/`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+		expectation := story.Steps[1].(*Expectation)
+		if expectation.Within != time.Second {
+			t.Fatalf("expected within to be 1s. actual: %s", expectation.Within)
+		}
+		if err := expectation.Compare(&pgproto3.CommandComplete{CommandTag: "INSERT 0 12"}); err != nil {
+			t.Fatal(err)
+		}
+		notice := story.Steps[2].(*Expectation)
+		if err := notice.Compare(&pgproto3.NoticeResponse{Message: "a / b"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range []string{`<- Z /I/`, `<- C /(/`, `<- C /a/ "b"`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test rows", func(t *testing.T) {
+		lines := []string{
+			`<- D | 1 | baa | NULL | "NULL" | "" | "a | b" |`,
+			`<- D | 1.5 | within 1s`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, ok := story.Steps[0].(*Row)
+		if !ok {
+			t.Fatalf("expected first step to be a row. actual: %T", story.Steps[0])
+		}
+		expected := [][]byte{[]byte("1"), []byte("baa"), nil, []byte("NULL"), []byte(""), []byte("a | b")}
+		if !equalValues(expected, row.Values) {
+			t.Fatalf("expected values %q. actual: %q", expected, row.Values)
+		}
+		if line, _ := FormatStep(row); line != lines[0] {
+			t.Fatalf("expected row to be formatted as %s. actual: %s", lines[0], line)
+		}
+		if within := story.Steps[1].(*Row).Within; within != time.Second {
+			t.Fatalf("expected within to be 1s. actual: %s", within)
+		}
+
+		for _, line := range []string{`<- D | 1`, `<- D | "a" b |`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test rows block", func(t *testing.T) {
+		story, _, err := createBuilder(t.Name(),
+			`-> Q "SELECT * FROM (VALUES(1, 'baa'), (2, NULL)) t(id, name);"`,
+			`<- rows`,
+			`| id | name |`,
+			`|----|------|`,
+			`| 1  | baa  |`,
+			`| 2  | NULL |`,
+			`<- rows unordered`,
+			`| id |`,
+			`| 2  |`,
+			`| 1  |`,
+			`<- Z`,
+		).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			`-> Q "SELECT * FROM (VALUES(1, 'baa'), (2, NULL)) t(id, name);"`,
+			`<- T ["id","name"] [0,0]`,
+			`<- D | 1 | baa |`,
+			`<- D | 2 | NULL |`,
+			`<- C`,
+			`<- T ["id"] [0]`,
+			`<- rows unordered (2 rows)`,
+			`<- C`,
+			`<- Z`,
+		}
+		if len(story.Steps) != len(expected) {
+			t.Fatalf("expected %d steps. actual: %d", len(expected), len(story.Steps))
+		}
+		for i, step := range story.Steps {
+			if actual := describeStep(step); actual != expected[i] {
+				t.Fatalf("expected step #%d to be %s. actual: %s", i, expected[i], actual)
+			}
+		}
+		if lines := []int{2, 4, 6, 7, 3, 9, 8, 8, 12}; fmt.Sprint(story.Lines) != fmt.Sprint(lines) {
+			t.Fatalf("expected lines %v. actual: %v", lines, story.Lines)
+		}
+
+		invalid := [][]string{
+			{`<- rows`, `<- Z`},
+			{`<- rows`, `| a | b |`, `| 1 |`},
+			{`<- rows sorted`, `| a |`},
+			{`<- rows`, `| NULL |`},
+		}
+		for _, lines := range invalid {
+			if _, _, err := createBuilder(t.Name(), lines...).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %v", lines)
+			}
+		}
+	})
+
+	t.Run("test error fields", func(t *testing.T) {
+		lines := []string{
+			`<- E {code=23505, severity=ERROR, constraint=users_pkey}`,
+			`<- N {severity=WARNING, message="a, b", position=7}`,
+			`<- E "23505"`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+		notice := story.Steps[1].(*Response).BackendMessage.(*pgproto3.NoticeResponse)
+		if notice.Message != "a, b" || notice.Position != 7 {
+			t.Fatalf("expected notice fields to be parsed. actual: %#v", notice)
+		}
+
+		for _, line := range []string{`<- E {code=1, unknown=2}`, `<- N {position=x}`, `<- E {code=1`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test notifications", func(t *testing.T) {
+		lines := []string{
+			`<- A "baa" "payload"`,
+			`<- A "baa"`,
+			`<- A`,
+			`<- A "baa" "" before Z`,
+			`<- A "baa" "payload" after Z within 1s`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+		n := story.Steps[4].(*Notification)
+		if n.Order != AfterReady || n.Within != time.Second || n.AnyPayload {
+			t.Fatalf("unexpected notification: %#v", n)
+		}
+
+		for _, line := range []string{`<- A "baa" "" during Z`, `<- A "baa" "" before C`, `<- A "baa" "" before Z Z`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test transaction status", func(t *testing.T) {
+		lines := []string{`<- Z`, `<- Z I`, `<- Z T`, `<- Z E`}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+		if status := story.Steps[2].(*Response).BackendMessage.(*pgproto3.ReadyForQuery).TxStatus; status != TxStatusInTransaction {
+			t.Fatalf("expected transaction status T. got %c", status)
+		}
+
+		for _, line := range []string{`<- Z X`, `<- Z idle`, `<- Z I T`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test parameters", func(t *testing.T) {
+		lines := []string{
+			`<- S "TimeZone" "UTC"`,
+			`<- S "application_name" "" within 1s`,
+			`assert param TimeZone = UTC`,
+			`assert param application_name = "my app"`,
+			`assert param application_name = ""`,
+		}
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range story.Steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != lines[i] {
+				t.Fatalf("expected step #%d to be formatted as %s. actual: %s", i, lines[i], line)
+			}
+		}
+		if a := story.Steps[3].(*ParameterAssertion); a.Name != "application_name" || a.Value != "my app" {
+			t.Fatalf("unexpected assertion: %#v", a)
+		}
+
+		for _, line := range []string{`<- S "TimeZone"`, `<- S "TimeZone" "UTC" "GMT"`, `assert parameter TimeZone = UTC`, `assert param TimeZone UTC`, `assert param = UTC`} {
+			if _, _, err := createBuilder(t.Name(), line).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", line)
+			}
+		}
+	})
+
+	t.Run("test ignore rules", func(t *testing.T) {
+		builder := NewBuilder(strings.NewReader(strings.Join([]string{
+			`@ignore S, K`,
+			`=== first`,
+			`@ignore N`,
+			`-> Q "SELECT 1"`,
+			`<- C`,
+			`@ignore T,D`,
+			`<- Z`,
+			`===`,
+			`=== second`,
+			`-> Q "SELECT 1"`,
+			`===`,
+		}, "\n")), &Command{&pgproto3.Query{String: "startup"}})
+		story, _, err := builder.ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := IgnoreRules{{Types: []byte("SK")}, {Types: []byte("N")}, {Types: []byte("TD"), From: 3}}
+		if fmt.Sprint(story.Ignore) != fmt.Sprint(expected) {
+			t.Fatalf("expected rules %v. got %v", expected, story.Ignore)
+		}
+		if !story.Ignore.Ignores(0, &pgproto3.NoticeResponse{}) || story.Ignore.Ignores(2, &pgproto3.DataRow{}) || !story.Ignore.Ignores(3, &pgproto3.DataRow{}) {
+			t.Fatalf("unexpected rules %v", story.Ignore)
+		}
+		if formatIgnoreRule(story.Ignore[2]) != "@ignore T, D" {
+			t.Fatalf("unexpected directive %s", formatIgnoreRule(story.Ignore[2]))
+		}
+		story, _, err = builder.ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(story.Ignore) != 1 || string(story.Ignore[0].Types) != "SK" {
+			t.Fatalf("expected only the rules before the stories. got %v", story.Ignore)
+		}
+
+		for _, lines := range [][]string{{`@ignore`}, {`@ignore X`}, {`@ignore S K`}, {`@pipeline`, `@ignore S`, `@end`}} {
+			if _, _, err := createBuilder(t.Name(), lines...).ParseNext(); err == nil {
+				t.Fatalf("expected an error for %s", lines)
+			}
+		}
+	})
+
 }
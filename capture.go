@@ -0,0 +1,606 @@
+package pg_stories
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"net"
+	"strconv"
+)
+
+// CapturedConnection is a connection to the backend that was read from a capture of the network traffic
+type CapturedConnection struct {
+	// Client and Server are the addresses of the two sides of the connection, e.g. 10.0.0.1:52344
+	Client string
+	Server string
+	// Steps are the messages that were sent after the startup sequence, in the order they were captured.
+	// Commands that were sent before the responses to a previous Sync or Query arrived are Pipelined
+	Steps []Step
+	// Err tells why the connection could not be decoded to its end, if it couldn't. Steps holds the
+	// messages that were decoded until then
+	Err error
+}
+
+// Name returns the name of the story of the connection
+func (c *CapturedConnection) Name() string {
+	return c.Client + " -> " + c.Server
+}
+
+// CaptureError is returned when a capture file is malformed
+type CaptureError struct {
+	reason string
+}
+
+func (e *CaptureError) Error() string {
+	return "invalid capture: " + e.reason
+}
+
+const (
+	pcapMagic         = 0xa1b2c3d4
+	pcapMagicNanos    = 0xa1b23c4d
+	pcapngSectionType = 0x0a0d0d0a
+	pcapngByteOrder   = 0x1a2b3c4d
+
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	cancelRequestCode = 80877102
+)
+
+// link layer types of the captured packets
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeSLL2     = 276
+)
+
+// readPackets reads a pcap or a pcapng capture from r and calls packet with the link layer type and the
+// data of every packet, in the order they were captured
+func readPackets(r io.Reader, packet func(linkType int, data []byte) error) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return &CaptureError{"missing file header"}
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionType {
+		return readPcapng(br, packet)
+	}
+	return readPcap(br, packet)
+}
+
+// readPcap reads a capture in the pcap format
+func readPcap(r io.Reader, packet func(linkType int, data []byte) error) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return &CaptureError{"missing file header"}
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagic || binary.LittleEndian.Uint32(header) == pcapMagicNanos:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagic || binary.BigEndian.Uint32(header) == pcapMagicNanos:
+		order = binary.BigEndian
+	default:
+		return &CaptureError{"unknown file format"}
+	}
+	linkType := int(order.Uint32(header[20:]) & 0x0fffffff)
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &CaptureError{"truncated packet header"}
+		}
+		data := make([]byte, order.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return &CaptureError{"truncated packet"}
+		}
+		if err := packet(linkType, data); err != nil {
+			return err
+		}
+	}
+}
+
+// readPcapng reads a capture in the pcapng format
+func readPcapng(r io.Reader, packet func(linkType int, data []byte) error) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []int
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &CaptureError{"truncated block header"}
+		}
+		blockType := order.Uint32(header)
+		if binary.LittleEndian.Uint32(header) == pcapngSectionType {
+			// the byte order of the section is known only once its magic is read
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return &CaptureError{"truncated section header"}
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic) == pcapngByteOrder:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic) == pcapngByteOrder:
+				order = binary.BigEndian
+			default:
+				return &CaptureError{"unknown byte order"}
+			}
+			blockType = pcapngSectionType
+			interfaces = nil
+			header = append(header, magic...)
+		}
+		length := int(order.Uint32(header[4:8]))
+		if length < len(header)+4 || length%4 != 0 {
+			return &CaptureError{"invalid block length " + strconv.Itoa(length)}
+		}
+		body := make([]byte, length-len(header))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return &CaptureError{"truncated block"}
+		}
+		body = body[:len(body)-4]
+		header = header[:8]
+
+		var iface int
+		var data []byte
+		switch blockType {
+		case 1: // interface description
+			if len(body) < 2 {
+				return &CaptureError{"truncated interface description"}
+			}
+			interfaces = append(interfaces, int(order.Uint16(body)))
+			continue
+		case 6: // enhanced packet
+			if len(body) < 20 {
+				return &CaptureError{"truncated packet"}
+			}
+			iface = int(order.Uint32(body))
+			data = body[20:]
+			if captured := int(order.Uint32(body[12:])); captured <= len(data) {
+				data = data[:captured]
+			}
+		case 3: // simple packet
+			if len(body) < 4 {
+				return &CaptureError{"truncated packet"}
+			}
+			data = body[4:]
+			if original := int(order.Uint32(body)); original <= len(data) {
+				data = data[:original]
+			}
+		case 2: // obsolete packet
+			if len(body) < 20 {
+				return &CaptureError{"truncated packet"}
+			}
+			iface = int(order.Uint16(body))
+			data = body[20:]
+			if captured := int(order.Uint32(body[12:])); captured <= len(data) {
+				data = data[:captured]
+			}
+		default:
+			continue
+		}
+		if iface >= len(interfaces) {
+			return &CaptureError{"packet of unknown interface " + strconv.Itoa(iface)}
+		}
+		if err := packet(interfaces[iface], data); err != nil {
+			return err
+		}
+	}
+}
+
+// tcpSegment is the part of a captured packet that matters for reassembling TCP streams
+type tcpSegment struct {
+	src, dst net.IP
+	srcPort  int
+	dstPort  int
+	seq      uint32
+	syn      bool
+	payload  []byte
+}
+
+// decodeSegment returns the TCP segment in the packet data of the provided link layer type, or false if
+// it holds no TCP segment over IPv4 or IPv6
+func decodeSegment(linkType int, data []byte) (*tcpSegment, bool) {
+	var network uint16
+	switch linkType {
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		family := binary.LittleEndian.Uint32(data)
+		if linkType == linkTypeLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			network = 0x0800
+		case 10, 24, 28, 30:
+			network = 0x86dd
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		network, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for (network == 0x8100 || network == 0x88a8) && len(data) >= 4 {
+			network, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case linkTypeRaw, 12, 14:
+		if len(data) == 0 {
+			return nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			network = 0x0800
+		case 6:
+			network = 0x86dd
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		network, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		network, data = binary.BigEndian.Uint16(data), data[20:]
+	default:
+		return nil, false
+	}
+
+	segment := &tcpSegment{}
+	switch network {
+	case 0x0800:
+		if len(data) < 20 || data[0]>>4 != 4 || data[9] != 6 {
+			return nil, false
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:]))
+		// fragments are not reassembled
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 || headerLen < 20 || totalLen < headerLen || totalLen > len(data) {
+			return nil, false
+		}
+		segment.src, segment.dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[headerLen:totalLen]
+	case 0x86dd:
+		if len(data) < 40 || data[0]>>4 != 6 || data[6] != 6 {
+			return nil, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+		if 40+payloadLen > len(data) {
+			return nil, false
+		}
+		segment.src, segment.dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40 : 40+payloadLen]
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	segment.srcPort = int(binary.BigEndian.Uint16(data))
+	segment.dstPort = int(binary.BigEndian.Uint16(data[2:]))
+	segment.seq = binary.BigEndian.Uint32(data[4:])
+	segment.syn = data[13]&0x02 != 0
+	segment.payload = data[offset:]
+	return segment, true
+}
+
+// tcpStream reassembles the data that one side of a TCP connection sent
+type tcpStream struct {
+	started bool
+	next    uint32
+	// early holds segments that arrived before the data that precedes them, by their sequence number
+	early map[uint32][]byte
+	data  []byte
+}
+
+// add adds the segment to the stream. Retransmitted data is dropped.
+func (s *tcpStream) add(seq uint32, syn bool, payload []byte) {
+	if syn {
+		s.started = true
+		s.next = seq + 1
+		return
+	}
+	if !s.started || len(payload) == 0 {
+		return
+	}
+	if int32(seq-s.next) > 0 {
+		if s.early == nil {
+			s.early = make(map[uint32][]byte)
+		}
+		if len(payload) > len(s.early[seq]) {
+			s.early[seq] = append([]byte(nil), payload...)
+		}
+		return
+	}
+	s.append(seq, payload)
+	for len(s.early) > 0 {
+		progress := false
+		for seq, payload := range s.early {
+			if int32(seq-s.next) <= 0 {
+				delete(s.early, seq)
+				s.append(seq, payload)
+				progress = true
+			}
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// append appends the part of payload that follows the data of the stream, given that it starts at seq
+// and seq is not after the end of the stream
+func (s *tcpStream) append(seq uint32, payload []byte) {
+	overlap := int(s.next - seq)
+	if overlap >= len(payload) {
+		return
+	}
+	s.data = append(s.data, payload[overlap:]...)
+	s.next += uint32(len(payload) - overlap)
+}
+
+// missing returns the number of bytes that arrived after a gap in the stream
+func (s *tcpStream) missing() int {
+	n := 0
+	for _, payload := range s.early {
+		n += len(payload)
+	}
+	return n
+}
+
+// phases of a captured connection
+const (
+	capturePhaseHandshake = iota
+	capturePhaseEncryption
+	capturePhaseStartup
+	capturePhaseRunning
+	capturePhaseDone
+)
+
+// capturedConn decodes the messages of a captured connection as its streams are reassembled
+type capturedConn struct {
+	*CapturedConnection
+	frontend tcpStream
+	backend  tcpStream
+	phase    int
+	cancel   bool
+	// outstanding is the number of Syncs and Queries that were sent and not answered by ReadyForQuery yet
+	outstanding int
+}
+
+// fail stops decoding the connection
+func (c *capturedConn) fail(err error) {
+	c.Err = err
+	c.phase = capturePhaseDone
+}
+
+// decode decodes the messages that were reassembled in both of the streams
+func (c *capturedConn) decode() {
+	for c.phase != capturePhaseDone && (c.decodeFrontend() || c.decodeBackend()) {
+	}
+}
+
+// decodeFrontend decodes the next message from the frontend, and tells whether one was decoded
+func (c *capturedConn) decodeFrontend() bool {
+	data := c.frontend.data
+	switch c.phase {
+	case capturePhaseEncryption:
+		return false
+	case capturePhaseHandshake:
+		if len(data) < 8 {
+			return false
+		}
+		length := int(binary.BigEndian.Uint32(data))
+		if length < 8 {
+			c.fail(fmt.Errorf("invalid startup packet length %d", length))
+			return false
+		}
+		if len(data) < length {
+			return false
+		}
+		c.frontend.data = data[length:]
+		switch binary.BigEndian.Uint32(data[4:]) {
+		case sslRequestCode, gssEncRequestCode:
+			c.phase = capturePhaseEncryption
+		case cancelRequestCode:
+			c.cancel = true
+			c.phase = capturePhaseDone
+		default:
+			c.phase = capturePhaseStartup
+		}
+		return true
+	}
+
+	if len(data) < 5 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(data[1:]))
+	if length < 4 {
+		c.fail(fmt.Errorf("invalid length %d of message %c", length, data[0]))
+		return false
+	}
+	if len(data) < length+1 {
+		return false
+	}
+	c.frontend.data = data[length+1:]
+	if c.phase != capturePhaseRunning {
+		// authentication is part of the startup sequence
+		return true
+	}
+	msg := newFrontendMessage(data[0])
+	if msg == nil {
+		c.fail(&UnknownMessageType{msgType: data[0]})
+		return false
+	}
+	if err := msg.Decode(data[5 : length+1]); err != nil {
+		c.fail(fmt.Errorf("failed to decode message %c: %s", data[0], err))
+		return false
+	}
+	if _, ok := msg.(*pgproto3.Terminate); ok {
+		// the connection is closed by the session that runs the story
+		c.phase = capturePhaseDone
+		return true
+	}
+	if c.outstanding > 0 {
+		c.Steps = append(c.Steps, &Pipelined{&Command{msg}})
+	} else {
+		c.Steps = append(c.Steps, &Command{msg})
+	}
+	if isSyncPoint(msg) {
+		c.outstanding++
+	}
+	return true
+}
+
+// decodeBackend decodes the next message from the backend, and tells whether one was decoded
+func (c *capturedConn) decodeBackend() bool {
+	data := c.backend.data
+	switch c.phase {
+	case capturePhaseHandshake:
+		return false
+	case capturePhaseEncryption:
+		if len(data) < 1 {
+			return false
+		}
+		if data[0] != 'N' {
+			c.fail(fmt.Errorf("the connection is encrypted"))
+			return false
+		}
+		c.backend.data = data[1:]
+		c.phase = capturePhaseHandshake
+		return true
+	}
+
+	if len(data) < 5 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(data[1:]))
+	if length < 4 {
+		c.fail(fmt.Errorf("invalid length %d of message %c", length, data[0]))
+		return false
+	}
+	if len(data) < length+1 {
+		return false
+	}
+	c.backend.data = data[length+1:]
+	if c.phase == capturePhaseStartup {
+		switch data[0] {
+		case 'Z':
+			c.phase = capturePhaseRunning
+		case 'E':
+			c.fail(fmt.Errorf("the startup sequence failed"))
+		}
+		return true
+	}
+	msg := newBackendMessage(data[0])
+	if msg == nil {
+		c.fail(&UnknownMessageType{msgType: data[0]})
+		return false
+	}
+	if err := msg.Decode(data[5 : length+1]); err != nil {
+		c.fail(fmt.Errorf("failed to decode message %c: %s", data[0], err))
+		return false
+	}
+	if _, ok := msg.(*pgproto3.ReadyForQuery); ok && c.outstanding > 0 {
+		c.outstanding--
+	}
+	c.Steps = append(c.Steps, &Response{msg})
+	return true
+}
+
+// newFrontendMessage returns an empty FrontendMessage of the provided type or nil if the type is unknown
+func newFrontendMessage(msgType byte) pgproto3.FrontendMessage {
+	switch msgType {
+	case 'B':
+		return &pgproto3.Bind{}
+	case 'C':
+		return &pgproto3.Close{}
+	case 'd':
+		return &pgproto3.CopyData{}
+	case 'D':
+		return &pgproto3.Describe{}
+	case 'E':
+		return &pgproto3.Execute{}
+	case 'H':
+		return &pgproto3.Flush{}
+	case 'P':
+		return &pgproto3.Parse{}
+	case 'p':
+		return &pgproto3.PasswordMessage{}
+	case 'Q':
+		return &pgproto3.Query{}
+	case 'S':
+		return &pgproto3.Sync{}
+	case 'X':
+		return &pgproto3.Terminate{}
+	}
+	return nil
+}
+
+// ReadCapture reads a capture of network traffic in the pcap or pcapng format from r, reassembles the TCP
+// connections to port and decodes the messages of each of them. Connections whose start was not captured
+// and cancel requests are skipped. Connections are returned in the order they were opened.
+func ReadCapture(r io.Reader, port int) ([]*CapturedConnection, error) {
+	conns := make(map[string]*capturedConn)
+	var order []*capturedConn
+	err := readPackets(r, func(linkType int, data []byte) error {
+		segment, ok := decodeSegment(linkType, data)
+		if !ok || (segment.dstPort != port && segment.srcPort != port) {
+			return nil
+		}
+		toServer := segment.dstPort == port
+		client := net.JoinHostPort(segment.src.String(), strconv.Itoa(segment.srcPort))
+		server := net.JoinHostPort(segment.dst.String(), strconv.Itoa(segment.dstPort))
+		if !toServer {
+			client, server = server, client
+		}
+		key := client + " " + server
+		c, ok := conns[key]
+		if !ok || (toServer && segment.syn && c.phase == capturePhaseDone) {
+			if !toServer || !segment.syn {
+				// the start of the connection was not captured
+				return nil
+			}
+			c = &capturedConn{CapturedConnection: &CapturedConnection{Client: client, Server: server}}
+			conns[key] = c
+			order = append(order, c)
+		}
+		if toServer {
+			c.frontend.add(segment.seq, segment.syn, segment.payload)
+		} else {
+			c.backend.add(segment.seq, segment.syn, segment.payload)
+		}
+		c.decode()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var captured []*CapturedConnection
+	for _, c := range order {
+		if c.cancel {
+			continue
+		}
+		if missing := c.frontend.missing() + c.backend.missing(); c.Err == nil && missing > 0 {
+			c.Err = fmt.Errorf("%d bytes were captured after a gap in the connection", missing)
+		}
+		clearSourceFields(c.Steps)
+		captured = append(captured, c.CapturedConnection)
+	}
+	return captured, nil
+}
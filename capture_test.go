@@ -0,0 +1,307 @@
+package pg_stories
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	"net"
+	"strings"
+	"testing"
+)
+
+// capturedPacket is a TCP segment to write in a test capture
+type capturedPacket struct {
+	toServer bool
+	seq      uint32
+	syn      bool
+	payload  []byte
+}
+
+// capturedFlow holds the addresses of a connection in a test capture and the packets that were sent on it
+type capturedFlow struct {
+	client, server         net.IP
+	clientPort, serverPort uint16
+	packets                []capturedPacket
+}
+
+// frame returns p as an ethernet frame of flow
+func (flow *capturedFlow) frame(p capturedPacket) []byte {
+	src, dst, srcPort, dstPort := flow.client, flow.server, flow.clientPort, flow.serverPort
+	if !p.toServer {
+		src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+	}
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], p.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x10
+	if p.syn {
+		tcp[13] = 0x02
+	}
+	tcp = append(tcp, p.payload...)
+
+	var network []byte
+	ethernetType := uint16(0x0800)
+	if src.To4() != nil {
+		network = make([]byte, 20)
+		network[0] = 0x45
+		binary.BigEndian.PutUint16(network[2:], uint16(20+len(tcp)))
+		network[8] = 64
+		network[9] = 6
+		copy(network[12:], src.To4())
+		copy(network[16:], dst.To4())
+	} else {
+		ethernetType = 0x86dd
+		network = make([]byte, 40)
+		network[0] = 0x60
+		binary.BigEndian.PutUint16(network[4:], uint16(len(tcp)))
+		network[6] = 6
+		copy(network[8:], src.To16())
+		copy(network[24:], dst.To16())
+	}
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], ethernetType)
+	return append(append(frame, network...), tcp...)
+}
+
+// writePcap returns the frames as a capture in the pcap format
+func writePcap(frames [][]byte) []byte {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	buf := bytes.NewBuffer(header)
+	for _, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		buf.Write(record)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// writePcapng returns the frames as a capture in the big endian pcapng format
+func writePcapng(frames [][]byte) []byte {
+	buf := &bytes.Buffer{}
+	block := func(blockType uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(body)+12))
+		binary.Write(buf, binary.BigEndian, blockType)
+		buf.Write(length)
+		buf.Write(body)
+		buf.Write(length)
+	}
+	section := make([]byte, 16)
+	binary.BigEndian.PutUint32(section, pcapngByteOrder)
+	binary.BigEndian.PutUint16(section[4:], 1)
+	binary.BigEndian.PutUint64(section[8:], ^uint64(0))
+	block(pcapngSectionType, section)
+	iface := make([]byte, 8)
+	binary.BigEndian.PutUint16(iface, linkTypeEthernet)
+	block(1, iface)
+	for _, frame := range frames {
+		packet := make([]byte, 20)
+		binary.BigEndian.PutUint32(packet[12:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(packet[16:], uint32(len(frame)))
+		block(6, append(packet, frame...))
+	}
+	return buf.Bytes()
+}
+
+func encodeMessages(messages ...pgproto3.Message) []byte {
+	var b []byte
+	for _, msg := range messages {
+		b = msg.Encode(b)
+	}
+	return b
+}
+
+// capturedSession returns the flow of a session that negotiates SSL, starts up, runs a query whose first
+// segment is retransmitted after its second one, and then pipelines a query after an extended query
+func capturedSession(client, server net.IP) *capturedFlow {
+	sslRequest := make([]byte, 8)
+	binary.BigEndian.PutUint32(sslRequest, 8)
+	binary.BigEndian.PutUint32(sslRequest[4:], sslRequestCode)
+	startup := encodeMessages(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	ready := encodeMessages(
+		&pgproto3.Authentication{Type: pgproto3.AuthTypeOk},
+		&pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+		&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	query := encodeMessages(&pgproto3.Query{String: "SELECT 1"})
+	result := encodeMessages(
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "?column?", DataTypeOID: 23}}},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("1")}},
+		&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	extended := encodeMessages(
+		&pgproto3.Parse{Query: "SELECT 2"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	pipelined := encodeMessages(&pgproto3.Query{String: "BEGIN"})
+	extendedResult := encodeMessages(
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("2")}},
+		&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		&pgproto3.CommandComplete{CommandTag: "BEGIN"},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	)
+	terminate := encodeMessages(&pgproto3.Terminate{})
+
+	clientSeq, serverSeq := uint32(1000), uint32(0xfffffff0)
+	flow := &capturedFlow{client: client, server: server, clientPort: 50000, serverPort: 5432}
+	send := func(toServer bool, payload []byte) {
+		seq := &serverSeq
+		if toServer {
+			seq = &clientSeq
+		}
+		flow.packets = append(flow.packets, capturedPacket{toServer: toServer, seq: *seq, payload: payload})
+		*seq += uint32(len(payload))
+	}
+	flow.packets = append(flow.packets,
+		capturedPacket{toServer: true, seq: clientSeq - 1, syn: true},
+		capturedPacket{toServer: false, seq: serverSeq - 1, syn: true})
+	send(true, sslRequest)
+	send(false, []byte{'N'})
+	send(true, startup)
+	send(false, ready)
+	first := capturedPacket{toServer: true, seq: clientSeq, payload: query[:3]}
+	flow.packets = append(flow.packets, capturedPacket{toServer: true, seq: clientSeq + 3, payload: query[3:]}, first, first)
+	clientSeq += uint32(len(query))
+	send(false, result[:7])
+	send(false, result[7:])
+	send(true, extended)
+	send(true, pipelined)
+	send(false, extendedResult)
+	send(true, terminate)
+	return flow
+}
+
+func TestReadCapture(t *testing.T) {
+	expected := strings.Join([]string{
+		`=== 10.0.0.1:50000 -> 10.0.0.2:5432`,
+		`-> Q "SELECT 1"`,
+		`<- T ["?column?"] [23]`,
+		`<- D ["1"]`,
+		`<- C "SELECT 1"`,
+		`<- Z I`,
+		`-> P "" "SELECT 2" []`,
+		`-> B "" "" []`,
+		`-> E "" 0`,
+		`-> S`,
+		`@pipeline`,
+		`-> Q "BEGIN"`,
+		`@end`,
+		`<- 1`,
+		`<- 2`,
+		`<- D ["2"]`,
+		`<- C "SELECT 1"`,
+		`<- Z I`,
+		`<- C "BEGIN"`,
+		`<- Z T`,
+		`===`,
+	}, "\n")
+
+	session := capturedSession(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"))
+	cancel := &capturedFlow{client: net.ParseIP("10.0.0.3"), server: net.ParseIP("10.0.0.2"), clientPort: 50001, serverPort: 5432}
+	cancelRequest := make([]byte, 16)
+	binary.BigEndian.PutUint32(cancelRequest, 16)
+	binary.BigEndian.PutUint32(cancelRequest[4:], cancelRequestCode)
+	cancel.packets = []capturedPacket{{toServer: true, seq: 1, syn: true}, {toServer: true, seq: 2, payload: cancelRequest}}
+	// the start of this connection is missing from the capture
+	partial := capturedSession(net.ParseIP("10.0.0.4"), net.ParseIP("10.0.0.2"))
+	partial.packets = partial.packets[4:]
+
+	var frames [][]byte
+	for i := 0; i < len(session.packets); i++ {
+		frames = append(frames, session.frame(session.packets[i]))
+		if i < len(cancel.packets) {
+			frames = append(frames, cancel.frame(cancel.packets[i]))
+		}
+		if i < len(partial.packets) {
+			frames = append(frames, partial.frame(partial.packets[i]))
+		}
+	}
+
+	for name, capture := range map[string][]byte{"pcap": writePcap(frames), "pcapng": writePcapng(frames)} {
+		t.Run("test "+name, func(t *testing.T) {
+			conns, err := ReadCapture(bytes.NewReader(capture), 5432)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conns) != 1 {
+				t.Fatalf("expected a single connection. got %d", len(conns))
+			}
+			if conns[0].Err != nil {
+				t.Fatal(conns[0].Err)
+			}
+			buf := &bytes.Buffer{}
+			if err := WriteStory(buf, conns[0].Name(), conns[0].Steps); err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(buf.String()) != expected {
+				t.Fatalf("expected transcript:\n%s\nactual:\n%s", expected, buf)
+			}
+		})
+	}
+
+	t.Run("test ipv6", func(t *testing.T) {
+		flow := capturedSession(net.ParseIP("fe80::1"), net.ParseIP("fe80::2"))
+		var frames [][]byte
+		for _, p := range flow.packets {
+			frames = append(frames, flow.frame(p))
+		}
+		conns, err := ReadCapture(bytes.NewReader(writePcap(frames)), 5432)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 1 || conns[0].Name() != "[fe80::1]:50000 -> [fe80::2]:5432" || len(conns[0].Steps) != 17 {
+			t.Fatalf("unexpected connections: %v", conns)
+		}
+	})
+
+	t.Run("test gap", func(t *testing.T) {
+		flow := capturedSession(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"))
+		var frames [][]byte
+		for i, p := range flow.packets {
+			// the first segment of the query is lost
+			if i != 7 && i != 8 {
+				frames = append(frames, flow.frame(p))
+			}
+		}
+		conns, err := ReadCapture(bytes.NewReader(writePcap(frames)), 5432)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 1 || conns[0].Err == nil {
+			t.Fatalf("expected a connection that failed on the gap. got %v", conns)
+		}
+		for _, step := range conns[0].Steps {
+			if _, ok := step.(*Command); ok {
+				t.Fatalf("expected no commands after the gap. got %s", describeStep(step))
+			}
+		}
+	})
+
+	t.Run("test invalid capture", func(t *testing.T) {
+		if _, err := ReadCapture(strings.NewReader("not a capture file at all"), 5432); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	stories "github.com/panoplyio/pg-stories"
+	"net"
+	"os"
+	"time"
+)
+
+// ignoreAsyncMessages ignores the messages that the backend may send at any time. Notifications
+// are kept in the inbox of the session, so they don't need to be ignored
+var ignoreAsyncMessages = stories.Ignore('S', 'K', 'N')
+
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:5432", "address of the backend")
+	user := fs.String("user", "postgres", "user to connect as. Only trust authentication is supported")
+	database := fs.String("database", "", "database to connect to. Defaults to the user name")
+	connections := fs.Int("c", 1, "number of concurrent connections")
+	duration := fs.Duration("d", 10*time.Second, "duration of every story. Zero means no time limit")
+	iterations := fs.Int("n", 0, "number of iterations of every story. Zero means no limit")
+	name := fs.String("story", "", "name of the story to run. All the stories run by default")
+	timeout := fs.Duration("timeout", 5*time.Second, "maximum time to wait for every response")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single transcript")
+	}
+
+	startup := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": *user},
+	}
+	if *database != "" {
+		startup.Parameters["database"] = *database
+	}
+	connect := func() (*stories.Session, error) {
+		conn, err := net.Dial("tcp", *addr)
+		if err != nil {
+			return nil, err
+		}
+		return stories.NewSession(conn)
+	}
+
+	parsed, err := readStories(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, story := range parsed {
+		if *name != "" && story.Name != *name {
+			continue
+		}
+		found = true
+		story.Ignore = append(story.Ignore, ignoreAsyncMessages)
+		story.StepTimeout = *timeout
+		b := &stories.Benchmark{
+			Story:       story,
+			Connect:     connect,
+			StartupSeq:  []stories.Step{&stories.Command{FrontendMessage: startup}},
+			Connections: *connections,
+			Duration:    *duration,
+			Iterations:  *iterations,
+			Timeout:     *timeout,
+		}
+		result, err := b.Run()
+		if err != nil {
+			return fmt.Errorf("%s: %s", story.Name, err)
+		}
+		fmt.Printf("=== %s\n", story.Name)
+		if err := result.Write(os.Stdout); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	if !found && *name != "" {
+		return fmt.Errorf("story %q not found", *name)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	stories "github.com/panoplyio/pg-stories"
+	"io/ioutil"
+	"os"
+)
+
+// readStories reads the stories of the file at path in the format of its extension. Files of other
+// extensions are read as transcripts
+func readStories(path string) ([]*stories.Story, error) {
+	format, err := stories.FormatOf(path)
+	if err != nil {
+		format = stories.FormatStory
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return stories.ReadStories(f, format)
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "", "format to convert to: story, json or yaml. Defaults to the format of the output file")
+	output := fs.String("o", "", "file to write the converted stories to. Defaults to the standard output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single story file")
+	}
+
+	format := stories.Format(*to)
+	if format == "" {
+		if *output == "" {
+			return fmt.Errorf("expected the format to convert to")
+		}
+		var err error
+		if format, err = stories.FormatOf(*output); err != nil {
+			return err
+		}
+	}
+	from, err := stories.FormatOf(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	doc, err := stories.ReadDocument(f, from)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := doc.Write(buf, format); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*output, buf.Bytes(), 0644)
+}
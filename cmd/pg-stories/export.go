@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	stories "github.com/panoplyio/pg-stories"
+	"io/ioutil"
+	"os"
+)
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	pkg := fs.String("package", "main", "package of the generated test file")
+	test := fs.String("test", "TestStories", "name of the generated test function")
+	run := fs.String("run", "runStory", "name of the function, defined by the package, that runs every story")
+	output := fs.String("o", "", "file to write the test to. Defaults to the standard output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single transcript")
+	}
+
+	parsed, err := readStories(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	g := &stories.GoTest{Package: *pkg, Test: *test, Run: *run, Source: fs.Arg(0)}
+	if err := g.Write(buf, parsed); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*output, buf.Bytes(), 0644)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	stories "github.com/panoplyio/pg-stories"
+	"io/ioutil"
+	"os"
+)
+
+func format(args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write the result to the transcript instead of the standard output")
+	list := fs.Bool("l", false, "list the transcripts whose formatting differs instead of printing them")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("expected transcripts to format")
+	}
+
+	for _, path := range fs.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if err := stories.FormatTranscript(buf, bytes.NewReader(src)); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		changed := !bytes.Equal(src, buf.Bytes())
+		if *list && changed {
+			fmt.Println(path)
+		}
+		if *write && changed {
+			if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				return err
+			}
+		}
+		if !*list && !*write {
+			if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	stories "github.com/panoplyio/pg-stories"
+	"io/ioutil"
+	"os"
+)
+
+func importCapture(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	port := fs.Int("port", 5432, "port of the backend in the capture")
+	output := fs.String("o", "", "file to write the transcript to. Defaults to the standard output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single pcap or pcapng capture")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	conns, err := stories.ReadCapture(f, *port)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, conn := range conns {
+		if conn.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", conn.Name(), conn.Err)
+		}
+		if len(conn.Steps) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: skipped, no messages after the startup sequence\n", conn.Name())
+			continue
+		}
+		story := &bytes.Buffer{}
+		if err := stories.WriteStory(story, conn.Name(), conn.Steps); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: skipped, %s\n", conn.Name(), err)
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		buf.Write(story.Bytes())
+	}
+	if buf.Len() == 0 {
+		return fmt.Errorf("no connections to port %d were captured", *port)
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*output, buf.Bytes(), 0644)
+}
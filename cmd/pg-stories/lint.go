@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	stories "github.com/panoplyio/pg-stories"
+)
+
+func lint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	simulate := fs.Bool("simulate", false, "also report the responses that differ from a simulation of the commands, or that are missing")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("expected story files to lint")
+	}
+
+	count := 0
+	for _, path := range fs.Args() {
+		all, err := readStories(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		for _, story := range all {
+			issues := stories.Lint(story)
+			if *simulate {
+				issues = append(issues, stories.CheckResponses(story)...)
+			}
+			for _, issue := range issues {
+				count++
+				if issue.Line > 0 {
+					fmt.Printf("%s:%d: %s: %s\n", path, issue.Line, story.Name, issue.Message)
+				} else {
+					fmt.Printf("%s: %s: step #%d: %s\n", path, story.Name, issue.Step, issue.Message)
+				}
+			}
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("found %d issues", count)
+	}
+	return nil
+}
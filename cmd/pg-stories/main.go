@@ -0,0 +1,69 @@
+// Command pg-stories runs tools over story transcripts.
+//
+// Usage:
+//
+//	pg-stories <command> [flags] <transcript>
+//
+// The commands are:
+//
+//	bench    run the stories of a transcript repeatedly and report their performance
+//	convert  convert stories between the transcript, JSON and YAML formats
+//	export   convert the stories of a transcript to a Go test
+//	fmt      rewrite transcripts in the canonical format
+//	import   convert a pcap or pcapng capture of postgres traffic to a transcript
+//	lint     check stories for protocol mistakes without running them
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a subcommand of pg-stories
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"bench":   {"run the stories of a transcript repeatedly and report their performance", bench},
+	"convert": {"convert stories between the transcript, JSON and YAML formats", convert},
+	"export":  {"convert the stories of a transcript to a Go test", export},
+	"fmt":     {"rewrite transcripts in the canonical format", format},
+	"import":  {"convert a pcap or pcapng capture of postgres traffic to a transcript", importCapture},
+	"lint":    {"check stories for protocol mistakes without running them", lint},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pg-stories <command> [flags] <transcript>")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "pg-stories: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "pg-stories %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,263 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// coverageFeatures are the variations of messages that Coverage reports on, in addition to their types
+var coverageFeatures = []struct {
+	name string
+	// frontend tells whether the feature is exercised by a sent or by a received message
+	frontend bool
+	match    func(msg pgproto3.Message) bool
+}{
+	{"Describe statement", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Describe)
+		return ok && m.ObjectType == 'S'
+	}},
+	{"Describe portal", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Describe)
+		return ok && m.ObjectType == 'P'
+	}},
+	{"Close statement", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Close)
+		return ok && m.ObjectType == 'S'
+	}},
+	{"Close portal", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Close)
+		return ok && m.ObjectType == 'P'
+	}},
+	{"Parse with parameter types", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Parse)
+		return ok && len(m.ParameterOIDs) > 0
+	}},
+	{"Bind with binary parameters", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Bind)
+		return ok && hasBinaryFormat(m.ParameterFormatCodes)
+	}},
+	{"Bind with binary results", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Bind)
+		return ok && hasBinaryFormat(m.ResultFormatCodes)
+	}},
+	{"Execute with MaxRows", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Execute)
+		return ok && m.MaxRows > 0
+	}},
+	{"Execute without MaxRows", true, func(msg pgproto3.Message) bool {
+		m, ok := msg.(*pgproto3.Execute)
+		return ok && m.MaxRows == 0
+	}},
+	{"COPY FROM STDIN", false, func(msg pgproto3.Message) bool {
+		_, ok := msg.(*pgproto3.CopyInResponse)
+		return ok
+	}},
+	{"COPY TO STDOUT", false, func(msg pgproto3.Message) bool {
+		_, ok := msg.(*pgproto3.CopyOutResponse)
+		return ok
+	}},
+	{"COPY BOTH", false, func(msg pgproto3.Message) bool {
+		_, ok := msg.(*pgproto3.CopyBothResponse)
+		return ok
+	}},
+	{"COPY in binary format", false, func(msg pgproto3.Message) bool {
+		switch m := msg.(type) {
+		case *pgproto3.CopyInResponse:
+			return m.OverallFormat == 1
+		case *pgproto3.CopyOutResponse:
+			return m.OverallFormat == 1
+		case *pgproto3.CopyBothResponse:
+			return m.OverallFormat == 1
+		}
+		return false
+	}},
+}
+
+// hasBinaryFormat tells whether any of the format codes is binary
+func hasBinaryFormat(codes []int16) bool {
+	for _, code := range codes {
+		if code == pgproto3.BinaryFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTypes returns the names of the types of messages that newMessage knows
+func messageTypes(newMessage func(msgType byte) pgproto3.Message) []string {
+	var names []string
+	for t := 0; t < 256; t++ {
+		if msg := newMessage(byte(t)); msg != nil {
+			names = append(names, messageTypeName(msg))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	// frontendTypes are the types of the messages that can be sent by a story
+	frontendTypes = messageTypes(func(msgType byte) pgproto3.Message {
+		if msg := newFrontendMessage(msgType); msg != nil {
+			return msg
+		}
+		if msgType == 0 {
+			// StartupMessage has no type
+			return &pgproto3.StartupMessage{}
+		}
+		return nil
+	})
+	// backendTypes are the types of the messages that can be received by a story
+	backendTypes = messageTypes(func(msgType byte) pgproto3.Message {
+		if msg := newBackendMessage(msgType); msg != nil {
+			return msg
+		}
+		return nil
+	})
+)
+
+// Coverage collects which parts of the protocol are exercised by the messages that stories send and
+// receive: the types of the messages, the codes of the errors and variations such as the object types
+// of Describe and Close, Execute with MaxRows and the modes of COPY. Set the same Coverage on all the
+// stories of a suite to aggregate over them. A zero Coverage is ready to use and it is safe to use it
+// from concurrent stories.
+type Coverage struct {
+	mu         sync.Mutex
+	frontend   map[string]int
+	backend    map[string]int
+	errorCodes map[string]int
+	features   map[string]int
+}
+
+// increment increments the count of key in m, creating it if needed
+func increment(m *map[string]int, key string) {
+	if *m == nil {
+		*m = make(map[string]int)
+	}
+	(*m)[key]++
+}
+
+// Sent records msg that is sent to the backend. Raw messages are not covered
+func (c *Coverage) Sent(msg pgproto3.FrontendMessage) {
+	if _, ok := msg.(*RawMessage); ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	increment(&c.frontend, messageTypeName(msg))
+	c.matchFeatures(msg, true)
+}
+
+// Received records msg that is received from the backend
+func (c *Coverage) Received(msg pgproto3.BackendMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	increment(&c.backend, messageTypeName(msg))
+	if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+		increment(&c.errorCodes, e.Code)
+	}
+	c.matchFeatures(msg, false)
+}
+
+func (c *Coverage) matchFeatures(msg pgproto3.Message, frontend bool) {
+	for _, f := range coverageFeatures {
+		if f.frontend == frontend && f.match(msg) {
+			increment(&c.features, f.name)
+		}
+	}
+}
+
+// CoverageItem is a part of the protocol and the number of times it was exercised
+type CoverageItem struct {
+	Name  string
+	Count int
+}
+
+// CoverageReport lists the parts of the protocol that were exercised, including those that were not
+// exercised at all, whose Count is zero. Only the error codes that were received are listed.
+type CoverageReport struct {
+	Frontend   []CoverageItem
+	Backend    []CoverageItem
+	ErrorCodes []CoverageItem
+	Features   []CoverageItem
+}
+
+// coverageItems returns an item for every one of names and for every other key of counts
+func coverageItems(names []string, counts map[string]int) []CoverageItem {
+	items := make([]CoverageItem, 0, len(names))
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+		items = append(items, CoverageItem{Name: name, Count: counts[name]})
+	}
+	var others []string
+	for name := range counts {
+		if !known[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		items = append(items, CoverageItem{Name: name, Count: counts[name]})
+	}
+	return items
+}
+
+// Report returns what was exercised so far
+func (c *Coverage) Report() *CoverageReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	features := make([]string, 0, len(coverageFeatures))
+	for _, f := range coverageFeatures {
+		features = append(features, f.name)
+	}
+	return &CoverageReport{
+		Frontend:   coverageItems(frontendTypes, c.frontend),
+		Backend:    coverageItems(backendTypes, c.backend),
+		ErrorCodes: coverageItems(nil, c.errorCodes),
+		Features:   coverageItems(features, c.features),
+	}
+}
+
+// unexercised returns the names of the items that were not exercised
+func unexercised(items []CoverageItem) []string {
+	var names []string
+	for _, item := range items {
+		if item.Count == 0 {
+			names = append(names, item.Name)
+		}
+	}
+	return names
+}
+
+// Write writes a table of every section of the report followed by the items that were not exercised to w
+func (r *CoverageReport) Write(w io.Writer) error {
+	sections := []struct {
+		title string
+		items []CoverageItem
+	}{
+		{"frontend messages", r.Frontend},
+		{"backend messages", r.Backend},
+		{"error codes", r.ErrorCodes},
+		{"features", r.Features},
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, s := range sections {
+		exercised := len(s.items) - len(unexercised(s.items))
+		fmt.Fprintf(tw, "%s: %d/%d exercised\n", s.title, exercised, len(s.items))
+		for _, item := range s.items {
+			if item.Count > 0 {
+				fmt.Fprintf(tw, "  %s\t%d\n", item.Name, item.Count)
+			}
+		}
+		if missing := unexercised(s.items); len(missing) > 0 {
+			fmt.Fprintf(tw, "  not exercised: %s\n", strings.Join(missing, ", "))
+		}
+	}
+	return tw.Flush()
+}
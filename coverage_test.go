@@ -0,0 +1,103 @@
+package pg_stories
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"testing"
+	"time"
+)
+
+// coverageItem returns the item of items with the provided name
+func coverageItem(t *testing.T, items []CoverageItem, name string) CoverageItem {
+	for _, item := range items {
+		if item.Name == name {
+			return item
+		}
+	}
+	t.Fatalf("expected %s to be listed in %v", name, items)
+	return CoverageItem{}
+}
+
+func TestCoverage(t *testing.T) {
+
+	t.Run("test message types", func(t *testing.T) {
+		report := (&Coverage{}).Report()
+		for msgType := byte(' '); msgType <= '~'; msgType++ {
+			if msg := newBackendMessage(msgType); msg != nil {
+				coverageItem(t, report.Backend, messageTypeName(msg))
+			}
+			parser := &tokenParser{bufio.NewReader(strings.NewReader(""))}
+			if _, err := (&Builder{}).parseCommand(msgType, parser); err != nil {
+				if _, unknown := err.(*UnknownMessageType); unknown {
+					continue
+				}
+			}
+			msg := newFrontendMessage(msgType)
+			if msg == nil {
+				t.Fatalf("expected the type of command %c to be covered", msgType)
+			}
+			coverageItem(t, report.Frontend, messageTypeName(msg))
+		}
+	})
+
+	t.Run("test aggregated stories", func(t *testing.T) {
+		coverage := &Coverage{}
+		for _, code := range []string{ErrorInvalidSqlStatementName, ErrorInvalidCursorName} {
+			story := &Story{
+				Frontend: pipeFrontend(t, answerQueries(
+					&pgproto3.ErrorResponse{Severity: "ERROR", Code: code},
+					&pgproto3.ReadyForQuery{TxStatus: 'I'},
+				)),
+				Steps: []Step{
+					&Command{&pgproto3.Query{String: "EXECUTE baa"}},
+					&Response{&pgproto3.ErrorResponse{Code: code}},
+					&Response{&pgproto3.ReadyForQuery{}},
+				},
+				Coverage:    coverage,
+				StepTimeout: time.Second,
+			}
+			if err := story.Run(t, make(chan interface{})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		coverage.Sent(&pgproto3.Describe{ObjectType: 'P'})
+		coverage.Sent(&pgproto3.Execute{MaxRows: 10})
+		coverage.Received(&pgproto3.CopyOutResponse{OverallFormat: 1})
+
+		report := coverage.Report()
+		expected := map[string]struct {
+			items []CoverageItem
+			count int
+		}{
+			"Query":                      {report.Frontend, 2},
+			"Parse":                      {report.Frontend, 0},
+			"ReadyForQuery":              {report.Backend, 2},
+			"ErrorResponse":              {report.Backend, 2},
+			"CopyOutResponse":            {report.Backend, 1},
+			ErrorInvalidSqlStatementName: {report.ErrorCodes, 1},
+			ErrorInvalidCursorName:       {report.ErrorCodes, 1},
+			"Describe portal":            {report.Features, 1},
+			"Describe statement":         {report.Features, 0},
+			"Execute with MaxRows":       {report.Features, 1},
+			"COPY TO STDOUT":             {report.Features, 1},
+			"COPY in binary format":      {report.Features, 1},
+		}
+		for name, e := range expected {
+			if item := coverageItem(t, e.items, name); item.Count != e.count {
+				t.Fatalf("expected %s to be exercised %d times. got %d", name, e.count, item.Count)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		if err := report.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"error codes: 2/2 exercised", "not exercised: Bind, Close", "Describe portal"} {
+			if !strings.Contains(buf.String(), s) {
+				t.Fatalf("expected the report to contain %q. got:\n%s", s, buf)
+			}
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"testing"
+	"time"
+)
+
+// DivergenceError is returned by Differential when the target backend does not respond the same as
+// the reference backend
+type DivergenceError struct {
+	step      int
+	index     int
+	reference pgproto3.BackendMessage
+	target    pgproto3.BackendMessage
+	err       error
+}
+
+func (e *DivergenceError) Error() string {
+	msg := fmt.Sprintf("backends diverged on response #%d to step #%d. reference: %s. target: %s",
+		e.index, e.step, describeDivergent(e.reference), describeDivergent(e.target))
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// describeDivergent returns a response of a DivergenceError as it is defined in a transcript, where nil
+// is a response that was not received
+func describeDivergent(msg pgproto3.BackendMessage) string {
+	if msg == nil {
+		return "none"
+	}
+	return describeResponse(msg)
+}
+
+// Differential runs the Commands of a story against a reference backend and a target backend and
+// reports any divergence between the messages they send back, so no Response steps are needed.
+// The caller owns the connections of Reference and Target and closes them once done, which also ends
+// the goroutines that receive their messages.
+type Differential struct {
+	// Reference communicates with the backend that is considered correct, usually upstream postgres
+	Reference *pgproto3.Frontend
+	// Target communicates with the tested backend
+	Target *pgproto3.Frontend
+	// Steps is a sequence of Step. Only Commands are used
+	Steps []Step
+	// Filter is a function that tells which responses should be compared
+	Filter func(pgproto3.BackendMessage) bool
+	// CompareFields tells whether the field values of the responses are compared and not only their types.
+	// Values are compared as Response steps compare them, and the source fields of errors are not compared
+	CompareFields bool
+	// CompareParameters tells whether BackendKeyData and ParameterStatus are compared as well. They are
+	// skipped by default, as the process IDs and server parameters such as server_version differ between
+	// backends
+	CompareParameters bool
+	// Timeout is the maximum time to wait for ReadyForQuery from each backend. Zero waits forever
+	Timeout time.Duration
+}
+
+// compare returns an error if target is not considered equal to reference
+func (d *Differential) compare(reference, target pgproto3.BackendMessage) error {
+	if !d.CompareFields {
+		if reference.Encode(nil)[0] != target.Encode(nil)[0] {
+			return fmt.Errorf("wrong type of message. expected: %T. got %T", reference, target)
+		}
+		return nil
+	}
+	expected := &Response{copyBackendMessage(reference)}
+	clearSourceFields([]Step{expected})
+	return expected.Compare(target)
+}
+
+// compared returns the responses that are compared, without the ones that are skipped by default
+func (d *Differential) compared(responses []pgproto3.BackendMessage) []pgproto3.BackendMessage {
+	if d.CompareParameters {
+		return responses
+	}
+	var kept []pgproto3.BackendMessage
+	for _, msg := range responses {
+		switch msg.(type) {
+		case *pgproto3.BackendKeyData, *pgproto3.ParameterStatus:
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// Run sends every Command to both backends. After every Sync, Query or StartupMessage it waits for
+// ReadyForQuery from both and compares the received messages. A Query that a backend discards after an
+// error in an extended query is not waited for. A Sync is sent if the story leaves the backends waiting
+// for one. Terminate ends the story, as the backends close the connections.
+func (d *Differential) Run(t *testing.T) error {
+	reference := sessionOf(d.Reference)
+	target := sessionOf(d.Target)
+	referenceState := &syncState{synced: true}
+	targetState := &syncState{synced: true}
+
+	// compareResponses waits for the backends that answer the last command, as one of them may discard
+	// a Query that the other answers
+	compareResponses := func(step int, referenceReady, targetReady bool) error {
+		var referenceResponses, targetResponses []pgproto3.BackendMessage
+		var err error
+		if referenceReady {
+			if referenceResponses, err = reference.untilReady(d.Timeout, d.Filter, referenceState); err != nil {
+				return fmt.Errorf("reference backend failed on step #%d: %s", step, err)
+			}
+		}
+		if targetReady {
+			if targetResponses, err = target.untilReady(d.Timeout, d.Filter, targetState); err != nil {
+				return fmt.Errorf("target backend failed on step #%d: %s", step, err)
+			}
+		}
+		for _, msg := range referenceResponses {
+			t.Logf("<<== %s (reference)\n", describeResponse(msg))
+		}
+		for _, msg := range targetResponses {
+			t.Logf("<<== %s (target)\n", describeResponse(msg))
+		}
+		referenceResponses = d.compared(referenceResponses)
+		targetResponses = d.compared(targetResponses)
+		for i := range referenceResponses {
+			if i >= len(targetResponses) {
+				return &DivergenceError{step: step, index: i, reference: referenceResponses[i]}
+			}
+			if err := d.compare(referenceResponses[i], targetResponses[i]); err != nil {
+				return &DivergenceError{step: step, index: i, reference: referenceResponses[i], target: targetResponses[i], err: err}
+			}
+		}
+		if len(targetResponses) > len(referenceResponses) {
+			i := len(referenceResponses)
+			return &DivergenceError{step: step, index: i, target: targetResponses[i]}
+		}
+		return nil
+	}
+
+	for i, step := range d.Steps {
+		cmd, ok := commandOf(step)
+		if !ok {
+			continue
+		}
+		t.Logf("==>> %s\n", describeCommand(cmd.FrontendMessage))
+		referenceReady := referenceState.sent(cmd.FrontendMessage)
+		targetReady := targetState.sent(cmd.FrontendMessage)
+		if err := d.Reference.Send(cmd.FrontendMessage); err != nil {
+			return err
+		}
+		if err := d.Target.Send(cmd.FrontendMessage); err != nil {
+			return err
+		}
+		if _, ok := cmd.FrontendMessage.(*pgproto3.Terminate); ok {
+			return nil
+		}
+		if !referenceReady && !targetReady {
+			continue
+		}
+		if err := compareResponses(i, referenceReady, targetReady); err != nil {
+			return err
+		}
+	}
+
+	if referenceState.synced && targetState.synced {
+		return nil
+	}
+	sync := &pgproto3.Sync{}
+	referenceState.sent(sync)
+	targetState.sent(sync)
+	if err := d.Reference.Send(sync); err != nil {
+		return err
+	}
+	if err := d.Target.Send(sync); err != nil {
+		return err
+	}
+	return compareResponses(len(d.Steps), true, true)
+}
@@ -0,0 +1,138 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDifferential_Run(t *testing.T) {
+
+	responses := []pgproto3.BackendMessage{
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "column1"}}},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("baa")}},
+		&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}
+	steps := []Step{
+		&Command{&pgproto3.Query{String: SimpleQuery}},
+	}
+
+	t.Run("test same responses", func(t *testing.T) {
+		d := &Differential{
+			Reference:     pipeFrontend(t, answerQueries(responses...)),
+			Target:        pipeFrontend(t, answerQueries(responses...)),
+			Steps:         steps,
+			CompareFields: true,
+			Timeout:       time.Second,
+		}
+		if err := d.Run(t); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test missing response", func(t *testing.T) {
+		d := &Differential{
+			Reference: pipeFrontend(t, answerQueries(responses...)),
+			Target:    pipeFrontend(t, answerQueries(responses[0], responses[2], responses[3])),
+			Steps:     steps,
+			Timeout:   time.Second,
+		}
+		err := d.Run(t)
+		if _, ok := err.(*DivergenceError); !ok {
+			t.Fatalf("expected: DivergenceError. got: %T", err)
+		}
+	})
+
+	t.Run("test different field values", func(t *testing.T) {
+		target := append([]pgproto3.BackendMessage{}, responses...)
+		target[1] = &pgproto3.DataRow{Values: [][]byte{[]byte("foo")}}
+		d := &Differential{
+			Reference: pipeFrontend(t, answerQueries(responses...)),
+			Target:    pipeFrontend(t, answerQueries(target...)),
+			Steps:     steps,
+			Timeout:   time.Second,
+		}
+		if err := d.Run(t); err != nil {
+			t.Fatalf("expected field values to be ignored. got: %s", err)
+		}
+		d.Reference = pipeFrontend(t, answerQueries(responses...))
+		d.Target = pipeFrontend(t, answerQueries(target...))
+		d.CompareFields = true
+		if _, ok := d.Run(t).(*DivergenceError); !ok {
+			t.Fatalf("expected: DivergenceError")
+		}
+	})
+
+	t.Run("test backend specific fields", func(t *testing.T) {
+		failure := func(file, version string, pid uint32) func(*pgproto3.Backend) error {
+			return answerQueries(
+				&pgproto3.ParameterStatus{Name: "server_version", Value: version},
+				&pgproto3.BackendKeyData{ProcessID: pid, SecretKey: pid},
+				&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error", File: file, Line: int32(pid)},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			)
+		}
+		d := &Differential{
+			Reference:     pipeFrontend(t, failure("scan.l", "12.1", 1)),
+			Target:        pipeFrontend(t, failure("parser.go", "9.6", 2)),
+			Steps:         steps,
+			CompareFields: true,
+			Timeout:       time.Second,
+		}
+		if err := d.Run(t); err != nil {
+			t.Fatalf("expected backend specific fields to be skipped. got: %s", err)
+		}
+		d.Reference = pipeFrontend(t, failure("scan.l", "12.1", 1))
+		d.Target = pipeFrontend(t, failure("scan.l", "9.6", 1))
+		d.CompareParameters = true
+		err := d.Run(t)
+		if _, ok := err.(*DivergenceError); !ok {
+			t.Fatalf("expected: DivergenceError. got: %v", err)
+		}
+		if !strings.Contains(err.Error(), `reference: S "server_version" "12.1"`) {
+			t.Fatalf("expected the divergent responses as they are defined in a transcript. got: %s", err)
+		}
+	})
+
+	t.Run("test query after failed extended query", func(t *testing.T) {
+		reference, err := connectSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reference.Close()
+		target, err := connectSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		failed := append(startupSeq(),
+			&Command{&pgproto3.Parse{Query: "SELEC 1"}},
+			&Command{&pgproto3.Query{String: "SELECT 1"}},
+		)
+		d := &Differential{
+			Reference:     reference.Frontend,
+			Target:        target.Frontend,
+			Steps:         failed,
+			CompareFields: true,
+			Timeout:       time.Second,
+		}
+		if err := d.Run(t); err != nil {
+			t.Fatalf("expected the discarded query not to be waited for. got: %s", err)
+		}
+	})
+
+	t.Run("test terminate", func(t *testing.T) {
+		d := &Differential{
+			Reference: pipeFrontend(t, answerQueries(responses...)),
+			Target:    pipeFrontend(t, answerQueries(responses...)),
+			Steps:     append(steps, &Command{&pgproto3.Terminate{}}),
+			Timeout:   100 * time.Millisecond,
+		}
+		if err := d.Run(t); err != nil {
+			t.Fatalf("expected terminate to end the story. got: %s", err)
+		}
+	})
+
+}
@@ -0,0 +1,755 @@
+package pg_stories
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Format is a format of a file that defines stories
+type Format string
+
+const (
+	// FormatStory is the line based format of transcripts that Builder parses
+	FormatStory Format = "story"
+	FormatJSON  Format = "json"
+	FormatYAML  Format = "yaml"
+)
+
+// FormatOf returns the format of the file at path by its extension
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".story":
+		return FormatStory, nil
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	}
+	return "", fmt.Errorf("unknown format of %s. expected one of .story, .json, .yaml and .yml", path)
+}
+
+// Document holds stories in a structure that can be written as JSON or YAML, for tools that generate
+// stories rather than write transcripts
+type Document struct {
+	// Ignore are the types of the responses that all the stories ignore, like an @ignore directive
+	// before the first story of a transcript
+	Ignore  []string         `json:"ignore,omitempty" yaml:"ignore,omitempty"`
+	Stories []*StoryDocument `json:"stories" yaml:"stories"`
+}
+
+// StoryDocument is a story in a Document
+type StoryDocument struct {
+	Name string `json:"name" yaml:"name"`
+	// Simulate fills in the responses that follow from the commands of the story, like a @simulate directive
+	Simulate bool            `json:"simulate,omitempty" yaml:"simulate,omitempty"`
+	Steps    []*StepDocument `json:"steps" yaml:"steps"`
+}
+
+// StepDocument is a step of a story in a Document. Exactly one of Send, Receive, Row, Rows, Silence,
+// Assert and Ignore is set. Ignore is not a step: it ignores responses from the following step on,
+// like an @ignore directive.
+type StepDocument struct {
+	// Send is the type of a command, e.g. Q
+	Send string `json:"send,omitempty" yaml:"send,omitempty"`
+	// Receive is the type of a response, e.g. C
+	Receive string `json:"receive,omitempty" yaml:"receive,omitempty"`
+	// Fields are the fields of the message by the names of the fields of its pgproto3 type, e.g.
+	// commandTag. Responses compare only the fields that are set. A with channel and payload fields
+	// expects a notification, and S with name and value fields expects a reported parameter
+	Fields map[string]interface{} `json:"fields,omitempty" yaml:"fields,omitempty"`
+	// Pipelined sends the command without waiting for the responses to the previous ones
+	Pipelined bool `json:"pipelined,omitempty" yaml:"pipelined,omitempty"`
+	// Match is a regular expression that the text of the response matches, wholly unless Partial is set
+	Match   string `json:"match,omitempty" yaml:"match,omitempty"`
+	Partial bool   `json:"partial,omitempty" yaml:"partial,omitempty"`
+	// Order is either before or after, requiring a notification to arrive before or after ReadyForQuery
+	Order string `json:"order,omitempty" yaml:"order,omitempty"`
+	// Within is the maximum time to wait for the response, e.g. 200ms
+	Within string `json:"within,omitempty" yaml:"within,omitempty"`
+	// Row are the values of an expected data row in text format, where null is NULL
+	Row []*string `json:"row,omitempty" yaml:"row,omitempty"`
+	// Rows are the values of expected data rows that may arrive in any order
+	Rows [][]*string `json:"rows,omitempty" yaml:"rows,omitempty"`
+	// Silence is a duration in which no response may arrive
+	Silence string `json:"silence,omitempty" yaml:"silence,omitempty"`
+	// Assert checks the last reported value of a parameter
+	Assert *AssertionDocument `json:"assert,omitempty" yaml:"assert,omitempty"`
+	// Ignore are the types of the responses to ignore from the following step on
+	Ignore []string `json:"ignore,omitempty" yaml:"ignore,omitempty"`
+}
+
+// AssertionDocument is the assertion of a parameter in a StepDocument
+type AssertionDocument struct {
+	Param string `json:"param" yaml:"param"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// ReadDocument reads a Document in the provided format from r
+func ReadDocument(r io.Reader, format Format) (*Document, error) {
+	doc := &Document{}
+	switch format {
+	case FormatStory:
+		var stories []*Story
+		builder := NewBuilder(r)
+		for {
+			story, _, err := builder.ParseNext()
+			if err != nil {
+				return nil, err
+			}
+			if story == nil {
+				break
+			}
+			stories = append(stories, story)
+		}
+		return NewDocument(stories, builder.ignore)
+	case FormatJSON:
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(doc); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return doc, nil
+}
+
+// ReadStories reads the stories that are defined in the provided format from r, each starting with startupSeq
+func ReadStories(r io.Reader, format Format, startupSeq ...Step) ([]*Story, error) {
+	if format == FormatStory {
+		var stories []*Story
+		builder := NewBuilder(r, startupSeq...)
+		for {
+			story, _, err := builder.ParseNext()
+			if err != nil || story == nil {
+				return stories, err
+			}
+			stories = append(stories, story)
+		}
+	}
+	doc, err := ReadDocument(r, format)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Build(startupSeq...)
+}
+
+// NewDocument returns a Document of stories, where rules are the ignore rules that all of them start with
+func NewDocument(stories []*Story, rules IgnoreRules) (*Document, error) {
+	doc := &Document{}
+	for _, rule := range rules {
+		doc.Ignore = append(doc.Ignore, ignoreTypes(rule)...)
+	}
+	for _, story := range stories {
+		storyDoc := &StoryDocument{Name: story.Name}
+		storyRules := story.Ignore
+		if len(storyRules) >= len(rules) {
+			storyRules = storyRules[len(rules):]
+		}
+		for i := 0; i <= len(story.Steps); i++ {
+			for _, rule := range storyRules {
+				if rule.From == i {
+					storyDoc.Steps = append(storyDoc.Steps, &StepDocument{Ignore: ignoreTypes(rule)})
+				}
+			}
+			if i == len(story.Steps) {
+				break
+			}
+			step, err := newStepDocument(story.Steps[i])
+			if err != nil {
+				return nil, fmt.Errorf("story %q, step #%d: %s", story.Name, i, err)
+			}
+			storyDoc.Steps = append(storyDoc.Steps, step)
+		}
+		doc.Stories = append(doc.Stories, storyDoc)
+	}
+	return doc, nil
+}
+
+// Build returns the stories of the document, each starting with startupSeq, like Builder.ParseNext
+// returns the stories of a transcript
+func (d *Document) Build(startupSeq ...Step) ([]*Story, error) {
+	rule, err := ignoreRule(d.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	var stories []*Story
+	for _, storyDoc := range d.Stories {
+		story := &Story{Name: storyDoc.Name, Steps: append([]Step(nil), startupSeq...)}
+		if len(rule.Types) > 0 {
+			story.Ignore = append(story.Ignore, rule)
+		}
+		for i, stepDoc := range storyDoc.Steps {
+			if stepDoc.kinds() != 1 {
+				return nil, fmt.Errorf("story %q, step #%d: expected exactly one of send, receive, row, rows, silence, assert and ignore", storyDoc.Name, i)
+			}
+			if stepDoc.Ignore != nil {
+				rule, err := ignoreRule(stepDoc.Ignore)
+				if err != nil {
+					return nil, fmt.Errorf("story %q, step #%d: %s", storyDoc.Name, i, err)
+				}
+				// like in a transcript, rules before the first step also apply to the startup sequence
+				if len(story.Steps) > len(startupSeq) {
+					rule.From = len(story.Steps)
+				}
+				story.Ignore = append(story.Ignore, rule)
+				continue
+			}
+			step, err := stepDoc.step()
+			if err != nil {
+				return nil, fmt.Errorf("story %q, step #%d: %s", storyDoc.Name, i, err)
+			}
+			story.Steps = append(story.Steps, step)
+		}
+		if len(story.Steps) == len(startupSeq) {
+			return nil, fmt.Errorf("story %q: %s", storyDoc.Name, &EmptyStoryError{})
+		}
+		if storyDoc.Simulate {
+			var issues []LintIssue
+			if story, issues = Simulate(story); len(issues) > 0 {
+				return nil, fmt.Errorf("story %q: %s", storyDoc.Name, &SimulationError{issues})
+			}
+		}
+		stories = append(stories, story)
+	}
+	return stories, nil
+}
+
+// Write writes the document to w in the provided format
+func (d *Document) Write(w io.Writer, format Format) error {
+	switch format {
+	case FormatStory:
+		stories, err := d.Build()
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if len(d.Ignore) > 0 {
+			fmt.Fprintf(buf, "%s %s\n\n", TokenIgnore, strings.Join(d.Ignore, string(TokenIgnoreDelimiter)+" "))
+		}
+		for _, story := range stories {
+			rules := story.Ignore
+			if len(d.Ignore) > 0 {
+				rules = rules[1:]
+			}
+			if err := writeStory(buf, story.Name, story.Steps, rules); err != nil {
+				return err
+			}
+		}
+		_, err = w.Write(buf.Bytes())
+		return err
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(d)
+	case FormatYAML:
+		b, err := yaml.Marshal(d)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// ignoreTypes returns the types of rule as they are written in a document
+func ignoreTypes(rule IgnoreRule) []string {
+	types := make([]string, 0, len(rule.Types))
+	for _, t := range rule.Types {
+		types = append(types, string(t))
+	}
+	return types
+}
+
+// ignoreRule returns a rule that ignores the types of messages, which are written as in a document
+func ignoreRule(types []string) (IgnoreRule, error) {
+	rule := IgnoreRule{}
+	for _, t := range types {
+		if len(t) != 1 || newBackendMessage(t[0]) == nil {
+			return rule, fmt.Errorf("unknown message type %q to ignore", t)
+		}
+		rule.Types = append(rule.Types, t[0])
+	}
+	return rule, nil
+}
+
+// messageType returns the type of msg as it is written in a document
+func messageType(msg pgproto3.Message) (string, error) {
+	if _, ok := msg.(*pgproto3.StartupMessage); ok {
+		return "", fmt.Errorf("%T has no type", msg)
+	}
+	return string(msg.Encode(nil)[0]), nil
+}
+
+// newStepDocument returns step as it is written in a document
+func newStepDocument(step Step) (*StepDocument, error) {
+	switch s := step.(type) {
+	case *Command:
+		t, err := messageType(s.FrontendMessage)
+		if err != nil {
+			return nil, err
+		}
+		fields := messageFields(s.FrontendMessage)
+		if bind, ok := s.FrontendMessage.(*pgproto3.Bind); ok && len(bind.Parameters) > 0 {
+			fields["parameters"] = documentParameters(bind)
+		}
+		return &StepDocument{Send: t, Fields: fields}, nil
+	case *Pipelined:
+		doc, err := newStepDocument(s.Command)
+		if err == nil {
+			doc.Pipelined = true
+		}
+		return doc, err
+	case *Response:
+		t, err := messageType(s.BackendMessage)
+		if err != nil {
+			return nil, err
+		}
+		return &StepDocument{Receive: t, Fields: messageFields(s.BackendMessage)}, nil
+	case *Expectation:
+		doc, err := newStepDocument(s.Response)
+		if err != nil {
+			return nil, err
+		}
+		doc.Within = formatWithin(s.Within)
+		for _, matcher := range s.Matchers {
+			m, ok := matcher.(*RegexpMatcher)
+			if !ok || doc.Match != "" {
+				return nil, &UnsupportedStepError{step}
+			}
+			doc.Match, doc.Partial = m.Regexp.String(), m.Partial
+		}
+		return doc, nil
+	case *Row:
+		return &StepDocument{Row: documentValues(s.Values), Within: formatWithin(s.Within)}, nil
+	case *RowSet:
+		doc := &StepDocument{Rows: [][]*string{}}
+		for _, row := range s.Rows {
+			doc.Rows = append(doc.Rows, documentValues(row.Values))
+		}
+		return doc, nil
+	case *Silence:
+		return &StepDocument{Silence: s.Duration.String()}, nil
+	case *Notification:
+		doc := &StepDocument{Receive: "A", Fields: map[string]interface{}{}, Within: formatWithin(s.Within)}
+		if s.Channel != "" {
+			doc.Fields["channel"] = s.Channel
+		}
+		if !s.AnyPayload {
+			doc.Fields["payload"] = s.Payload
+		}
+		switch s.Order {
+		case BeforeReady:
+			doc.Order = TokenBefore
+		case AfterReady:
+			doc.Order = TokenAfter
+		}
+		return doc, nil
+	case *Parameter:
+		return &StepDocument{
+			Receive: "S",
+			Fields:  map[string]interface{}{"name": s.Name, "value": s.Value},
+			Within:  formatWithin(s.Within),
+		}, nil
+	case *ParameterAssertion:
+		return &StepDocument{Assert: &AssertionDocument{Param: s.Name, Value: s.Value}}, nil
+	}
+	return nil, &UnsupportedStepError{step}
+}
+
+// formatWithin returns the maximum time to wait for a response as it is written in a document
+func formatWithin(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// documentValues returns the values of a row as they are written in a document
+func documentValues(values [][]byte) []*string {
+	cells := make([]*string, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			cells = append(cells, nil)
+			continue
+		}
+		s := string(v)
+		cells = append(cells, &s)
+	}
+	return cells
+}
+
+// fieldName returns the name of a field of a pgproto3 type as it is written in a document, e.g. commandTag
+func fieldName(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[n:]
+}
+
+// messageFields returns the fields of msg that are set, by their names in a document
+func messageFields(msg pgproto3.Message) map[string]interface{} {
+	v := reflect.ValueOf(msg).Elem()
+	fields := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); !isZero(f) {
+			fields[fieldName(v.Type().Field(i).Name)] = documentValue(f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// documentParameters returns the parameters of bind as they are written in a document, where the parameters
+// that were written as numbers are written as numbers again
+func documentParameters(bind *pgproto3.Bind) []interface{} {
+	items := make([]interface{}, 0, len(bind.Parameters))
+	for i, p := range bind.Parameters {
+		if p == nil {
+			items = append(items, nil)
+		} else if f, ok := numericParameter(bind, i); ok {
+			items = append(items, f)
+		} else {
+			items = append(items, string(p))
+		}
+	}
+	return items
+}
+
+// documentValue returns v as it is written in a document. Bytes are written as characters and values
+// as strings
+func documentValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Uint8:
+		return string(byte(v.Uint()))
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); !isZero(f) {
+				fields[fieldName(v.Type().Field(i).Name)] = documentValue(f)
+			}
+		}
+		return fields
+	case reflect.Map:
+		m := make(map[string]interface{})
+		for _, key := range v.MapKeys() {
+			m[fmt.Sprint(documentValue(key))] = documentValue(v.MapIndex(key))
+		}
+		return m
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.IsNil() {
+				return nil
+			}
+			return string(v.Bytes())
+		}
+		items := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, documentValue(v.Index(i)))
+		}
+		return items
+	}
+	return v.Interface()
+}
+
+// kinds returns the number of the kinds of steps that are set in doc, which must be exactly one
+func (doc *StepDocument) kinds() int {
+	kinds := 0
+	for _, set := range []bool{doc.Send != "", doc.Receive != "", doc.Row != nil, doc.Rows != nil, doc.Silence != "", doc.Assert != nil, doc.Ignore != nil} {
+		if set {
+			kinds++
+		}
+	}
+	return kinds
+}
+
+// step returns the step that doc defines
+func (doc *StepDocument) step() (Step, error) {
+	var within time.Duration
+	if doc.Within != "" {
+		var err error
+		if within, err = time.ParseDuration(doc.Within); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case doc.Send != "":
+		if len(doc.Send) != 1 || newFrontendMessage(doc.Send[0]) == nil {
+			return nil, &UnknownMessageType{msgType: doc.Send[0]}
+		}
+		msg := newFrontendMessage(doc.Send[0])
+		if err := setFields(msg, doc.Fields); err != nil {
+			return nil, err
+		}
+		if bind, ok := msg.(*pgproto3.Bind); ok {
+			setNumericParameters(bind, documentNumeric(doc.Fields))
+		}
+		if doc.Pipelined {
+			return &Pipelined{&Command{msg}}, nil
+		}
+		return &Command{msg}, nil
+	case doc.Row != nil:
+		return &Row{Values: stepValues(doc.Row), Within: within}, nil
+	case doc.Rows != nil:
+		set := &RowSet{}
+		for _, values := range doc.Rows {
+			set.Rows = append(set.Rows, &Row{Values: stepValues(values)})
+		}
+		return set, nil
+	case doc.Silence != "":
+		d, err := time.ParseDuration(doc.Silence)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("silence must be positive. got %s", doc.Silence)
+		}
+		return &Silence{Duration: d}, nil
+	case doc.Assert != nil:
+		return &ParameterAssertion{Name: doc.Assert.Param, Value: doc.Assert.Value}, nil
+	}
+
+	if len(doc.Receive) != 1 || newBackendMessage(doc.Receive[0]) == nil {
+		return nil, &UnknownMessageType{msgType: doc.Receive[0]}
+	}
+	switch {
+	case doc.Receive == "A":
+		return doc.notification(within)
+	case doc.Receive == "S" && len(doc.Fields) > 0:
+		p := &pgproto3.ParameterStatus{}
+		if err := setFields(p, doc.Fields); err != nil {
+			return nil, err
+		}
+		return &Parameter{Name: p.Name, Value: p.Value, Within: within}, nil
+	}
+	msg := newBackendMessage(doc.Receive[0])
+	if err := setFields(msg, doc.Fields); err != nil {
+		return nil, err
+	}
+	res := &Response{msg}
+	if doc.Match == "" && within == 0 {
+		return res, nil
+	}
+	expectation := &Expectation{Response: res, Within: within}
+	if doc.Match != "" {
+		if _, ok := messageText(msg); !ok {
+			return nil, &InvalidArgError{msgType: doc.Receive[0]}
+		}
+		re, err := regexp.Compile(doc.Match)
+		if err != nil {
+			return nil, err
+		}
+		expectation.Matchers = []Matcher{&RegexpMatcher{Regexp: re, Partial: doc.Partial}}
+	}
+	return expectation, nil
+}
+
+// notification returns the Notification that doc defines
+func (doc *StepDocument) notification(within time.Duration) (*Notification, error) {
+	n := &Notification{AnyPayload: true, Within: within}
+	for key, value := range doc.Fields {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected %s of A to be a string. got %v", key, value)
+		}
+		switch key {
+		case "channel":
+			n.Channel = s
+		case "payload":
+			n.Payload, n.AnyPayload = s, false
+		default:
+			return nil, fmt.Errorf("unknown field %s of A", key)
+		}
+	}
+	switch doc.Order {
+	case "":
+	case TokenBefore:
+		n.Order = BeforeReady
+	case TokenAfter:
+		n.Order = AfterReady
+	default:
+		return nil, &UnexpectedTokenError{actual: doc.Order, expected: []string{TokenBefore, TokenAfter}}
+	}
+	return n, nil
+}
+
+// stepValues returns the values of a row in a document as the values of a step
+func stepValues(cells []*string) [][]byte {
+	values := make([][]byte, 0, len(cells))
+	for _, cell := range cells {
+		if cell == nil {
+			values = append(values, nil)
+		} else {
+			values = append(values, []byte(*cell))
+		}
+	}
+	return values
+}
+
+// documentNumeric returns which of the parameters of Bind in fields are written as numbers
+func documentNumeric(fields map[string]interface{}) []bool {
+	var numeric []bool
+	for key, value := range fields {
+		items, ok := value.([]interface{})
+		if !ok || !strings.EqualFold(key, "parameters") {
+			continue
+		}
+		for _, item := range items {
+			_, text := item.(string)
+			numeric = append(numeric, !text && item != nil)
+		}
+	}
+	return numeric
+}
+
+// setFields sets the fields of msg by their names in a document
+func setFields(msg pgproto3.Message, fields map[string]interface{}) error {
+	v := reflect.ValueOf(msg).Elem()
+	for key, value := range fields {
+		f := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+		if !f.IsValid() {
+			return fmt.Errorf("unknown field %s of %s", key, messageTypeName(msg))
+		}
+		if err := setValue(f, value, strings.EqualFold(key, "parameters")); err != nil {
+			return fmt.Errorf("field %s of %s: %s", key, messageTypeName(msg), err)
+		}
+	}
+	return nil
+}
+
+// setValue sets v to value that was decoded from JSON or YAML. Numbers are allowed as parameters of
+// Bind, and they are sent as float64 in little endian like in transcripts
+func setValue(v reflect.Value, value interface{}, params bool) error {
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	invalid := fmt.Errorf("invalid value %v for %s", value, v.Type())
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return invalid
+		}
+		v.SetString(s)
+	case reflect.Uint8:
+		s, ok := value.(string)
+		if !ok || len(s) != 1 {
+			return invalid
+		}
+		v.SetUint(uint64(s[0]))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil || n != math.Trunc(n) {
+			return invalid
+		}
+		if v.Kind() >= reflect.Uint {
+			if n < 0 || v.OverflowUint(uint64(n)) {
+				return invalid
+			}
+			v.SetUint(uint64(n))
+		} else {
+			if v.OverflowInt(int64(n)) {
+				return invalid
+			}
+			v.SetInt(int64(n))
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			switch x := value.(type) {
+			case string:
+				v.SetBytes([]byte(x))
+			default:
+				f, err := strconv.ParseFloat(fmt.Sprint(x), 64)
+				if !params || err != nil {
+					return invalid
+				}
+				v.SetBytes(numberParameter(f))
+			}
+			return nil
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return invalid
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), item, params); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Struct, reflect.Map:
+		fields, ok := stringMap(value)
+		if !ok {
+			return invalid
+		}
+		if v.Kind() == reflect.Map {
+			m := reflect.MakeMap(v.Type())
+			for key, item := range fields {
+				k, e := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+				if err := setValue(k, key, false); err != nil {
+					return err
+				}
+				if err := setValue(e, item, false); err != nil {
+					return err
+				}
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+			return nil
+		}
+		for key, item := range fields {
+			f := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+			if !f.IsValid() {
+				return fmt.Errorf("unknown field %s of %s", key, v.Type())
+			}
+			if err := setValue(f, item, false); err != nil {
+				return err
+			}
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
+
+// stringMap returns value as a map with string keys, since YAML objects are decoded with keys of any type
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		fields := make(map[string]interface{}, len(m))
+		for key, item := range m {
+			fields[fmt.Sprint(key)] = item
+		}
+		return fields, true
+	}
+	return nil, false
+}
@@ -0,0 +1,151 @@
+package pg_stories
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// documentTranscript holds a story with every kind of step that a document supports
+var documentTranscript = strings.Join([]string{
+	`@ignore K, N`,
+	``,
+	`=== every kind of step`,
+	`-> P "baa" "SELECT * FROM (VALUES($1)) t;" [0]`,
+	`-> B "" "baa" [1.5,2,baa,NULL]`,
+	`-> D P ""`,
+	`-> E "" 10`,
+	`@pipeline`,
+	`-> Q "NOTIFY jobs"`,
+	`@end`,
+	`-> S`,
+	`<- 1`,
+	`<- 2`,
+	`<- T ["column1"] [25]`,
+	`<- D ["baa"]`,
+	`<- D | baa |`,
+	`<- s within 1s`,
+	`<- C /SELECT \d+/`,
+	`<- E ~/does not exist/ within 200ms`,
+	`<- E {code=26000, severity=ERROR}`,
+	`<- A "jobs" "42" before Z`,
+	`<- S "TimeZone" "UTC"`,
+	`<- Z E`,
+	`@ignore S`,
+	`assert param TimeZone = "UTC"`,
+	`<- none 100ms`,
+	`===`,
+}, "\n")
+
+func TestDocument(t *testing.T) {
+	expected, _, err := NewBuilder(strings.NewReader(documentTranscript)).ParseNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Format{FormatJSON, FormatYAML} {
+		t.Run("test "+string(format)+" round trip", func(t *testing.T) {
+			doc, err := ReadDocument(strings.NewReader(documentTranscript), FormatStory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			if err := doc.Write(buf, format); err != nil {
+				t.Fatal(err)
+			}
+			stories, err := ReadStories(bytes.NewReader(buf.Bytes()), format)
+			if err != nil {
+				t.Fatalf("%s\n%s", err, buf)
+			}
+			if len(stories) != 1 || stories[0].Name != expected.Name {
+				t.Fatalf("expected a single story named %s. got %v", expected.Name, stories)
+			}
+			if !reflect.DeepEqual(stories[0].Steps, expected.Steps) {
+				t.Fatalf("expected the steps of the transcript. got:\n%s", buf)
+			}
+			if !reflect.DeepEqual(stories[0].Ignore, expected.Ignore) {
+				t.Fatalf("expected ignore rules %v. got %v", expected.Ignore, stories[0].Ignore)
+			}
+
+			transcript := &bytes.Buffer{}
+			doc, err = ReadDocument(bytes.NewReader(buf.Bytes()), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := doc.Write(transcript, FormatStory); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(transcript.String(), `-> B "" "baa" [1.5,2,"baa",NULL]`) {
+				t.Fatalf("expected the numbers of bind to be written as numbers. got:\n%s", transcript)
+			}
+			converted, _, err := NewBuilder(transcript).ParseNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(converted.Steps, expected.Steps) || !reflect.DeepEqual(converted.Ignore, expected.Ignore) {
+				t.Fatalf("expected the converted transcript to define the same story. got:\n%s", transcript)
+			}
+		})
+	}
+
+	t.Run("test yaml", func(t *testing.T) {
+		doc := strings.Join([]string{
+			`ignore: [S, K, N]`,
+			`stories:`,
+			`  - name: simple query`,
+			`    steps:`,
+			`      - send: Q`,
+			`        fields: {string: "SELECT 1"}`,
+			`      - receive: T`,
+			`        fields:`,
+			`          fields: [{name: "?column?", dataTypeOID: 23}]`,
+			`      - row: ["1", ~]`,
+			`      - receive: C`,
+			`        fields: {commandTag: SELECT 1}`,
+			`      - receive: Z`,
+			`        fields: {txStatus: I}`,
+			`        within: 1s`,
+		}, "\n")
+		transcript := strings.Join([]string{
+			`@ignore S, K, N`,
+			`=== simple query`,
+			`-> Q "SELECT 1"`,
+			`<- T ["?column?"] [23]`,
+			`<- D | 1 | NULL |`,
+			`<- C "SELECT 1"`,
+			`<- Z I within 1s`,
+			`===`,
+		}, "\n")
+		startup := startupSeq()
+		stories, err := ReadStories(strings.NewReader(doc), FormatYAML, startup...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _, err := NewBuilder(strings.NewReader(transcript), startup...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stories) != 1 || !reflect.DeepEqual(stories[0].Steps, expected.Steps) || !reflect.DeepEqual(stories[0].Ignore, expected.Ignore) {
+			t.Fatalf("expected the story of the transcript. got %v", stories)
+		}
+	})
+
+	t.Run("test invalid documents", func(t *testing.T) {
+		docs := []string{
+			`{"stories": [{"name": "x", "steps": [{"send": "Q", "receive": "C"}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"send": "?"}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"send": "Q", "fields": {"query": "SELECT 1"}}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"receive": "Z", "fields": {"txStatus": 73}}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"receive": "T", "match": "x"}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"ignore": ["S"]}]}]}`,
+			`{"stories": [{"name": "x", "steps": [{"send": "S"}]}], "unknown": true}`,
+			`{"stories": [{"name": "x", "steps": [{"silence": "0s"}]}]}`,
+		}
+		for _, doc := range docs {
+			if _, err := ReadStories(strings.NewReader(doc), FormatJSON); err == nil {
+				t.Fatalf("expected an error for %s", doc)
+			}
+		}
+	})
+}
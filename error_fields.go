@@ -0,0 +1,142 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strconv"
+	"strings"
+)
+
+// errorField is a field of ErrorResponse and NoticeResponse as it is named in a transcript
+type errorField struct {
+	name string
+	text func(e *pgproto3.ErrorResponse) *string
+	num  func(e *pgproto3.ErrorResponse) *int32
+}
+
+// value returns the field of e as text, or an empty string if it is not set
+func (f *errorField) value(e *pgproto3.ErrorResponse) string {
+	if f.text != nil {
+		return *f.text(e)
+	}
+	if n := *f.num(e); n != 0 {
+		return strconv.Itoa(int(n))
+	}
+	return ""
+}
+
+// set sets the field of e to value
+func (f *errorField) set(e *pgproto3.ErrorResponse, value string) error {
+	if f.text != nil {
+		*f.text(e) = value
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid value of error field %s: %s", f.name, value)
+	}
+	*f.num(e) = int32(n)
+	return nil
+}
+
+// errorFields are the fields of ErrorResponse and NoticeResponse in the order they are written
+var errorFields = []errorField{
+	{name: "code", text: func(e *pgproto3.ErrorResponse) *string { return &e.Code }},
+	{name: "severity", text: func(e *pgproto3.ErrorResponse) *string { return &e.Severity }},
+	{name: "message", text: func(e *pgproto3.ErrorResponse) *string { return &e.Message }},
+	{name: "detail", text: func(e *pgproto3.ErrorResponse) *string { return &e.Detail }},
+	{name: "hint", text: func(e *pgproto3.ErrorResponse) *string { return &e.Hint }},
+	{name: "position", num: func(e *pgproto3.ErrorResponse) *int32 { return &e.Position }},
+	{name: "internal_position", num: func(e *pgproto3.ErrorResponse) *int32 { return &e.InternalPosition }},
+	{name: "internal_query", text: func(e *pgproto3.ErrorResponse) *string { return &e.InternalQuery }},
+	{name: "where", text: func(e *pgproto3.ErrorResponse) *string { return &e.Where }},
+	{name: "schema", text: func(e *pgproto3.ErrorResponse) *string { return &e.SchemaName }},
+	{name: "table", text: func(e *pgproto3.ErrorResponse) *string { return &e.TableName }},
+	{name: "column", text: func(e *pgproto3.ErrorResponse) *string { return &e.ColumnName }},
+	{name: "data_type", text: func(e *pgproto3.ErrorResponse) *string { return &e.DataTypeName }},
+	{name: "constraint", text: func(e *pgproto3.ErrorResponse) *string { return &e.ConstraintName }},
+	{name: "file", text: func(e *pgproto3.ErrorResponse) *string { return &e.File }},
+	{name: "line", num: func(e *pgproto3.ErrorResponse) *int32 { return &e.Line }},
+	{name: "routine", text: func(e *pgproto3.ErrorResponse) *string { return &e.Routine }},
+}
+
+func errorFieldByName(name string) *errorField {
+	for i := range errorFields {
+		if errorFields[i].name == name {
+			return &errorFields[i]
+		}
+	}
+	return nil
+}
+
+// errorResponseOf returns the fields of an ErrorResponse or a NoticeResponse
+func errorResponseOf(msg pgproto3.BackendMessage) *pgproto3.ErrorResponse {
+	switch m := msg.(type) {
+	case *pgproto3.ErrorResponse:
+		return m
+	case *pgproto3.NoticeResponse:
+		return (*pgproto3.ErrorResponse)(m)
+	}
+	return nil
+}
+
+// compareErrorFields compares every field that is set in expected with the same field in actual
+func compareErrorFields(kind string, expected, actual *pgproto3.ErrorResponse) error {
+	if expected.Code != "" && expected.Code != actual.Code {
+		return fmt.Errorf("expected %s with code: %s. got %s", kind, expected.Code, actual.Code)
+	}
+	for i := range errorFields {
+		f := &errorFields[i]
+		if want, got := f.value(expected), f.value(actual); want != "" && want != got {
+			return fmt.Errorf("expected %s with %s: %q. got %q", kind, f.name, want, got)
+		}
+	}
+	return nil
+}
+
+// formatErrorFields returns the fields that are set in e as an object token. Only the code is
+// returned, as a string token, if no other field is set.
+func formatErrorFields(e *pgproto3.ErrorResponse) string {
+	var items []string
+	for i := range errorFields {
+		f := &errorFields[i]
+		value := f.value(e)
+		if value == "" {
+			continue
+		}
+		if value != strings.TrimSpace(value) || strings.ContainsAny(value, ",}=\"\\\n") {
+			value = quote(value)
+		}
+		items = append(items, f.name+"="+value)
+	}
+	if len(items) == 0 {
+		return ""
+	}
+	if len(items) == 1 && e.Code != "" {
+		return quote(e.Code)
+	}
+	return string(TokenDelimiterObjectStart) + strings.Join(items, ", ") + string(TokenDelimiterObjectEnd)
+}
+
+// parseErrorFields reads either a code as a string token or an object token of fields into e
+func parseErrorFields(e *pgproto3.ErrorResponse, parser *tokenParser) error {
+	if !parser.isObject() {
+		var err error
+		e.Code, err = parser.readString()
+		return err
+	}
+	items, err := parser.readObject()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		f := errorFieldByName(item.key)
+		if f == nil {
+			return fmt.Errorf("unknown error field: %s", item.key)
+		}
+		if err := f.set(e, item.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"testing"
+)
+
+func TestResponse_CompareErrorFields(t *testing.T) {
+	actual := &pgproto3.ErrorResponse{
+		Severity:       "ERROR",
+		Code:           "23505",
+		Message:        `duplicate key value violates unique constraint "users_pkey"`,
+		ConstraintName: "users_pkey",
+		TableName:      "users",
+		Line:           434,
+	}
+	tests := []struct {
+		name     string
+		expected pgproto3.BackendMessage
+		equal    bool
+	}{
+		{"code only", &pgproto3.ErrorResponse{Code: "23505"}, true},
+		{"some fields", &pgproto3.ErrorResponse{Code: "23505", Severity: "ERROR", ConstraintName: "users_pkey"}, true},
+		{"wrong code", &pgproto3.ErrorResponse{Code: "23503"}, false},
+		{"wrong constraint", &pgproto3.ErrorResponse{ConstraintName: "users_email_key"}, false},
+		{"wrong line", &pgproto3.ErrorResponse{Line: 435}, false},
+		{"notice", &pgproto3.NoticeResponse{Severity: "ERROR"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&Response{test.expected}).Compare(actual)
+			if test.equal && err != nil {
+				t.Fatal(err)
+			}
+			if !test.equal && err == nil {
+				t.Fatal("expected responses not to be equal")
+			}
+		})
+	}
+
+	t.Run("notice fields", func(t *testing.T) {
+		notice := &pgproto3.NoticeResponse{Severity: "WARNING", Code: "01000", Message: "deprecated"}
+		if err := (&Response{&pgproto3.NoticeResponse{Severity: "WARNING", Message: "deprecated"}}).Compare(notice); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Response{&pgproto3.NoticeResponse{Message: "removed"}}).Compare(notice); err == nil {
+			t.Fatal("expected notices with different messages not to be equal")
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package pg_stories
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// UnsupportedStepError is returned when a step cannot be written in a transcript
+type UnsupportedStepError struct {
+	step Step
+}
+
+func (e *UnsupportedStepError) Error() string {
+	return fmt.Sprintf("step can not be written in a transcript: %#v", e.step)
+}
+
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns s as a string token
+func quote(s string) string {
+	return string(TokenDelimiterString) + stringEscaper.Replace(s) + string(TokenDelimiterString)
+}
+
+// formatArray returns items as an array token
+func formatArray(items []string) string {
+	return string(TokenDelimiterArrayStart) + strings.Join(items, ",") + string(TokenDelimiterArrayEnd)
+}
+
+// formatValues returns values as an array token of quoted strings, where nil values are NULL
+func formatValues(values [][]byte) string {
+	items := make([]string, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			items = append(items, "NULL")
+		} else {
+			items = append(items, quote(string(v)))
+		}
+	}
+	return formatArray(items)
+}
+
+// formatParameters returns the parameters of bind the way Builder parses them, where the parameters that
+// were written as numbers are written as numbers again
+func formatParameters(bind *pgproto3.Bind) string {
+	items := make([]string, 0, len(bind.Parameters))
+	for i, p := range bind.Parameters {
+		if p == nil {
+			items = append(items, "NULL")
+		} else if f, ok := numericParameter(bind, i); ok {
+			items = append(items, strconv.FormatFloat(f, 'g', -1, 64))
+		} else {
+			items = append(items, quote(string(p)))
+		}
+	}
+	return formatArray(items)
+}
+
+func formatUints(values []uint32) string {
+	items := make([]string, 0, len(values))
+	for _, v := range values {
+		items = append(items, strconv.FormatUint(uint64(v), 10))
+	}
+	return formatArray(items)
+}
+
+func formatCommand(msg pgproto3.FrontendMessage) (string, error) {
+	switch m := msg.(type) {
+	case *pgproto3.Bind:
+		return fmt.Sprintf("B %s %s %s", quote(m.DestinationPortal), quote(m.PreparedStatement), formatParameters(m)), nil
+	case *pgproto3.Close:
+		if m.ObjectType == 0 {
+			return "C", nil
+		}
+		return fmt.Sprintf("C %c %s", m.ObjectType, quote(m.Name)), nil
+	case *pgproto3.Describe:
+		return fmt.Sprintf("D %c %s", m.ObjectType, quote(m.Name)), nil
+	case *pgproto3.Execute:
+		return fmt.Sprintf("E %s %d", quote(m.Portal), m.MaxRows), nil
+	case *pgproto3.Flush:
+		return "H", nil
+	case *pgproto3.Parse:
+		return fmt.Sprintf("P %s %s %s", quote(m.Name), quote(m.Query), formatUints(m.ParameterOIDs)), nil
+	case *pgproto3.PasswordMessage:
+		if m.Password == "" {
+			return "p", nil
+		}
+		return "p " + quote(m.Password), nil
+	case *pgproto3.Query:
+		return "Q " + quote(m.String), nil
+	case *pgproto3.Sync:
+		return "S", nil
+	case *pgproto3.Terminate:
+		return "X", nil
+	}
+	return "", &UnsupportedStepError{&Command{msg}}
+}
+
+func formatResponse(msg pgproto3.BackendMessage) string {
+	t := fmt.Sprintf("%c", msg.Encode(nil)[0])
+	switch m := msg.(type) {
+	case *pgproto3.CommandComplete:
+		if m.CommandTag != "" {
+			return t + " " + quote(m.CommandTag)
+		}
+	case *pgproto3.DataRow:
+		if m.Values != nil {
+			return t + " " + formatValues(m.Values)
+		}
+	case *pgproto3.ErrorResponse, *pgproto3.NoticeResponse:
+		if fields := formatErrorFields(errorResponseOf(m)); fields != "" {
+			return t + " " + fields
+		}
+	case *pgproto3.NotificationResponse:
+		if m.Channel != "" {
+			return t + " " + quote(m.Channel) + " " + quote(m.Payload)
+		}
+	case *pgproto3.ParameterDescription:
+		if m.ParameterOIDs != nil {
+			return t + " " + formatUints(m.ParameterOIDs)
+		}
+	case *pgproto3.ReadyForQuery:
+		if m.TxStatus != 0 {
+			return fmt.Sprintf("%s %c", t, m.TxStatus)
+		}
+	case *pgproto3.ParameterStatus:
+		if m.Name != "" {
+			return t + " " + quote(m.Name) + " " + quote(m.Value)
+		}
+	case *pgproto3.RowDescription:
+		if m.Fields == nil {
+			return t
+		}
+		names := make([]string, 0, len(m.Fields))
+		oids := make([]uint32, 0, len(m.Fields))
+		var formats []uint32
+		for _, f := range m.Fields {
+			names = append(names, quote(f.Name))
+			oids = append(oids, f.DataTypeOID)
+			formats = append(formats, uint32(f.Format))
+		}
+		t += " " + formatArray(names) + " " + formatUints(oids)
+		for _, f := range formats {
+			if f != 0 {
+				return t + " " + formatUints(formats)
+			}
+		}
+	}
+	return t
+}
+
+// FormatStep returns the transcript line that defines step
+func FormatStep(step Step) (string, error) {
+	switch s := step.(type) {
+	case *Command:
+		line, err := formatCommand(s.FrontendMessage)
+		if err != nil {
+			return "", err
+		}
+		return TokenFrontendMessage + " " + line, nil
+	case *Pipelined:
+		return FormatStep(s.Command)
+	case *Response:
+		return TokenBackendMessage + " " + formatResponse(s.BackendMessage), nil
+	case *Expectation:
+		line, err := FormatStep(s.Response)
+		if err != nil {
+			return "", err
+		}
+		for _, m := range s.Matchers {
+			re, ok := m.(*RegexpMatcher)
+			if !ok {
+				return "", &UnsupportedStepError{step}
+			}
+			line += " " + re.token()
+		}
+		if s.Within == 0 {
+			return line, nil
+		}
+		return line + " " + TokenWithin + " " + s.Within.String(), nil
+	case *Row:
+		line := TokenBackendMessage + " D " + formatRow(s.Values)
+		if s.Within > 0 {
+			line += " " + TokenWithin + " " + s.Within.String()
+		}
+		return line, nil
+	case *Notification:
+		return formatNotification(s), nil
+	case *Parameter:
+		line := TokenBackendMessage + " S " + quote(s.Name) + " " + quote(s.Value)
+		if s.Within > 0 {
+			line += " " + TokenWithin + " " + s.Within.String()
+		}
+		return line, nil
+	case *ParameterAssertion:
+		return formatParameterAssertion(s), nil
+	case *Silence:
+		return TokenBackendMessage + " " + TokenNone + " " + s.Duration.String(), nil
+	}
+	return "", &UnsupportedStepError{step}
+}
+
+// WriteStory writes a story with the provided name and steps as a transcript to w
+func WriteStory(w io.Writer, name string, steps []Step) error {
+	return writeStory(w, name, steps, nil)
+}
+
+// writeStory writes a story like WriteStory, with an ignore directive for each of rules before the step it
+// applies from. Rules that apply from after the last step are written at the end of the story.
+func writeStory(w io.Writer, name string, steps []Step, rules IgnoreRules) error {
+	lines := []string{TokenStoryDelimiter + " " + name}
+	// directives returns the ignore directives to write before step i
+	directives := func(i int) []string {
+		var directives []string
+		for _, rule := range rules {
+			if rule.From == i || (i == len(steps) && rule.From > i) {
+				directives = append(directives, formatIgnoreRule(rule))
+			}
+		}
+		return directives
+	}
+	pipeline := false
+	for i, step := range steps {
+		line, err := FormatStep(step)
+		if err != nil {
+			return err
+		}
+		_, pipelined := step.(*Pipelined)
+		ignore := directives(i)
+		// directives are not allowed in a pipeline block, so the block is split around them
+		if pipeline && (!pipelined || len(ignore) > 0) {
+			pipeline = false
+			lines = append(lines, TokenEnd)
+		}
+		lines = append(lines, ignore...)
+		if pipelined && !pipeline {
+			pipeline = true
+			lines = append(lines, TokenPipeline)
+		}
+		lines = append(lines, line)
+	}
+	if pipeline {
+		lines = append(lines, TokenEnd)
+	}
+	lines = append(lines, directives(len(steps))...)
+	lines = append(lines, TokenStoryDelimiter, "")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// formatTable returns the lines of a table of rows with aligned columns, where the first row holds the
+// column names. The separator line is written after the column names if separated is set
+func formatTable(rows [][][]byte, separated bool) []string {
+	var widths []int
+	cells := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		line := make([]string, 0, len(row))
+		for i, v := range row {
+			cell := formatCell(v)
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+			line = append(line, cell)
+		}
+		cells = append(cells, line)
+	}
+	lines := make([]string, 0, len(rows)+1)
+	for i, line := range cells {
+		padded := make([]string, 0, len(line))
+		for j, cell := range line {
+			padded = append(padded, cell+strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell)))
+		}
+		lines = append(lines, strings.TrimRight(fmt.Sprintf("%c %s %c", TokenCellDelimiter,
+			strings.Join(padded, fmt.Sprintf(" %c ", TokenCellDelimiter)), TokenCellDelimiter), WhiteSpaceChars))
+		if i == 0 && separated {
+			dashes := make([]string, 0, len(widths))
+			for _, width := range widths {
+				dashes = append(dashes, strings.Repeat("-", width+2))
+			}
+			lines = append(lines, string(TokenCellDelimiter)+strings.Join(dashes, string(TokenCellDelimiter))+string(TokenCellDelimiter))
+		}
+	}
+	return lines
+}
+
+// FormatTranscript writes the transcript that is read from r to w in its canonical form: every step is
+// written the way FormatStep writes it, the columns of tables are aligned, empty lines are removed from
+// the stories and a single empty line separates them.
+func FormatTranscript(w io.Writer, r io.Reader) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// the transcript is parsed first, so errors are reported with their lines
+	builder := NewBuilder(bytes.NewReader(src))
+	for {
+		story, _, err := builder.ParseNext()
+		if err != nil {
+			return err
+		}
+		if story == nil {
+			break
+		}
+	}
+
+	var lines []string
+	var table [][][]byte
+	separated, inStory := false, false
+	flushTable := func() {
+		if table != nil {
+			lines = append(lines, formatTable(table, separated)...)
+			table, separated = nil, false
+		}
+	}
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.Trim(line, " \t\r")
+		if line == "" {
+			continue
+		}
+		if table != nil && line[0] == TokenCellDelimiter {
+			if isSeparator(line) {
+				separated = true
+				continue
+			}
+			parser := &tokenParser{bufio.NewReader(strings.NewReader(line))}
+			values, err := parser.readRow()
+			if err != nil {
+				return err
+			}
+			table = append(table, values)
+			continue
+		}
+		flushTable()
+		switch fields := strings.Fields(line); {
+		case strings.HasPrefix(line, TokenStoryDelimiter):
+			if inStory {
+				lines = append(lines, TokenStoryDelimiter, "")
+			} else {
+				lines = append(lines, strings.TrimRight(TokenStoryDelimiter+" "+strings.Trim(line[3:], WhiteSpaceChars), WhiteSpaceChars))
+			}
+			inStory = !inStory
+		case isIgnoreDirective(line):
+			rule, err := parseIgnoreRule(line, 0)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, formatIgnoreRule(rule))
+			if !inStory {
+				// the directives before the stories are separated from them
+				lines = append(lines, "")
+			}
+		case line == TokenPipeline || line == TokenEnd || line == TokenSimulate:
+			lines = append(lines, line)
+		case len(fields) > 1 && fields[0] == TokenBackendMessage && fields[1] == TokenRows:
+			block, err := parseRowsHeader(fields[2:], 0)
+			if err != nil {
+				return err
+			}
+			header := TokenBackendMessage + " " + TokenRows
+			if block.unordered {
+				header += " " + TokenUnordered
+			}
+			lines = append(lines, header)
+			table = [][][]byte{}
+		default:
+			step, err := builder.parseStep(line)
+			if err != nil {
+				return err
+			}
+			if line, err = FormatStep(step); err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	}
+	flushTable()
+
+	// a single empty line separates the directives before the stories from them
+	text := strings.Join(lines, "\n")
+	for strings.Contains(text, "\n\n\n") {
+		text = strings.Replace(text, "\n\n\n", "\n\n", -1)
+	}
+	_, err = io.WriteString(w, strings.TrimRight(text, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,453 @@
+package pg_stories
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// CrashError is returned by Fuzz when the backend drops the connection without reporting a fatal error first.
+type CrashError struct {
+	err error
+}
+
+func (e *CrashError) Error() string {
+	return fmt.Sprintf("backend crashed: %s", e.err)
+}
+
+// HangError is returned by Fuzz when the backend does not answer with ReadyForQuery in time.
+type HangError struct {
+	timeout time.Duration
+}
+
+func (e *HangError) Error() string {
+	return fmt.Sprintf("backend hangs: no ReadyForQuery within %s", e.timeout)
+}
+
+// ProtocolViolationError is returned when the backend sends a message that breaks the protocol.
+type ProtocolViolationError struct {
+	reason string
+}
+
+func (e *ProtocolViolationError) Error() string {
+	return fmt.Sprintf("protocol violation: %s", e.reason)
+}
+
+// RawMessage is a FrontendMessage that is sent to the backend as is, without adding a header.
+// It is used to send malformed messages to the backend.
+type RawMessage []byte
+
+// Decode stores a copy of data
+func (m *RawMessage) Decode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// Encode appends the raw bytes to dst
+func (m *RawMessage) Encode(dst []byte) []byte {
+	return append(dst, *m...)
+}
+
+// Frontend is here just to identify RawMessage as a pgproto3.FrontendMessage implementation
+func (m *RawMessage) Frontend() {}
+
+// fuzzSource hands out the bytes provided by the fuzzing engine and zeros once they are exhausted.
+type fuzzSource struct {
+	data []byte
+}
+
+func (f *fuzzSource) byte() byte {
+	if len(f.data) == 0 {
+		return 0
+	}
+	b := f.data[0]
+	f.data = f.data[1:]
+	return b
+}
+
+func (f *fuzzSource) intn(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16([]byte{f.byte(), f.byte()})) % n
+}
+
+func (f *fuzzSource) string(s string) string {
+	switch f.intn(4) {
+	case 0:
+		return ""
+	case 1:
+		return s[:f.intn(len(s)+1)]
+	case 2:
+		b := make([]byte, f.intn(64))
+		for i := range b {
+			b[i] = f.byte()
+		}
+		return string(b)
+	}
+	return s + s
+}
+
+// cloneFrontendMessage returns a deep copy of msg, so mutations won't affect the original story.
+func cloneFrontendMessage(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	switch m := msg.(type) {
+	case *pgproto3.Bind:
+		c := *m
+		c.ParameterFormatCodes = append([]int16(nil), m.ParameterFormatCodes...)
+		c.ResultFormatCodes = append([]int16(nil), m.ResultFormatCodes...)
+		c.Parameters = nil
+		for _, p := range m.Parameters {
+			c.Parameters = append(c.Parameters, append([]byte(nil), p...))
+		}
+		return &c
+	case *pgproto3.Close:
+		c := *m
+		return &c
+	case *pgproto3.Describe:
+		c := *m
+		return &c
+	case *pgproto3.Execute:
+		c := *m
+		return &c
+	case *pgproto3.Parse:
+		c := *m
+		c.ParameterOIDs = append([]uint32(nil), m.ParameterOIDs...)
+		return &c
+	case *pgproto3.PasswordMessage:
+		c := *m
+		return &c
+	case *pgproto3.Query:
+		c := *m
+		return &c
+	case *RawMessage:
+		c := append(RawMessage(nil), *m...)
+		return &c
+	}
+	return msg
+}
+
+// mutateFields changes the field values of msg in place
+func mutateFields(msg pgproto3.FrontendMessage, src *fuzzSource) {
+	switch m := msg.(type) {
+	case *pgproto3.Bind:
+		switch src.intn(4) {
+		case 0:
+			m.DestinationPortal = src.string(m.DestinationPortal)
+		case 1:
+			m.PreparedStatement = src.string(m.PreparedStatement)
+		case 2:
+			m.Parameters = m.Parameters[:src.intn(len(m.Parameters)+1)]
+		default:
+			m.Parameters = append(m.Parameters, []byte(src.string("")))
+		}
+	case *pgproto3.Close:
+		m.ObjectType = src.byte()
+		m.Name = src.string(m.Name)
+	case *pgproto3.Describe:
+		if src.intn(2) == 0 {
+			m.ObjectType = src.byte()
+		} else {
+			m.Name = src.string(m.Name)
+		}
+	case *pgproto3.Execute:
+		if src.intn(2) == 0 {
+			m.MaxRows = uint32(src.intn(4))
+		} else {
+			m.Portal = src.string(m.Portal)
+		}
+	case *pgproto3.Parse:
+		switch src.intn(3) {
+		case 0:
+			m.Name = src.string(m.Name)
+		case 1:
+			m.Query = src.string(m.Query)
+		default:
+			m.ParameterOIDs = append(m.ParameterOIDs, uint32(src.intn(4096)))
+		}
+	case *pgproto3.Query:
+		m.String = src.string(m.String)
+	}
+}
+
+// mutateBytes returns the encoded msg as a RawMessage with corrupted content. The declared length of
+// the message is never increased, so the backend won't wait for bytes that will never arrive.
+func mutateBytes(msg pgproto3.FrontendMessage, src *fuzzSource) *RawMessage {
+	raw := RawMessage(msg.Encode(nil))
+	if len(raw) < 5 {
+		return &raw
+	}
+	switch src.intn(3) {
+	case 0:
+		raw[0] = src.byte()
+	case 1:
+		length := binary.BigEndian.Uint32(raw[1:5])
+		binary.BigEndian.PutUint32(raw[1:5], uint32(src.intn(int(length)+1)))
+	default:
+		if len(raw) > 5 {
+			raw[5+src.intn(len(raw)-5)] = src.byte()
+		}
+	}
+	return &raw
+}
+
+// Mutate returns the Commands of steps mutated according to data, which is usually provided by
+// the fuzzing engine. Mutations change the order of the messages, their field values, their length
+// and their raw bytes. Responses are dropped and StartupMessage is never mutated.
+func Mutate(steps []Step, data []byte) []Step {
+	var fixed, commands []Step
+	for _, step := range steps {
+		cmd, ok := commandOf(step)
+		if !ok {
+			continue
+		}
+		if _, ok := cmd.FrontendMessage.(*pgproto3.StartupMessage); ok && len(commands) == 0 {
+			fixed = append(fixed, cmd)
+			continue
+		}
+		commands = append(commands, &Command{cloneFrontendMessage(cmd.FrontendMessage)})
+	}
+
+	src := &fuzzSource{data: data}
+	for len(src.data) > 0 && len(commands) > 0 {
+		i := src.intn(len(commands))
+		switch src.intn(5) {
+		case 0:
+			j := src.intn(len(commands))
+			commands[i], commands[j] = commands[j], commands[i]
+		case 1:
+			dup := &Command{cloneFrontendMessage(commands[i].(*Command).FrontendMessage)}
+			commands = append(commands[:i+1], append([]Step{dup}, commands[i+1:]...)...)
+		case 2:
+			commands = append(commands[:i], commands[i+1:]...)
+		case 3:
+			mutateFields(commands[i].(*Command).FrontendMessage, src)
+		default:
+			commands[i] = &Command{mutateBytes(commands[i].(*Command).FrontendMessage, src)}
+		}
+	}
+
+	return append(fixed, commands...)
+}
+
+// isSyncPoint tells whether the backend should answer msg with ReadyForQuery
+func isSyncPoint(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Sync, *pgproto3.Query, *pgproto3.StartupMessage:
+		return true
+	}
+	return false
+}
+
+// syncState follows which of the sent messages the backend answers with ReadyForQuery, the way the
+// backend does. After an error in an extended query the backend discards every message until Sync,
+// including Query, which is then never answered.
+type syncState struct {
+	// synced tells whether the backend answered or is going to answer every message that was sent
+	synced bool
+	// pending counts the messages of the extended query that were not answered yet
+	pending int
+	// failed tells whether the extended query failed, so the messages until Sync are discarded
+	failed bool
+	// query tells whether the awaited ReadyForQuery answers a Query that follows pending messages
+	query bool
+}
+
+// sent updates the state with msg and tells whether the backend should answer it with ReadyForQuery.
+// A Query that follows an extended query is not answered if the extended query fails, which received
+// reports once the error arrives.
+func (s *syncState) sent(msg pgproto3.FrontendMessage) bool {
+	switch m := msg.(type) {
+	case *pgproto3.StartupMessage:
+		s.synced = true
+		return true
+	case *RawMessage:
+		// interpret the raw bytes the same way the backend would, without waiting for them to be answered
+		for raw := []byte(*m); len(raw) >= 5; {
+			n := int(binary.BigEndian.Uint32(raw[1:5])) + 1
+			if n < 5 || n > len(raw) {
+				break
+			}
+			s.sentType(raw[0])
+			raw = raw[n:]
+		}
+		s.synced = false
+		return false
+	}
+	return s.sentType(msg.Encode(nil)[0])
+}
+
+// sentType updates the state with a message of type t
+func (s *syncState) sentType(t byte) bool {
+	switch t {
+	case 'S':
+		s.synced, s.pending, s.failed, s.query = true, 0, false, false
+		return true
+	case 'Q':
+		s.synced = !s.failed
+		s.query = s.synced && s.pending > 0
+		return s.synced
+	case 'P', 'B', 'D', 'E', 'C':
+		if !s.failed {
+			s.pending++
+		}
+	}
+	s.synced = false
+	return false
+}
+
+// received updates the state with msg and tells whether it ends the wait for the last message that sent
+// reported to be answered: either ReadyForQuery, or the error that makes the backend discard the Query
+func (s *syncState) received(msg pgproto3.BackendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.ReadyForQuery:
+		s.pending, s.failed, s.query = 0, false, false
+		return true
+	case *pgproto3.ErrorResponse:
+		if s.pending == 0 {
+			return false
+		}
+		discarded := s.query
+		s.pending, s.failed, s.query = 0, true, false
+		if discarded {
+			s.synced = false
+		}
+		return discarded
+	case *pgproto3.ParseComplete, *pgproto3.BindComplete, *pgproto3.CloseComplete, *pgproto3.NoData,
+		*pgproto3.RowDescription, *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+		if s.pending > 0 {
+			s.pending--
+		}
+	}
+	return false
+}
+
+// isConnectionClosed tells whether err was caused by the backend closing the connection
+func isConnectionClosed(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
+		return true
+	}
+	// timeouts leave the connection open
+	netErr, ok := err.(net.Error)
+	return ok && !netErr.Timeout()
+}
+
+// Fuzz sends the Commands of the story to the backend and ignores its Responses. Instead of comparing
+// responses it fails on crashes, hangs and protocol violations, as reported by Validator. Every Sync,
+// Query and StartupMessage must be answered with ReadyForQuery within timeout, unless it is discarded
+// after an error in an extended query, and a Sync is sent at the end of the story, unless it ends with
+// one, to make sure the backend is still responsive.
+func (s *Story) Fuzz(t *testing.T, timeout time.Duration) error {
+	r := newRunner(s, t.Logf, nil)
+	r.validator = &Validator{}
+	return r.fuzz(timeout)
+}
+
+// fuzz runs the story for Fuzz
+func (r *runner) fuzz(timeout time.Duration) (err error) {
+	s := r.story
+	steps := s.Steps
+	var last pgproto3.FrontendMessage
+	for _, step := range steps {
+		if cmd, ok := commandOf(step); ok {
+			last = cmd.FrontendMessage
+		}
+	}
+	if _, ok := last.(*pgproto3.Sync); !ok {
+		steps = append(steps[:len(steps):len(steps)], &Command{&pgproto3.Sync{}})
+		r.timeline = newTimeline(&Story{Steps: steps, Lines: s.Lines})
+	}
+	r.session.inbox.restart()
+	if s.Reporter != nil {
+		s.Reporter.StoryStarted(r.id, s.Name)
+		defer func() {
+			s.Reporter.StoryEnded(r.id, s.Name, err)
+		}()
+	}
+
+	state := &syncState{}
+	fatal := false
+	waitReady := func(i int) error {
+		deadline := time.Now().Add(timeout)
+		for {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return &HangError{timeout}
+			}
+			msg, err := r.session.next(remaining, nil)
+			if _, ok := err.(*StepTimeoutError); ok {
+				return &HangError{timeout}
+			}
+			if err != nil {
+				if !isConnectionClosed(err) {
+					return &ProtocolViolationError{err.Error()}
+				}
+				if fatal {
+					return err
+				}
+				return &CrashError{err}
+			}
+			if fatal {
+				return &ProtocolViolationError{fmt.Sprintf("%T received after fatal error", msg)}
+			}
+			if err := r.accept(msg); err != nil {
+				return err
+			}
+			if len(r.pending) > 0 {
+				// no step expects the responses, so they are only logged
+				r.pending = nil
+				r.received(i, msg)
+			}
+			if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+				fatal = e.Severity == "FATAL" || e.Severity == "PANIC"
+			}
+			if state.received(msg) {
+				return nil
+			}
+		}
+	}
+
+	send := func(i int, msg pgproto3.FrontendMessage) error {
+		err := r.send(i, msg, true)
+		if err == nil {
+			return nil
+		}
+		// the backend may have closed the connection after reporting a fatal error
+		if err := waitReady(i); fatal {
+			if isConnectionClosed(err) {
+				return nil
+			}
+			return err
+		}
+		return &CrashError{err}
+	}
+
+	for i, step := range steps {
+		cmd, ok := commandOf(step)
+		if !ok {
+			continue
+		}
+		r.current = i
+		r.timeline.start(i)
+		if _, ok := cmd.FrontendMessage.(*pgproto3.Terminate); ok {
+			return r.send(i, cmd.FrontendMessage, true)
+		}
+		ready := state.sent(cmd.FrontendMessage)
+		if err := send(i, cmd.FrontendMessage); err != nil || fatal {
+			return err
+		}
+		if !ready {
+			continue
+		}
+		if err := waitReady(i); err != nil {
+			if fatal && isConnectionClosed(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
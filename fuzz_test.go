@@ -0,0 +1,120 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadStories(t testing.TB, pattern string) []*Story {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stories []*Story
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		builder := NewBuilder(f, startupSeq()...)
+		for {
+			story, _, err := builder.ParseNext()
+			if err != nil {
+				f.Close()
+				t.Fatalf("%s: %s", file, err)
+			}
+			if story == nil {
+				break
+			}
+			stories = append(stories, story)
+		}
+		f.Close()
+	}
+	return stories
+}
+
+func TestMutate(t *testing.T) {
+	stories := loadStories(t, "testdata/*.story")
+	if len(stories) == 0 {
+		t.Fatal("no stories in testdata")
+	}
+
+	t.Run("test without data", func(t *testing.T) {
+		steps := Mutate(stories[0].Steps, nil)
+		for i, step := range steps {
+			if _, ok := step.(*Command); !ok {
+				t.Fatalf("expected step %d to be a command. actual: %T", i, step)
+			}
+		}
+		if steps[0].(*Command).FrontendMessage != stories[0].Steps[0].(*Command).FrontendMessage {
+			t.Fatalf("expected startup message to be kept")
+		}
+	})
+
+	t.Run("test original is untouched", func(t *testing.T) {
+		before := stories[0].Steps[3].(*Command).Encode(nil)
+		for i := 0; i < 256; i++ {
+			Mutate(stories[0].Steps, []byte{byte(i), 3, byte(i), 0, byte(i), 2, 1, 7})
+		}
+		after := stories[0].Steps[3].(*Command).Encode(nil)
+		if string(before) != string(after) {
+			t.Fatalf("expected original command to stay %q. actual: %q", before, after)
+		}
+	})
+}
+
+func TestIsConnectionClosed(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	conn.SetReadDeadline(time.Now())
+	if _, err := conn.Read(make([]byte, 1)); isConnectionClosed(err) {
+		t.Fatalf("expected a timeout to leave the connection open. got: %v", err)
+	}
+	conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); !isConnectionClosed(err) {
+		t.Fatalf("expected the connection to be closed. got: %v", err)
+	}
+}
+
+func FuzzStories(f *testing.F) {
+	stories := loadStories(f, "testdata/*.story")
+	for i := range stories {
+		f.Add(byte(i), []byte{})
+		f.Add(byte(i), []byte{0, 1, 0, 2, 0, 0})
+	}
+
+	f.Fuzz(func(t *testing.T, i byte, data []byte) {
+		steps := Mutate(stories[int(i)%len(stories)].Steps, data)
+		story, err := initStory(steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer story.Session.Close()
+		err = story.Fuzz(t, time.Second*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStory_Fuzz(t *testing.T) {
+
+	t.Run("test query after failed extended query", func(t *testing.T) {
+		story, err := initStory(append(startupSeq(),
+			&Command{&pgproto3.Parse{Query: "SELEC 1"}},
+			&Command{&pgproto3.Query{String: "SELECT 1"}},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer story.Session.Close()
+		if err := story.Fuzz(t, time.Second); err != nil {
+			t.Fatalf("expected the discarded query not to be waited for. got: %s", err)
+		}
+	})
+
+}
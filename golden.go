@@ -0,0 +1,229 @@
+package pg_stories
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Record sends the Commands of steps to the backend and returns them together with the Responses
+// that were observed, each following the Sync, Query or StartupMessage it answers. Expected Responses
+// in steps are ignored. A Sync is added if steps leave the backend waiting for one.
+func Record(frontend *pgproto3.Frontend, steps []Step, filter func(pgproto3.BackendMessage) bool, timeout time.Duration) ([]Step, error) {
+	recorded, _, err := record(frontend, steps, func(_ int, msg pgproto3.BackendMessage) bool {
+		return filter == nil || filter(msg)
+	}, timeout)
+	return recorded, err
+}
+
+// record records steps like Record, where keep tells which responses to record by the index of the step
+// they arrive during, which is the one that follows the command they answer. It also returns the origin of
+// every recorded step: the index in steps of a command, and the index of the step that follows the
+// command that a response answers.
+func record(frontend *pgproto3.Frontend, steps []Step, keep func(int, pgproto3.BackendMessage) bool, timeout time.Duration) ([]Step, []int, error) {
+	r := sessionOf(frontend)
+
+	var recorded []Step
+	var origins []int
+	state := &syncState{synced: true}
+	send := func(i int, step Step, msg pgproto3.FrontendMessage) error {
+		recorded = append(recorded, step)
+		origins = append(origins, i)
+		ready := state.sent(msg)
+		if err := frontend.Send(msg); err != nil {
+			return err
+		}
+		if !ready {
+			return nil
+		}
+		responses, err := r.untilReady(timeout, func(msg pgproto3.BackendMessage) bool {
+			return keep(i+1, msg)
+		}, state)
+		for _, res := range responses {
+			recorded = append(recorded, &Response{res})
+			origins = append(origins, i+1)
+		}
+		return err
+	}
+
+	for i, step := range steps {
+		if cmd, ok := commandOf(step); ok {
+			if err := send(i, step, cmd.FrontendMessage); err != nil {
+				return recorded, origins, err
+			}
+		}
+	}
+	if !state.synced {
+		sync := &pgproto3.Sync{}
+		if err := send(len(steps), &Command{sync}, sync); err != nil {
+			return recorded, origins, err
+		}
+	}
+	return recorded, origins, nil
+}
+
+// recordedRules returns rules with the indices of the recorded steps they apply from, given the origins
+// of the recorded steps
+func recordedRules(rules IgnoreRules, origins []int) IgnoreRules {
+	var recorded IgnoreRules
+	for _, rule := range rules {
+		from := len(origins)
+		for i, origin := range origins {
+			if origin >= rule.From {
+				from = i
+				break
+			}
+		}
+		recorded = append(recorded, IgnoreRule{Types: rule.Types, From: from})
+	}
+	return recorded
+}
+
+// skipCommands returns steps without the first n Commands and the Responses that follow them
+func skipCommands(steps []Step, n int) []Step {
+	for i, step := range steps {
+		if _, ok := commandOf(step); !ok {
+			continue
+		}
+		if n == 0 {
+			return steps[i:]
+		}
+		n--
+	}
+	return nil
+}
+
+// clearSourceFields clears the fields of the errors and notices in steps that point to the source code
+// of the backend, since they change between its versions
+func clearSourceFields(steps []Step) {
+	for _, step := range steps {
+		if res, ok := step.(*Response); ok {
+			if e := errorResponseOf(res.BackendMessage); e != nil {
+				e.File, e.Line, e.Routine = "", 0, ""
+			}
+		}
+	}
+}
+
+// Golden records the responses of a backend into transcripts, so they can be verified later on.
+type Golden struct {
+	// Connect opens a new session with the backend. It is called for every story, and the session is closed
+	// once the story is done
+	Connect func() (*Session, error)
+	// StartupSeq is the sequence of steps that opens every story. It is not written to the transcript
+	StartupSeq []Step
+	// Filter is a function that tells which responses should be recorded and verified
+	Filter func(pgproto3.BackendMessage) bool
+	// Timeout is the maximum time to wait for the responses of each Sync, and for every story to run
+	Timeout time.Duration
+	// Reporter is notified on the progress of the verified stories
+	Reporter Reporter
+}
+
+// parse returns the stories of the transcript at path, their names and the ignore rules that are defined
+// before the stories
+func (g *Golden) parse(path string) ([]*Story, []string, IgnoreRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	var stories []*Story
+	var names []string
+	builder := NewBuilder(f, g.StartupSeq...)
+	for {
+		story, name, err := builder.ParseNext()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if story == nil {
+			return stories, names, builder.ignore, nil
+		}
+		stories = append(stories, story)
+		names = append(names, name)
+	}
+}
+
+// Update runs the Commands of every story in the transcript at path and rewrites it with
+// the Responses that were observed from the backend, including their arguments.
+func (g *Golden) Update(t *testing.T, path string) error {
+	stories, names, rules, err := g.parse(path)
+	if err != nil {
+		return err
+	}
+
+	startupCommands := 0
+	for _, step := range g.StartupSeq {
+		if _, ok := commandOf(step); ok {
+			startupCommands++
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, rule := range rules {
+		fmt.Fprintln(buf, formatIgnoreRule(rule))
+	}
+	if len(rules) > 0 {
+		fmt.Fprintln(buf)
+	}
+	for i, story := range stories {
+		session, err := g.Connect()
+		if err != nil {
+			return err
+		}
+		t.Logf("recording %s", names[i])
+		steps, origins, err := record(session.Frontend, story.Steps, func(i int, msg pgproto3.BackendMessage) bool {
+			return (g.Filter == nil || g.Filter(msg)) && !story.Ignore.Ignores(i, msg)
+		}, g.Timeout)
+		session.Close()
+		if err != nil {
+			return fmt.Errorf("failed to record %s: %s", names[i], err)
+		}
+		clearSourceFields(steps)
+		skipped := len(steps) - len(skipCommands(steps, startupCommands))
+		// the rules that are defined before the stories are written once at the top
+		storyRules := recordedRules(story.Ignore[len(rules):], origins[skipped:])
+		if err := writeStory(buf, names[i], steps[skipped:], storyRules); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Verify runs every story in the transcript at path as a sub test of t, comparing the responses
+// of the backend with the ones saved in the transcript.
+func (g *Golden) Verify(t *testing.T, path string) {
+	stories, names, _, err := g.parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, story := range stories {
+		t.Run(names[i], func(t *testing.T) {
+			session, err := g.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			story.Session = session
+			story.Filter = g.Filter
+			story.Reporter = g.Reporter
+			sigKill := make(chan interface{}, 1)
+			if g.Timeout > 0 {
+				timer := time.AfterFunc(g.Timeout, func() {
+					sigKill <- fmt.Errorf("timeout")
+				})
+				defer timer.Stop()
+			}
+			if err := story.Run(t, sigKill); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
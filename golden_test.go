@@ -0,0 +1,118 @@
+package pg_stories
+
+import (
+	"flag"
+	"github.com/jackc/pgx/pgproto3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden transcripts with the responses of the backend")
+
+func TestGolden(t *testing.T) {
+	var sessions []*Session
+	g := &Golden{
+		Connect: func() (*Session, error) {
+			session, err := pipeSession(answerQueries(
+				&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "column1", DataTypeOID: 25}}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte("baa"), nil}},
+				&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			))
+			sessions = append(sessions, session)
+			return session, err
+		},
+		Timeout: time.Second,
+	}
+	path := filepath.Join(t.TempDir(), "golden.story")
+	err := ioutil.WriteFile(path, []byte("@ignore S\n=== query\n-> Q \"SELECT \\\"baa\\\";\"\n@ignore D\n===\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Update(t, path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		`@ignore S`,
+		``,
+		`=== query`,
+		`-> Q "SELECT \"baa\";"`,
+		`@ignore D`,
+		`<- T ["column1"] [25]`,
+		`<- C "SELECT 1"`,
+		`<- Z I`,
+		`===`,
+	}, "\n")
+	if strings.TrimSpace(string(b)) != expected {
+		t.Fatalf("expected transcript:\n%s\nactual:\n%s", expected, b)
+	}
+
+	g.Verify(t, path)
+	for _, session := range sessions {
+		select {
+		case <-session.done:
+		default:
+			t.Fatal("expected the session of every story to be closed")
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+
+	t.Run("test query after failed extended query", func(t *testing.T) {
+		session, err := connectSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		steps := append(startupSeq(),
+			&Command{&pgproto3.Parse{Query: "SELEC 1"}},
+			&Command{&pgproto3.Query{String: "SELECT 1"}},
+		)
+		recorded, err := Record(session.Frontend, steps, func(msg pgproto3.BackendMessage) bool {
+			return !IgnoreRules{Ignore('S', 'K')}.Ignores(0, msg)
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tail []string
+		for _, step := range recorded[len(recorded)-4:] {
+			tail = append(tail, describeStep(step))
+		}
+		for i, expected := range []string{`-> Q "SELECT 1"`, `<- E`, `-> S`, `<- Z I`} {
+			if !strings.HasPrefix(tail[i], expected) {
+				t.Fatalf("expected the recording to end with the error and a Sync. got:\n%s", strings.Join(tail, "\n"))
+			}
+		}
+	})
+
+}
+
+func TestGoldenTranscripts(t *testing.T) {
+	g := &Golden{
+		Connect:    connectSession,
+		StartupSeq: startupSeq(),
+		Timeout:    time.Second * 2,
+	}
+	files, err := filepath.Glob("testdata/golden*.story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if *update {
+			if err := g.Update(t, file); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		g.Verify(t, file)
+	}
+}
@@ -0,0 +1,306 @@
+package pg_stories
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packagePath is the import path of this package, that generated code imports it by
+var packagePath = reflect.TypeOf(Story{}).PkgPath()
+
+// UnsupportedValueError is returned when a step holds a value that can not be written as a Go literal,
+// e.g. a MatcherFunc
+type UnsupportedValueError struct {
+	value reflect.Value
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return fmt.Sprintf("value of type %s can not be written as a Go literal", e.value.Type())
+}
+
+// GoTest writes stories as a Go test that builds each of their steps with pgproto3 literals, so that
+// transcripts can be migrated to compiled tests. Every story becomes a subtest that passes the story to
+// the function named Run, which the package of the generated file defines, e.g. to connect the story to
+// the tested backend:
+//
+//	func runStory(t *testing.T, story *stories.Story)
+type GoTest struct {
+	// Package is the name of the package of the generated file
+	Package string
+	// Test is the name of the generated test function. Defaults to TestStories
+	Test string
+	// Run is the name of the function that runs every story. Defaults to runStory
+	Run string
+	// Source is the transcript that the stories were parsed from. It is mentioned in the header of the file
+	Source string
+}
+
+// Write writes a test file with a subtest for every one of stories. Only the name, the steps and the
+// ignore rules of the stories are written
+func (g *GoTest) Write(w io.Writer, stories []*Story) error {
+	test, run := g.Test, g.Run
+	if test == "" {
+		test = "TestStories"
+	}
+	if run == "" {
+		run = "runStory"
+	}
+	lw := &literalWriter{imports: map[string]string{"testing": ""}}
+	if g.Package != "pg_stories" {
+		lw.qualifier = "stories."
+	}
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "func %s(t *testing.T) {\n", test)
+	for _, story := range stories {
+		literal, err := lw.literal(reflect.ValueOf(&Story{Name: story.Name, Steps: story.Steps, Ignore: story.Ignore}))
+		if err != nil {
+			return fmt.Errorf("story %q: %s", story.Name, err)
+		}
+		fmt.Fprintf(body, "t.Run(%s, func(t *testing.T) {\n%s(t, %s)\n})\n", strconv.Quote(story.Name), run, literal)
+	}
+	body.WriteString("}\n")
+
+	src := &bytes.Buffer{}
+	if g.Source != "" {
+		fmt.Fprintf(src, "// This file was generated by pg-stories export from %s\n\n", g.Source)
+	}
+	fmt.Fprintf(src, "package %s\n\nimport (\n", g.Package)
+	paths := make([]string, 0, len(lw.imports))
+	for path := range lw.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(src, "%s %s\n", lw.imports[path], strconv.Quote(path))
+	}
+	src.WriteString(")\n\n")
+	src.Write(body.Bytes())
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format the generated code: %s", err)
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+// literalWriter writes values as Go literals and collects the packages that they import
+type literalWriter struct {
+	// qualifier is prepended to the types of this package, empty when the code is generated into it
+	qualifier string
+	// imports maps the import path of every package that the literals use to its name, empty for the default
+	imports map[string]string
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	regexpType     = reflect.TypeOf(&regexp.Regexp{})
+	orderType      = reflect.TypeOf(Anytime)
+	ignoreRuleType = reflect.TypeOf(IgnoreRule{})
+	orderNames     = map[Order]string{Anytime: "Anytime", BeforeReady: "BeforeReady", AfterReady: "AfterReady"}
+)
+
+// typeName returns the name of t as it is written in the generated file
+func (lw *literalWriter) typeName(t reflect.Type) string {
+	if t.Name() != "" {
+		switch t.PkgPath() {
+		case "":
+			if t.Kind() == reflect.Uint8 {
+				return "byte"
+			}
+			return t.String()
+		case packagePath:
+			if lw.qualifier != "" {
+				lw.imports[packagePath] = strings.TrimSuffix(lw.qualifier, ".")
+			}
+			return lw.qualifier + t.Name()
+		}
+		lw.imports[t.PkgPath()] = ""
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + lw.typeName(t.Elem())
+	case reflect.Slice:
+		return "[]" + lw.typeName(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), lw.typeName(t.Elem()))
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", lw.typeName(t.Key()), lw.typeName(t.Elem()))
+	}
+	return t.String()
+}
+
+// literal returns v as a Go expression. Composite literals that hold other composite literals are
+// written on multiple lines
+func (lw *literalWriter) literal(v reflect.Value) (string, error) {
+	t := v.Type()
+	switch t {
+	case durationType:
+		lw.imports["time"] = ""
+		return formatDuration(time.Duration(v.Int())), nil
+	case regexpType:
+		lw.imports["regexp"] = ""
+		return fmt.Sprintf("regexp.MustCompile(%s)", strconv.Quote(v.Interface().(*regexp.Regexp).String())), nil
+	case ignoreRuleType:
+		if rule := v.Interface().(IgnoreRule); rule.From == 0 {
+			types := make([]string, 0, len(rule.Types))
+			for _, t := range rule.Types {
+				types = append(types, strconv.QuoteRune(rune(t)))
+			}
+			lw.typeName(ignoreRuleType)
+			return fmt.Sprintf("%sIgnore(%s)", lw.qualifier, strings.Join(types, ", ")), nil
+		}
+	case orderType:
+		if name, ok := orderNames[Order(v.Int())]; ok {
+			lw.typeName(t)
+			return lw.qualifier + name, nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return "nil", nil
+		}
+		return lw.literal(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "nil", nil
+		}
+		if t.Elem().Kind() != reflect.Struct {
+			return "", &UnsupportedValueError{v}
+		}
+		s, err := lw.literal(v.Elem())
+		return "&" + s, err
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := v.Field(i)
+			if isZero(f) {
+				continue
+			}
+			if t.Field(i).PkgPath != "" {
+				return "", &UnsupportedValueError{v}
+			}
+			s, err := lw.literal(f)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, t.Field(i).Name+": "+s)
+		}
+		return composite(lw.typeName(t), fields, false), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return "nil", nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("[]byte(%s)", strconv.Quote(string(v.Bytes()))), nil
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s, err := lw.literal(v.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items = append(items, lw.elide(t.Elem(), s))
+		}
+		return composite(lw.typeName(t), items, t.Elem().Kind() == reflect.Interface), nil
+	case reflect.Map:
+		if v.IsNil() {
+			return "nil", nil
+		}
+		items := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			k, err := lw.literal(key)
+			if err != nil {
+				return "", err
+			}
+			e, err := lw.literal(v.MapIndex(key))
+			if err != nil {
+				return "", err
+			}
+			items = append(items, k+": "+e)
+		}
+		sort.Strings(items)
+		return composite(lw.typeName(t), items, false), nil
+	case reflect.String:
+		return strconv.Quote(v.String()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Uint8:
+		if b := byte(v.Uint()); b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' {
+			return strconv.QuoteRune(rune(b)), nil
+		}
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	}
+	return "", &UnsupportedValueError{v}
+}
+
+// elide removes the type of a composite literal s of type t, where it is an element of a composite
+// literal that already states it
+func (lw *literalWriter) elide(t reflect.Type, s string) string {
+	switch {
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct:
+		return strings.TrimPrefix(s, "&"+lw.typeName(t.Elem()))
+	case t.Kind() == reflect.Struct:
+		return strings.TrimPrefix(s, lw.typeName(t))
+	}
+	return s
+}
+
+// composite returns a composite literal of type t. It spans a line per item if multiline is set or
+// any of the items spans multiple lines
+func composite(t string, items []string, multiline bool) string {
+	for _, item := range items {
+		multiline = multiline || strings.Contains(item, "\n")
+	}
+	if !multiline || len(items) == 0 {
+		return t + "{" + strings.Join(items, ", ") + "}"
+	}
+	return t + "{\n" + strings.Join(items, ",\n") + ",\n}"
+}
+
+// isZero tells whether v is the zero value of its type
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// formatDuration returns d as a multiple of the largest unit that divides it
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		unit time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+		{time.Microsecond, "time.Microsecond"},
+	}
+	for _, u := range units {
+		if d%u.unit == 0 {
+			return fmt.Sprintf("%d * %s", d/u.unit, u.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
@@ -0,0 +1,80 @@
+package pg_stories
+
+import (
+	"bytes"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"testing"
+)
+
+func TestGoTest(t *testing.T) {
+	t.Run("test export", func(t *testing.T) {
+		transcript := strings.Join([]string{
+			`@ignore S, K`,
+			`=== pipeline`,
+			`-> P "baa" "SELECT * FROM (VALUES($1)) t;" [0]`,
+			`@pipeline`,
+			`-> B "" "baa" [baa]`,
+			`@end`,
+			`-> S`,
+			`<- 1`,
+			`<- C /SELECT \d+/ within 1s`,
+			`<- A "jobs" after Z`,
+			`<- Z T`,
+			`===`,
+		}, "\n")
+		story, _, err := NewBuilder(strings.NewReader(transcript)).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		g := &GoTest{Package: "pg_test", Test: "TestPipeline", Run: "run", Source: "pipeline.story"}
+		if err := g.Write(buf, []*Story{story}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			"// This file was generated by pg-stories export from pipeline.story\n",
+			"package pg_test\n",
+			`stories "` + packagePath + `"`,
+			`"regexp"`,
+			`"time"`,
+			"func TestPipeline(t *testing.T) {\n",
+			`run(t, &stories.Story{`,
+			`&stories.Command{FrontendMessage: &pgproto3.Parse{Name: "baa", Query: "SELECT * FROM (VALUES($1)) t;", ParameterOIDs: []uint32{0}}},`,
+			`&stories.Pipelined{Command: &stories.Command{FrontendMessage: &pgproto3.Bind{PreparedStatement: "baa", Parameters: [][]byte{[]byte("baa")}}}},`,
+			`&stories.RegexpMatcher{Regexp: regexp.MustCompile("SELECT \\d+")},`,
+			`1 * time.Second,`,
+			`&stories.Notification{Channel: "jobs", AnyPayload: true, Order: stories.AfterReady},`,
+			`&stories.Response{BackendMessage: &pgproto3.ReadyForQuery{TxStatus: 'T'}},`,
+			`Ignore: stories.IgnoreRules{stories.Ignore('S', 'K')},`,
+		}
+		for _, s := range expected {
+			if !strings.Contains(buf.String(), s) {
+				t.Fatalf("expected the generated code to contain %s. got:\n%s", s, buf)
+			}
+		}
+	})
+
+	t.Run("test export into the package", func(t *testing.T) {
+		story := &Story{Name: "query", Steps: []Step{&Command{&pgproto3.Query{String: "SELECT 1"}}}}
+		buf := &bytes.Buffer{}
+		if err := (&GoTest{Package: "pg_stories"}).Write(buf, []*Story{story}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "stories.") || !strings.Contains(buf.String(), `runStory(t, &Story{`) {
+			t.Fatalf("expected unqualified types. got:\n%s", buf)
+		}
+	})
+
+	t.Run("test unsupported matcher", func(t *testing.T) {
+		story := &Story{Name: "func", Steps: []Step{&Expectation{
+			Response: &Response{&pgproto3.CommandComplete{}},
+			Matchers: []Matcher{MatcherFunc(func(msg pgproto3.BackendMessage) error { return nil })},
+		}}}
+		err := (&GoTest{Package: "pg_test"}).Write(&bytes.Buffer{}, []*Story{story})
+		if err == nil || !strings.Contains(err.Error(), "MatcherFunc can not be written") {
+			t.Fatalf("expected the matcher to be unsupported. got %v", err)
+		}
+	})
+}
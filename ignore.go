@@ -0,0 +1,79 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+)
+
+const (
+	TokenIgnore          = "@ignore"
+	TokenIgnoreDelimiter = ','
+)
+
+// IgnoreRule tells the runner not to verify the messages of some types that arrive from step From to the
+// end of the story. Ignored messages are not consumed by any step, and they are listed in the report.
+type IgnoreRule struct {
+	// Types are the types of the ignored messages, e.g. 'S' for ParameterStatus
+	Types []byte
+	// From is the index of the first step that the rule applies to
+	From int
+}
+
+// Ignore returns a rule that ignores messages of the provided types during the whole story
+func Ignore(types ...byte) IgnoreRule {
+	return IgnoreRule{Types: types}
+}
+
+// Ignores tells whether the rule ignores msg when it arrives during step i
+func (rule IgnoreRule) Ignores(i int, msg pgproto3.BackendMessage) bool {
+	if i < rule.From {
+		return false
+	}
+	t := msg.Encode(nil)[0]
+	for _, ignored := range rule.Types {
+		if ignored == t {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreRules is a set of rules that ignores a message if any of its rules does
+type IgnoreRules []IgnoreRule
+
+// Ignores tells whether any of the rules ignores msg when it arrives during step i
+func (rules IgnoreRules) Ignores(i int, msg pgproto3.BackendMessage) bool {
+	for _, rule := range rules {
+		if rule.Ignores(i, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatIgnoreRule returns the directive that defines the types of rule in a transcript
+func formatIgnoreRule(rule IgnoreRule) string {
+	types := make([]string, 0, len(rule.Types))
+	for _, t := range rule.Types {
+		types = append(types, string(t))
+	}
+	return TokenIgnore + " " + strings.Join(types, string(TokenIgnoreDelimiter)+" ")
+}
+
+// parseIgnoreRule parses the types of an ignore directive, e.g. @ignore S, K, N
+func parseIgnoreRule(txt string, line int) (IgnoreRule, error) {
+	rule := IgnoreRule{}
+	args := strings.TrimPrefix(txt, TokenIgnore)
+	if strings.Trim(args, WhiteSpaceChars) == "" {
+		return rule, fmt.Errorf("expected message types to ignore at line #%d", line)
+	}
+	for _, t := range strings.Split(args, string(TokenIgnoreDelimiter)) {
+		t = strings.Trim(t, WhiteSpaceChars)
+		if len(t) != 1 || newBackendMessage(t[0]) == nil {
+			return rule, &UnexpectedTokenError{actual: t, line: line, expected: []string{"backend message type"}}
+		}
+		rule.Types = append(rule.Types, t[0])
+	}
+	return rule, nil
+}
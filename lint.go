@@ -0,0 +1,228 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LintIssue is a problem that Lint found in a story
+type LintIssue struct {
+	// Step is the index of the step that the issue was found at
+	Step int
+	// Line is the line in the transcript that defines the step, or 0 if there is none
+	Line    int
+	Message string
+}
+
+func (i LintIssue) String() string {
+	if i.Line > 0 {
+		return fmt.Sprintf("line #%d: %s", i.Line, i.Message)
+	}
+	return fmt.Sprintf("step #%d: %s", i.Step, i.Message)
+}
+
+var (
+	// placeholderPattern matches the parameters of a query, e.g. $1
+	placeholderPattern = regexp.MustCompile(`\$(\d+)`)
+	// prepareSQLPattern and declareSQLPattern match the SQL commands that create statements and portals
+	prepareSQLPattern = regexp.MustCompile(`(?i)^PREPARE\s+("[^"]+"|\w+)`)
+	declareSQLPattern = regexp.MustCompile(`(?i)^DECLARE\s+("[^"]+"|\w+)`)
+	// deallocateSQLPattern and closeSQLPattern match the SQL commands that destroy statements and portals
+	deallocateSQLPattern = regexp.MustCompile(`(?i)^DEALLOCATE\s+(?:PREPARE\s+)?("[^"]+"|\w+)`)
+	closeSQLPattern      = regexp.MustCompile(`(?i)^CLOSE\s+("[^"]+"|\w+)`)
+	beginSQLPattern      = regexp.MustCompile(`(?i)^(BEGIN|START\s+TRANSACTION)\b`)
+	endSQLPattern        = regexp.MustCompile(`(?i)^(COMMIT|ROLLBACK|END|ABORT)\b`)
+)
+
+// sqlName returns the name of an object in SQL as it is named in the protocol, where unquoted names are
+// folded to lower case
+func sqlName(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		return strings.Trim(name, `"`)
+	}
+	return strings.ToLower(name)
+}
+
+// parameterCount returns the number of parameters of a statement that parse prepares
+func parameterCount(parse *pgproto3.Parse) int {
+	count := len(parse.ParameterOIDs)
+	for _, match := range placeholderPattern.FindAllStringSubmatch(parse.Query, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n > count {
+			count = n
+		}
+	}
+	return count
+}
+
+// linter holds the state of the backend that the commands of a story lead to, as far as it is known
+// without running them
+type linter struct {
+	story  *Story
+	issues []LintIssue
+	// statements holds the number of parameters of every prepared statement by its name
+	statements map[string]int
+	// portals holds the names of the open portals
+	portals map[string]bool
+	// transaction tells whether a transaction block was started by a query
+	transaction bool
+	// failed holds the batches whose responses include an ErrorResponse, by their index
+	failed map[int]bool
+	// batch is the index of the batch of the current command. A batch ends with Sync, Query or StartupMessage
+	batch int
+}
+
+// add adds an issue at step i
+func (l *linter) add(i int, format string, args ...interface{}) {
+	issue := LintIssue{Step: i, Message: fmt.Sprintf(format, args...)}
+	if i < len(l.story.Lines) {
+		issue.Line = l.story.Lines[i]
+	}
+	l.issues = append(l.issues, issue)
+}
+
+// report adds an issue at step i, unless the story expects the current batch to fail, which is how the
+// errors of the backend are tested
+func (l *linter) report(i int, format string, args ...interface{}) {
+	if !l.failed[l.batch] {
+		l.add(i, format, args...)
+	}
+}
+
+// query updates the statements, the portals and the transaction with the SQL commands of q
+func (l *linter) query(q string) {
+	// a query replaces the unnamed statement and portal
+	delete(l.statements, "")
+	delete(l.portals, "")
+	for _, sql := range strings.Split(q, ";") {
+		sql = strings.Trim(sql, WhiteSpaceChars+"\r")
+		if m := prepareSQLPattern.FindStringSubmatch(sql); m != nil {
+			l.statements[sqlName(m[1])] = len(placeholderPattern.FindAllString(sql, -1))
+		}
+		if m := deallocateSQLPattern.FindStringSubmatch(sql); m != nil {
+			if strings.EqualFold(m[1], "ALL") {
+				l.statements = make(map[string]int)
+			}
+			delete(l.statements, sqlName(m[1]))
+		}
+		if m := declareSQLPattern.FindStringSubmatch(sql); m != nil {
+			l.portals[sqlName(m[1])] = true
+		}
+		if m := closeSQLPattern.FindStringSubmatch(sql); m != nil {
+			if strings.EqualFold(m[1], "ALL") {
+				l.portals = make(map[string]bool)
+			}
+			delete(l.portals, sqlName(m[1]))
+		}
+		if beginSQLPattern.MatchString(sql) {
+			l.transaction = true
+		}
+		if endSQLPattern.MatchString(sql) {
+			l.transaction = false
+			l.portals = make(map[string]bool)
+		}
+	}
+}
+
+// responseOf returns the Response that step expects, if any
+func responseOf(step Step) (*Response, bool) {
+	switch s := step.(type) {
+	case *Response:
+		return s, true
+	case *Expectation:
+		return s.Response, true
+	}
+	return nil, false
+}
+
+// Lint checks a story for mistakes that can be found without running it:
+//   - Extended query messages that are not followed by Sync
+//   - Bind to a statement that was not prepared
+//   - Execute on a portal that was not bound
+//   - Bind with a different number of parameters than the statement takes
+//   - Sync or Query without a ReadyForQuery step after them
+//
+// Steps whose batch is expected to fail with ErrorResponse are not checked.
+func Lint(story *Story) []LintIssue {
+	l := &linter{
+		story:      story,
+		statements: make(map[string]int),
+		portals:    make(map[string]bool),
+		failed:     make(map[int]bool),
+	}
+	ready, lastSync, unsynced := 0, -1, -1
+	for _, step := range story.Steps {
+		if res, ok := responseOf(step); ok {
+			switch res.BackendMessage.(type) {
+			case *pgproto3.ErrorResponse:
+				l.failed[ready] = true
+			case *pgproto3.ReadyForQuery:
+				ready++
+			}
+		}
+	}
+
+	for i, step := range story.Steps {
+		if res, ok := responseOf(step); ok {
+			if _, ok := res.BackendMessage.(*pgproto3.ReadyForQuery); ok {
+				lastSync = -1
+			}
+		}
+		cmd, ok := commandOf(step)
+		if !ok {
+			continue
+		}
+		switch m := cmd.FrontendMessage.(type) {
+		case *pgproto3.Parse:
+			l.statements[m.Name] = parameterCount(m)
+		case *pgproto3.Bind:
+			count, ok := l.statements[m.PreparedStatement]
+			if !ok {
+				l.report(i, "Bind to undeclared statement %q", m.PreparedStatement)
+			} else if len(m.Parameters) != count {
+				l.report(i, "Bind sends %d parameters to statement %q that takes %d", len(m.Parameters), m.PreparedStatement, count)
+			}
+			l.portals[m.DestinationPortal] = true
+		case *pgproto3.Execute:
+			if !l.portals[m.Portal] {
+				l.report(i, "Execute on unknown portal %q", m.Portal)
+			}
+		case *pgproto3.Close:
+			if m.ObjectType == 'S' {
+				delete(l.statements, m.Name)
+			} else {
+				delete(l.portals, m.Name)
+			}
+		case *pgproto3.Query:
+			l.query(m.String)
+		}
+
+		switch cmd.FrontendMessage.(type) {
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+			if unsynced < 0 {
+				unsynced = i
+			}
+		case *pgproto3.Sync:
+			unsynced, lastSync = -1, i
+			if !l.transaction {
+				l.portals = make(map[string]bool)
+			}
+			l.batch++
+		case *pgproto3.Query, *pgproto3.StartupMessage:
+			lastSync = i
+			l.batch++
+		}
+	}
+
+	if unsynced >= 0 {
+		msg, _ := commandOf(story.Steps[unsynced])
+		l.add(unsynced, "%s is not followed by Sync", messageTypeName(msg.FrontendMessage))
+	}
+	if lastSync >= 0 {
+		msg, _ := commandOf(story.Steps[lastSync])
+		l.add(lastSync, "%s is not followed by %s %s", messageTypeName(msg.FrontendMessage), TokenBackendMessage, TokenReady)
+	}
+	return l.issues
+}
@@ -0,0 +1,141 @@
+package pg_stories
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	lint := func(t *testing.T, lines ...string) []string {
+		story, _, err := createBuilder(t.Name(), lines...).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var issues []string
+		for _, issue := range Lint(story) {
+			issues = append(issues, issue.String())
+		}
+		return issues
+	}
+
+	t.Run("test valid stories", func(t *testing.T) {
+		issues := lint(t,
+			`-> Q "PREPARE stmt AS SELECT $1; BEGIN; DECLARE cur CURSOR FOR SELECT 1"`,
+			`<- Z T`,
+			`-> B "" "stmt" [1]`,
+			`-> E "" 0`,
+			`-> E "cur" 0`,
+			`-> S`,
+			`<- Z T`,
+			`-> P "" "SELECT $2" [25]`,
+			`-> B "" "" [a,b]`,
+			`-> E "" 0`,
+			`-> B "" "baa" []`,
+			`-> S`,
+			`<- 1`,
+			`<- 2`,
+			`<- C`,
+			`<- E {code=26000}`,
+			`<- Z`,
+		)
+		if len(issues) > 0 {
+			t.Fatalf("expected no issues. got %v", issues)
+		}
+	})
+
+	t.Run("test issues", func(t *testing.T) {
+		issues := lint(t,
+			`-> P "stmt" "SELECT $1" []`,
+			`-> B "" "stmt" []`,
+			`-> B "" "baa" []`,
+			`-> S`,
+			`<- Z`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- Z`,
+			`-> C S "stmt"`,
+			`-> Q "SELECT 1"`,
+			`<- Z`,
+		)
+		expected := []string{
+			`line #3: Bind sends 0 parameters to statement "stmt" that takes 1`,
+			`line #4: Bind to undeclared statement "baa"`,
+			`line #7: Execute on unknown portal ""`,
+			`line #10: Close is not followed by Sync`,
+		}
+		if strings.Join(issues, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("expected issues:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(issues, "\n"))
+		}
+
+		issues = lint(t, `-> Q "SELECT 1"`, `<- C`, `-> Q "SELECT 2"`, `<- C`)
+		if len(issues) != 1 || issues[0] != `line #4: Query is not followed by <- Z` {
+			t.Fatalf("expected a missing ReadyForQuery. got %v", issues)
+		}
+	})
+}
+
+func TestFormatTranscript(t *testing.T) {
+	transcript := strings.Join([]string{
+		`@ignore   S,K`,
+		`=== first`,
+		``,
+		`->   Q    "SELECT 1"`,
+		`<- E {message="oops",   code=42601}`,
+		`<- rows ordered`,
+		`|id|name|`,
+		`|--|--|`,
+		`| 1 | "a b" |`,
+		`|100|NULL|`,
+		`@pipeline`,
+		`-> B "" ""   [baa, NULL]`,
+		`@end`,
+		`<- Z   within 1s`,
+		`-> B "" "" [0,2,1.5,foo,"5"]`,
+		`===`,
+		``,
+		``,
+		`=== second`,
+		`<- none 100ms`,
+		`===`,
+	}, "\n")
+	expected := strings.Join([]string{
+		`@ignore S, K`,
+		``,
+		`=== first`,
+		`-> Q "SELECT 1"`,
+		`<- E {code=42601, message=oops}`,
+		`<- rows`,
+		`| id  | name |`,
+		`|-----|------|`,
+		`| 1   | a b  |`,
+		`| 100 | NULL |`,
+		`@pipeline`,
+		`-> B "" "" ["baa",NULL]`,
+		`@end`,
+		`<- Z within 1s`,
+		`-> B "" "" [0,2,1.5,"foo","5"]`,
+		`===`,
+		``,
+		`=== second`,
+		`<- none 100ms`,
+		`===`,
+		``,
+	}, "\n")
+
+	buf := &bytes.Buffer{}
+	if err := FormatTranscript(buf, strings.NewReader(transcript)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("expected transcript:\n%s\nactual:\n%s", expected, buf)
+	}
+	formatted := buf.String()
+	buf.Reset()
+	if err := FormatTranscript(buf, strings.NewReader(formatted)); err != nil || buf.String() != formatted {
+		t.Fatalf("expected the canonical transcript to be kept. got:\n%s", buf)
+	}
+	if err := FormatTranscript(buf, strings.NewReader("=== invalid\n-> Y\n===")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
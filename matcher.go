@@ -0,0 +1,130 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Matcher checks a received message for what can not be expressed as equality of its fields.
+// Matchers are carried by an Expectation and run after its Response is compared.
+type Matcher interface {
+	// Match returns an error if msg does not match
+	Match(msg pgproto3.BackendMessage) error
+}
+
+// MatcherFunc is a function that is used as a Matcher
+type MatcherFunc func(msg pgproto3.BackendMessage) error
+
+func (f MatcherFunc) Match(msg pgproto3.BackendMessage) error {
+	return f(msg)
+}
+
+// messageText returns the text of msg that regular expressions are matched against: the tag of
+// CommandComplete and the message of ErrorResponse and NoticeResponse
+func messageText(msg pgproto3.BackendMessage) (string, bool) {
+	switch m := msg.(type) {
+	case *pgproto3.CommandComplete:
+		return m.CommandTag, true
+	case *pgproto3.ErrorResponse:
+		return m.Message, true
+	case *pgproto3.NoticeResponse:
+		return m.Message, true
+	}
+	return "", false
+}
+
+// RegexpMatcher matches the text of a message against a regular expression. The text is the tag of
+// CommandComplete and the message of ErrorResponse and NoticeResponse.
+type RegexpMatcher struct {
+	Regexp *regexp.Regexp
+	// Partial tells whether the regular expression may match only part of the text
+	Partial bool
+}
+
+func (m *RegexpMatcher) Match(msg pgproto3.BackendMessage) error {
+	text, ok := messageText(msg)
+	if !ok {
+		return fmt.Errorf("%T has no text to match", msg)
+	}
+	if m.Partial {
+		if !m.Regexp.MatchString(text) {
+			return fmt.Errorf("expected %q to contain a match of /%s/", text, m.Regexp)
+		}
+		return nil
+	}
+	if !anchored(m.Regexp).MatchString(text) {
+		return fmt.Errorf("expected %q to match /%s/", text, m.Regexp)
+	}
+	return nil
+}
+
+// anchoredRegexps keeps the anchored copy of every regular expression that was matched against a
+// whole text, so it is compiled once
+var anchoredRegexps = struct {
+	sync.Mutex
+	m map[*regexp.Regexp]*regexp.Regexp
+}{m: make(map[*regexp.Regexp]*regexp.Regexp)}
+
+// anchored returns a copy of re that matches only the whole text. The leftmost match of re itself
+// is not necessarily the longest, e.g. /SELECT|SELECT 1/ matches only "SELECT" of "SELECT 1".
+func anchored(re *regexp.Regexp) *regexp.Regexp {
+	anchoredRegexps.Lock()
+	defer anchoredRegexps.Unlock()
+	a, ok := anchoredRegexps.m[re]
+	if !ok {
+		a = regexp.MustCompile(`^(?:` + re.String() + `)$`)
+		anchoredRegexps.m[re] = a
+	}
+	return a
+}
+
+// token returns the matcher as it is defined in a transcript
+func (m *RegexpMatcher) token() string {
+	token := "/" + strings.Replace(m.Regexp.String(), "/", `\/`, -1) + "/"
+	if m.Partial {
+		return "~" + token
+	}
+	return token
+}
+
+// ColumnValue returns a Matcher that calls match with the value of column in a DataRow,
+// which is nil for NULL
+func ColumnValue(column int, match func(value []byte) error) Matcher {
+	return MatcherFunc(func(msg pgproto3.BackendMessage) error {
+		row, ok := msg.(*pgproto3.DataRow)
+		if !ok {
+			return fmt.Errorf("expected data row. got %T", msg)
+		}
+		if column >= len(row.Values) {
+			return fmt.Errorf("expected data row with at least %d values. got %d", column+1, len(row.Values))
+		}
+		if err := match(row.Values[column]); err != nil {
+			return fmt.Errorf("column #%d: %s", column, err)
+		}
+		return nil
+	})
+}
+
+// RowCount returns a Matcher that calls match with the number of rows in the tag of CommandComplete,
+// which is its last word, e.g. 3 for "INSERT 0 3"
+func RowCount(match func(count int64) error) Matcher {
+	return MatcherFunc(func(msg pgproto3.BackendMessage) error {
+		complete, ok := msg.(*pgproto3.CommandComplete)
+		if !ok {
+			return fmt.Errorf("expected command complete. got %T", msg)
+		}
+		words := strings.Fields(complete.CommandTag)
+		if len(words) == 0 {
+			return fmt.Errorf("command tag %q has no row count", complete.CommandTag)
+		}
+		count, err := strconv.ParseInt(words[len(words)-1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("command tag %q has no row count", complete.CommandTag)
+		}
+		return match(count)
+	})
+}
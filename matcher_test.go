@@ -0,0 +1,75 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMatchers(t *testing.T) {
+
+	t.Run("test regexp", func(t *testing.T) {
+		msg := &pgproto3.ErrorResponse{Code: "42P01", Message: `relation "baa" does not exist`}
+		whole := &RegexpMatcher{Regexp: regexp.MustCompile(`relation .* does not exist`)}
+		if err := whole.Match(msg); err != nil {
+			t.Fatal(err)
+		}
+		partial := &RegexpMatcher{Regexp: regexp.MustCompile(`does not`), Partial: true}
+		if err := partial.Match(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&RegexpMatcher{Regexp: regexp.MustCompile(`does not`)}).Match(msg); err == nil {
+			t.Fatal("expected a regular expression that matches part of the text to fail")
+		}
+		if err := whole.Match(&pgproto3.ReadyForQuery{}); err == nil {
+			t.Fatal("expected a message without text to fail")
+		}
+		alternation := &RegexpMatcher{Regexp: regexp.MustCompile(`SELECT|SELECT 1`)}
+		if err := alternation.Match(&pgproto3.CommandComplete{CommandTag: "SELECT 1"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test column value", func(t *testing.T) {
+		nearNow := ColumnValue(1, func(value []byte) error {
+			ts, err := time.Parse(time.RFC3339, string(value))
+			if err != nil {
+				return err
+			}
+			if time.Since(ts) > time.Minute {
+				return fmt.Errorf("%s is not near now", ts)
+			}
+			return nil
+		})
+		row := &pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte(time.Now().Format(time.RFC3339))}}
+		if err := nearNow.Match(row); err != nil {
+			t.Fatal(err)
+		}
+		row.Values[1] = []byte("2000-01-01T00:00:00Z")
+		if err := nearNow.Match(row); err == nil {
+			t.Fatal("expected an old timestamp to fail")
+		}
+	})
+
+	t.Run("test expectation", func(t *testing.T) {
+		positive := RowCount(func(count int64) error {
+			if count <= 0 {
+				return fmt.Errorf("expected rows. got %d", count)
+			}
+			return nil
+		})
+		e := &Expectation{Response: &Response{&pgproto3.CommandComplete{}}, Matchers: []Matcher{positive}}
+		if err := e.Compare(&pgproto3.CommandComplete{CommandTag: "INSERT 0 3"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Compare(&pgproto3.CommandComplete{CommandTag: "INSERT 0 0"}); err == nil {
+			t.Fatal("expected zero rows to fail")
+		}
+		if err := e.Compare(&pgproto3.ReadyForQuery{}); err == nil {
+			t.Fatal("expected the response to be compared before the matchers")
+		}
+	})
+
+}
@@ -0,0 +1,177 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"sync"
+	"time"
+)
+
+// Order constrains when a notification arrives relative to ReadyForQuery
+type Order int
+
+const (
+	// Anytime accepts a notification no matter when it arrived
+	Anytime Order = iota
+	// BeforeReady requires the notification to arrive before the ReadyForQuery that the next step consumes
+	BeforeReady
+	// AfterReady requires the notification to arrive after the last ReadyForQuery that a step consumed
+	AfterReady
+)
+
+const (
+	TokenBefore = "before"
+	TokenAfter  = "after"
+	TokenReady  = "Z"
+)
+
+// Notification is a type of Step that expects an asynchronous notification. Notifications don't take
+// part in the order of the responses: they are kept in the inbox of the session as they arrive, and
+// the step consumes a matching one that already arrived, or waits for one up to Within.
+type Notification struct {
+	// Channel is the channel of the notification. Empty matches any channel
+	Channel string
+	// Payload is the payload of the notification. It is not compared if AnyPayload is set
+	Payload    string
+	AnyPayload bool
+	// Order constrains when the notification arrives relative to ReadyForQuery
+	Order Order
+	// Within is the maximum time to wait for the notification. Zero means Story.StepTimeout
+	Within time.Duration
+}
+
+// Step is here just to identify Notification as a Step implementation
+func (n *Notification) Step() {}
+
+// matches tells whether msg is the expected notification
+func (n *Notification) matches(msg *pgproto3.NotificationResponse) bool {
+	return (n.Channel == "" || n.Channel == msg.Channel) && (n.AnyPayload || n.Payload == msg.Payload)
+}
+
+// notification is a notification that is kept in an inbox
+type notification struct {
+	msg *pgproto3.NotificationResponse
+	// ready is the number of ReadyForQuery messages that arrived before the notification in the current
+	// run of a story, or -1 if it arrived before the run started
+	ready int
+}
+
+// inbox holds the notifications that arrived on a session and were not consumed yet
+type inbox struct {
+	mu            sync.Mutex
+	notifications []notification
+}
+
+func (in *inbox) add(msg *pgproto3.NotificationResponse, ready int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.notifications = append(in.notifications, notification{msg: msg, ready: ready})
+}
+
+// take removes and returns the first notification that n matches
+func (in *inbox) take(n *Notification) (notification, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i, entry := range in.notifications {
+		if n.matches(entry.msg) {
+			in.notifications = append(in.notifications[:i], in.notifications[i+1:]...)
+			return entry, true
+		}
+	}
+	return notification{}, false
+}
+
+// restart marks the notifications in the inbox as ones that arrived before the current run
+func (in *inbox) restart() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := range in.notifications {
+		in.notifications[i].ready = -1
+	}
+}
+
+// drain removes and returns all the notifications in the inbox
+func (in *inbox) drain() []*pgproto3.NotificationResponse {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var notifications []*pgproto3.NotificationResponse
+	for _, entry := range in.notifications {
+		notifications = append(notifications, entry.msg)
+	}
+	in.notifications = nil
+	return notifications
+}
+
+// checkOrder returns an error if the notification that arrived after ready ReadyForQuery messages
+// breaks order, when consumed ReadyForQuery messages were consumed by steps
+func checkOrder(order Order, ready, consumed int) error {
+	switch {
+	case order == BeforeReady && ready > consumed:
+		return fmt.Errorf("expected notification to arrive before ReadyForQuery #%d", consumed)
+	case order == AfterReady && (consumed == 0 || ready < consumed):
+		return fmt.Errorf("expected notification to arrive after ReadyForQuery #%d", consumed-1)
+	}
+	return nil
+}
+
+// formatNotification returns n as it is defined in a transcript
+func formatNotification(n *Notification) string {
+	line := TokenBackendMessage + " A"
+	if n.Channel != "" || !n.AnyPayload {
+		line += " " + quote(n.Channel)
+	}
+	if !n.AnyPayload {
+		line += " " + quote(n.Payload)
+	}
+	switch n.Order {
+	case BeforeReady:
+		line += " " + TokenBefore + " " + TokenReady
+	case AfterReady:
+		line += " " + TokenAfter + " " + TokenReady
+	}
+	if n.Within > 0 {
+		line += " " + TokenWithin + " " + n.Within.String()
+	}
+	return line
+}
+
+// parseNotification parses the arguments of a notification: an optional channel, an optional payload
+// and an optional order relative to ReadyForQuery
+func parseNotification(parser *tokenParser) (*Notification, error) {
+	n := &Notification{AnyPayload: true}
+	var err error
+	if parser.more() && parser.isString() {
+		if n.Channel, err = parser.readString(); err != nil {
+			return nil, err
+		}
+	}
+	if parser.more() && parser.isString() {
+		if n.Payload, err = parser.readString(); err != nil {
+			return nil, err
+		}
+		n.AnyPayload = false
+	}
+	if !parser.more() {
+		return n, nil
+	}
+	order, err := parser.readToken(0, ' ')
+	if err != nil && order == "" {
+		return nil, err
+	}
+	switch order {
+	case TokenBefore:
+		n.Order = BeforeReady
+	case TokenAfter:
+		n.Order = AfterReady
+	default:
+		return nil, &UnexpectedTokenError{actual: order, expected: []string{TokenBefore, TokenAfter}}
+	}
+	parser.more()
+	if ready, _ := parser.readToken(0, ' '); ready != TokenReady {
+		return nil, &UnexpectedTokenError{actual: ready, expected: []string{TokenReady}}
+	}
+	if parser.more() {
+		return nil, &InvalidArgCountError{msgType: 'A'}
+	}
+	return n, nil
+}
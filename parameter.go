@@ -0,0 +1,151 @@
+package pg_stories
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenAssert = "assert"
+	TokenParam  = "param"
+	TokenEquals = "="
+)
+
+// Parameter is a type of Step that expects the backend to report Value for the run-time parameter Name.
+// Like notifications, ParameterStatus may arrive at any point, so the step is satisfied by the last value
+// that the backend reported for the parameter, and waits for a new report up to Within if it differs.
+type Parameter struct {
+	Name  string
+	Value string
+	// Within is the maximum time to wait for the parameter to be reported. Zero means Story.StepTimeout
+	Within time.Duration
+}
+
+// Step is here just to identify Parameter as a Step implementation
+func (p *Parameter) Step() {}
+
+// ParameterAssertion is a type of Step that checks the last value that the backend reported for the
+// run-time parameter Name, without waiting for a new report
+type ParameterAssertion struct {
+	Name  string
+	Value string
+}
+
+// Step is here just to identify ParameterAssertion as a Step implementation
+func (a *ParameterAssertion) Step() {}
+
+// parameters holds the last value that was reported for every run-time parameter of a session
+type parameters struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (p *parameters) set(name, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.values == nil {
+		p.values = make(map[string]string)
+	}
+	p.values[name] = value
+}
+
+func (p *parameters) get(name string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	value, ok := p.values[name]
+	return value, ok
+}
+
+// all returns a copy of the values of all the parameters
+func (p *parameters) all() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	values := make(map[string]string, len(p.values))
+	for name, value := range p.values {
+		values[name] = value
+	}
+	return values
+}
+
+// status returns the ParameterStatus that reported the last value of name
+func (p *parameters) status(name string) *pgproto3.ParameterStatus {
+	value, _ := p.get(name)
+	return &pgproto3.ParameterStatus{Name: name, Value: value}
+}
+
+// check returns an error unless the last reported value of name is value
+func (p *parameters) check(name, value string) error {
+	actual, ok := p.get(name)
+	if !ok {
+		return fmt.Errorf("expected parameter %s=%s. it was not reported", name, value)
+	}
+	if actual != value {
+		return fmt.Errorf("expected parameter %s=%s. got %s=%s", name, value, name, actual)
+	}
+	return nil
+}
+
+// parseParameter parses the name and the value of a parameter that the backend reports
+func parseParameter(parser *tokenParser) (*Parameter, error) {
+	p := &Parameter{}
+	var err error
+	if p.Name, err = parser.readString(); err != nil {
+		return nil, err
+	}
+	if p.Value, err = parser.readString(); err != nil {
+		return nil, err
+	}
+	if parser.more() {
+		return nil, &InvalidArgCountError{msgType: 'S'}
+	}
+	return p, nil
+}
+
+// formatParameterAssertion returns a as it is defined in a transcript
+func formatParameterAssertion(a *ParameterAssertion) string {
+	value := a.Value
+	if value == "" || value != strings.TrimSpace(value) || strings.ContainsAny(value, " \"\\\n") {
+		value = quote(value)
+	}
+	return fmt.Sprintf("%s %s %s %s %s", TokenAssert, TokenParam, a.Name, TokenEquals, value)
+}
+
+// parseAssertion parses an assertion line, e.g. assert param TimeZone = UTC. The value may be quoted,
+// and it is the rest of the line otherwise.
+func parseAssertion(txt string) (Step, error) {
+	fields := strings.Fields(txt)
+	if len(fields) < 2 || fields[0] != TokenAssert {
+		return nil, &UnexpectedTokenError{actual: txt, expected: []string{TokenAssert}}
+	}
+	if fields[1] != TokenParam {
+		return nil, &UnexpectedTokenError{actual: fields[1], expected: []string{TokenParam}}
+	}
+	rest := strings.TrimLeft(txt, WhiteSpaceChars)[len(TokenAssert):]
+	rest = strings.TrimLeft(rest, WhiteSpaceChars)[len(TokenParam):]
+	i := strings.Index(rest, TokenEquals)
+	if i < 0 {
+		return nil, fmt.Errorf("expected %s name %s value", TokenParam, TokenEquals)
+	}
+	a := &ParameterAssertion{Name: strings.Trim(rest[:i], WhiteSpaceChars)}
+	if a.Name == "" || strings.ContainsAny(a.Name, WhiteSpaceChars) {
+		return nil, fmt.Errorf("invalid parameter name %q", a.Name)
+	}
+	value := strings.Trim(rest[i+len(TokenEquals):], WhiteSpaceChars)
+	if !strings.HasPrefix(value, string(TokenDelimiterString)) {
+		a.Value = value
+		return a, nil
+	}
+	parser := &tokenParser{bufio.NewReader(strings.NewReader(value))}
+	var err error
+	if a.Value, err = parser.readString(); err != nil {
+		return nil, err
+	}
+	if parser.more() {
+		return nil, fmt.Errorf("unexpected value after parameter %s", a.Name)
+	}
+	return a, nil
+}
@@ -0,0 +1,195 @@
+package pg_stories
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// messageTypeName returns the name of the type of msg without its package, e.g. Query
+func messageTypeName(msg pgproto3.Message) string {
+	if msg == nil {
+		return ""
+	}
+	name := fmt.Sprintf("%T", msg)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// describeCommand returns msg as it is defined in a transcript, or its type if it can't be
+func describeCommand(msg pgproto3.FrontendMessage) string {
+	line, err := formatCommand(msg)
+	if err != nil {
+		return messageTypeName(msg)
+	}
+	return line
+}
+
+// describeResponse returns msg as it is defined in a transcript
+func describeResponse(msg pgproto3.BackendMessage) string {
+	return formatResponse(msg)
+}
+
+// describeStep returns step as it is defined in a transcript, or its type if it can't be
+func describeStep(step Step) string {
+	switch s := step.(type) {
+	case *Command:
+		return TokenFrontendMessage + " " + describeCommand(s.FrontendMessage)
+	case *Pipelined:
+		return describeStep(s.Command)
+	case *Response:
+		return TokenBackendMessage + " " + describeResponse(s.BackendMessage)
+	}
+	if set, ok := step.(*RowSet); ok {
+		return fmt.Sprintf("%s %s %s (%d rows)", TokenBackendMessage, TokenRows, TokenUnordered, len(set.Rows))
+	}
+	if line, err := FormatStep(step); err == nil {
+		return line
+	}
+	if e, ok := step.(*Expectation); ok {
+		return describeStep(e.Response) + " (custom matchers)"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", step), "*")
+}
+
+// timeline records what actually happened on every step of a running story
+type timeline struct {
+	mu      sync.Mutex
+	steps   []Step
+	lines   []int
+	actual  []string
+	ignored []ignoredMessage
+	current int
+}
+
+// ignoredMessage is a message that was ignored while a step ran
+type ignoredMessage struct {
+	step int
+	msg  string
+}
+
+func newTimeline(s *Story) *timeline {
+	return &timeline{steps: s.Steps, lines: s.Lines, actual: make([]string, len(s.Steps))}
+}
+
+// start marks step i as the one that is currently running
+func (tl *timeline) start(i int) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.current = i
+}
+
+// record sets what actually happened on step i
+func (tl *timeline) record(i int, actual string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.actual[i] = actual
+}
+
+// ignore records msg as a message that was ignored while step i ran
+func (tl *timeline) ignore(i int, msg string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.ignored = append(tl.ignored, ignoredMessage{step: i, msg: msg})
+}
+
+// fail returns a StoryError for err that occurred on the current step
+func (tl *timeline) fail(err error, unconsumed []pgproto3.BackendMessage) *StoryError {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	e := &StoryError{err: err, step: tl.current}
+	for i, step := range tl.steps {
+		entry := timelineEntry{expected: describeStep(step), actual: tl.actual[i]}
+		if i < len(tl.lines) {
+			entry.line = tl.lines[i]
+		}
+		e.timeline = append(e.timeline, entry)
+	}
+	for _, msg := range unconsumed {
+		e.unconsumed = append(e.unconsumed, TokenBackendMessage+" "+describeResponse(msg))
+	}
+	e.ignored = append(e.ignored, tl.ignored...)
+	return e
+}
+
+type timelineEntry struct {
+	line     int
+	expected string
+	actual   string
+}
+
+// StoryError is returned by Run when a story fails. Its message is a report that aligns the expected
+// steps with what actually happened, step by step, followed by the messages that were received
+// from the backend but not consumed by any step, and the ones that were ignored.
+type StoryError struct {
+	err        error
+	step       int
+	timeline   []timelineEntry
+	unconsumed []string
+	ignored    []ignoredMessage
+}
+
+// Cause returns the error that failed the story
+func (e *StoryError) Cause() error {
+	return e.err
+}
+
+// Step returns the index of the step that failed. It equals to the number of steps if the story
+// failed after all of them were completed.
+func (e *StoryError) Step() int {
+	return e.step
+}
+
+// Line returns the line of the transcript that defines the failed step, or 0 if it is unknown.
+func (e *StoryError) Line() int {
+	if e.step < len(e.timeline) {
+		return e.timeline[e.step].line
+	}
+	return 0
+}
+
+func (e *StoryError) Error() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "step #%d", e.step)
+	if line := e.Line(); line > 0 {
+		fmt.Fprintf(buf, " at line %d", line)
+	}
+	fmt.Fprintf(buf, " failed: %s\n", e.err)
+
+	table := &bytes.Buffer{}
+	w := tabwriter.NewWriter(table, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "step\tline\texpected\tactual\t")
+	for i, entry := range e.timeline {
+		line := "-"
+		if entry.line > 0 {
+			line = strconv.Itoa(entry.line)
+		}
+		marker := ""
+		if i == e.step {
+			marker = "<<<"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", i, line, entry.expected, entry.actual, marker)
+	}
+	w.Flush()
+	for _, line := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+		fmt.Fprintln(buf, strings.TrimRight(line, " "))
+	}
+
+	if len(e.unconsumed) > 0 {
+		fmt.Fprintln(buf, "unconsumed messages:")
+		for _, msg := range e.unconsumed {
+			fmt.Fprintln(buf, msg)
+		}
+	}
+	if len(e.ignored) > 0 {
+		fmt.Fprintln(buf, "ignored messages:")
+		for _, ignored := range e.ignored {
+			fmt.Fprintf(buf, "%s (step #%d)\n", ignored.msg, ignored.step)
+		}
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
@@ -0,0 +1,271 @@
+package pg_stories
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepEvent describes a single step of a running story
+type StepEvent struct {
+	// Story is the name of the story
+	Story string
+	// Run identifies the run of the story that the step is part of, as passed to StoryStarted
+	Run uint64
+	// Step is the index of the step in the story
+	Step int
+	// Line is the line in the transcript that defines the step, or 0 if there is none
+	Line int
+	// Time is when the step was completed
+	Time time.Time
+	// Direction is TokenFrontendMessage for sent messages and TokenBackendMessage for received messages
+	Direction string
+	// Type is the type of the message, e.g. Query
+	Type string
+	// Payload is the message as it is defined in a transcript
+	Payload string
+	// Err is the error that failed the step, if any
+	Err error
+}
+
+// Reporter is notified on the progress of running stories, so their results can be consumed
+// by tools other than the go test runner. Reporters are safe for use by concurrent stories.
+// Every run of a story has its own ID, since stories may share names or have none, and the same
+// story may run concurrently.
+type Reporter interface {
+	// StoryStarted is called before the first step of run of the named story
+	StoryStarted(run uint64, name string)
+	// StepDone is called after every step of a story
+	StepDone(event StepEvent)
+	// StoryEnded is called after run of the named story ends with the error that failed it, if any
+	StoryEnded(run uint64, name string, err error)
+	// Close writes whatever is left to write after all the stories ended
+	Close() error
+}
+
+// JSONReporter writes a JSON object per line for every event
+type JSONReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONReporter returns a JSONReporter that writes to w
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Story     string    `json:"story"`
+	Run       uint64    `json:"run"`
+	Step      *int      `json:"step,omitempty"`
+	Line      int       `json:"line,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Payload   string    `json:"payload,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (r *JSONReporter) write(event jsonEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(event)
+}
+
+// StoryStarted writes a start event
+func (r *JSONReporter) StoryStarted(run uint64, name string) {
+	r.write(jsonEvent{Time: time.Now(), Event: "start", Story: name, Run: run})
+}
+
+// StepDone writes a step event
+func (r *JSONReporter) StepDone(event StepEvent) {
+	e := jsonEvent{
+		Time:      event.Time,
+		Event:     "step",
+		Story:     event.Story,
+		Run:       event.Run,
+		Step:      &event.Step,
+		Line:      event.Line,
+		Direction: event.Direction,
+		Type:      event.Type,
+		Payload:   event.Payload,
+	}
+	if event.Err != nil {
+		e.Error = event.Err.Error()
+	}
+	r.write(e)
+}
+
+// StoryEnded writes an end event with the error that failed the story, if any
+func (r *JSONReporter) StoryEnded(run uint64, name string, err error) {
+	e := jsonEvent{Time: time.Now(), Event: "end", Story: name, Run: run}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.write(e)
+}
+
+// Close does nothing, since every event is written once it happens
+func (r *JSONReporter) Close() error {
+	return nil
+}
+
+// TAPReporter writes a TAP version 13 stream where every story is a test point and its steps
+// are written as diagnostic comments
+type TAPReporter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	count int
+}
+
+// NewTAPReporter returns a TAPReporter that writes to w
+func NewTAPReporter(w io.Writer) *TAPReporter {
+	fmt.Fprintln(w, "TAP version 13")
+	return &TAPReporter{w: w}
+}
+
+// StoryStarted does nothing, since a test point is written once its story ends
+func (r *TAPReporter) StoryStarted(run uint64, name string) {}
+
+// StepDone writes the step as a diagnostic comment
+func (r *TAPReporter) StepDone(event StepEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.w, "# %s: %s %s\n", event.Story, event.Direction, event.Payload)
+}
+
+// StoryEnded writes the test point of the story, with the error that failed it as a YAML block
+func (r *TAPReporter) StoryEnded(run uint64, name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	if err == nil {
+		fmt.Fprintf(r.w, "ok %d - %s\n", r.count, name)
+		return
+	}
+	fmt.Fprintf(r.w, "not ok %d - %s\n  ---\n  message: |\n", r.count, name)
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(r.w, "    %s\n", line)
+	}
+	fmt.Fprintln(r.w, "  ...")
+}
+
+// Close writes the plan of the stream
+func (r *TAPReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := fmt.Fprintf(r.w, "1..%d\n", r.count)
+	return err
+}
+
+type junitFailure struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+
+	started time.Time
+	steps   []string
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name         `xml:"testsuite"`
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Time      float64          `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+// JUnitReporter writes a JUnit XML test suite where every story is a test case. Since the
+// document is written as a whole, nothing is written until Close is called.
+type JUnitReporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	started time.Time
+	suite   junitTestSuite
+	// running holds the test cases of the stories that didn't end yet by their run
+	running map[uint64]*junitTestCase
+}
+
+// NewJUnitReporter returns a JUnitReporter that writes a test suite with the provided name to w
+func NewJUnitReporter(w io.Writer, suite string) *JUnitReporter {
+	return &JUnitReporter{
+		w:       w,
+		started: time.Now(),
+		suite:   junitTestSuite{Name: suite},
+		running: make(map[uint64]*junitTestCase),
+	}
+}
+
+// StoryStarted adds a test case for the story
+func (r *JUnitReporter) StoryStarted(run uint64, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tc := &junitTestCase{Name: name, ClassName: r.suite.Name, started: time.Now()}
+	r.running[run] = tc
+	r.suite.TestCases = append(r.suite.TestCases, tc)
+}
+
+// StepDone adds the step to the output of the test case of its story
+func (r *JUnitReporter) StepDone(event StepEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tc, ok := r.running[event.Run]; ok {
+		tc.steps = append(tc.steps, event.Time.Format(time.RFC3339Nano)+" "+event.Direction+" "+event.Payload)
+	}
+}
+
+// StoryEnded sets the time of the test case of the story, and its failure if err is not nil
+func (r *JUnitReporter) StoryEnded(run uint64, name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tc, ok := r.running[run]
+	if !ok {
+		return
+	}
+	delete(r.running, run)
+	tc.Time = time.Since(tc.started).Seconds()
+	tc.SystemOut = strings.Join(tc.steps, "\n")
+	if err != nil {
+		message := strings.SplitN(err.Error(), "\n", 2)[0]
+		tc.Failure = &junitFailure{Message: message, Contents: err.Error()}
+	}
+}
+
+// Close writes the test suite
+func (r *JUnitReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suite.Tests = len(r.suite.TestCases)
+	r.suite.Failures = 0
+	for _, tc := range r.suite.TestCases {
+		if tc.Failure != nil {
+			r.suite.Failures++
+		}
+	}
+	r.suite.Time = time.Since(r.started).Seconds()
+	r.suite.Timestamp = r.started.Format(time.RFC3339)
+	if _, err := io.WriteString(r.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(r.w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(r.suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(r.w, "\n")
+	return err
+}
@@ -0,0 +1,128 @@
+package pg_stories
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"testing"
+)
+
+func runReported(t *testing.T, reporter Reporter) {
+	responses := []pgproto3.BackendMessage{
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "column1"}}},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("baa")}},
+		&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}
+	for _, name := range []string{"pass", "fail"} {
+		value := name
+		if name == "pass" {
+			value = "baa"
+		}
+		story := &Story{
+			Name:     name,
+			Frontend: pipeFrontend(t, answerQueries(responses...)),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.RowDescription{}},
+				&Response{&pgproto3.DataRow{Values: [][]byte{[]byte(value)}}},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			Reporter: reporter,
+		}
+		story.Run(t, nil)
+	}
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReporters(t *testing.T) {
+
+	t.Run("test json", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		runReported(t, NewJSONReporter(buf))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		// pass: start, 5 steps and end. fail: start, 3 steps and end
+		if len(lines) != 12 {
+			t.Fatalf("expected 12 events. actual: %d\n%s", len(lines), buf)
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event["direction"] != TokenFrontendMessage || event["type"] != "Query" {
+			t.Fatalf("expected a sent Query event. actual: %s", lines[1])
+		}
+		if !strings.Contains(lines[11], `"error"`) {
+			t.Fatalf("expected the last event to have an error. actual: %s", lines[11])
+		}
+	})
+
+	t.Run("test tap", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		runReported(t, NewTAPReporter(buf))
+		out := buf.String()
+		for _, expected := range []string{"TAP version 13\n", "ok 1 - pass\n", "not ok 2 - fail\n", "1..2\n"} {
+			if !strings.Contains(out, expected) {
+				t.Fatalf("expected output to contain %q. actual:\n%s", expected, out)
+			}
+		}
+	})
+
+	t.Run("test junit", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		runReported(t, NewJUnitReporter(buf, "stories"))
+		var suite junitTestSuite
+		if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+			t.Fatal(err)
+		}
+		if suite.Tests != 2 || suite.Failures != 1 {
+			t.Fatalf("expected 2 tests and 1 failure. actual: %d tests and %d failures", suite.Tests, suite.Failures)
+		}
+		if suite.TestCases[1].Name != "fail" || suite.TestCases[1].Failure == nil {
+			t.Fatalf("expected the second test case to fail")
+		}
+	})
+
+	t.Run("test junit concurrent runs", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		reporter := NewJUnitReporter(buf, "stories")
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(&pgproto3.ReadyForQuery{TxStatus: 'I'})),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			Reporter: reporter,
+		}
+		other := *story
+		other.Frontend = pipeFrontend(t, answerQueries(&pgproto3.ReadyForQuery{TxStatus: 'I'}))
+		other.Steps = append([]Step{}, story.Steps...)
+		other.Steps[1] = &Response{&pgproto3.ReadyForQuery{TxStatus: 'T'}}
+		done := make(chan error)
+		go func() { done <- story.Run(t, nil) }()
+		go func() { done <- other.Run(t, nil) }()
+		<-done
+		<-done
+		if err := reporter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var suite junitTestSuite
+		if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+			t.Fatal(err)
+		}
+		if suite.Tests != 2 || suite.Failures != 1 {
+			t.Fatalf("expected 2 tests and 1 failure. actual: %d tests and %d failures", suite.Tests, suite.Failures)
+		}
+		for _, tc := range suite.TestCases {
+			if strings.Count(tc.SystemOut, "\n") != 1 {
+				t.Fatalf("expected the test case to hold the 2 steps of its run. got:\n%s", tc.SystemOut)
+			}
+		}
+	})
+
+}
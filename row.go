@@ -0,0 +1,381 @@
+package pg_stories
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OIDs of the builtin types that pgtype has no constants for
+const (
+	intervalOID     pgtype.OID = 1186
+	numericArrayOID pgtype.OID = 1231
+)
+
+// typeOIDs are the OIDs of the builtin types that values are decoded to
+var typeOIDs = map[string]pgtype.OID{
+	"bool":         pgtype.BoolOID,
+	"bytea":        pgtype.ByteaOID,
+	"char":         pgtype.CharOID,
+	"name":         pgtype.NameOID,
+	"int8":         pgtype.Int8OID,
+	"int2":         pgtype.Int2OID,
+	"int4":         pgtype.Int4OID,
+	"text":         pgtype.TextOID,
+	"oid":          pgtype.OIDOID,
+	"json":         pgtype.JSONOID,
+	"float4":       pgtype.Float4OID,
+	"float8":       pgtype.Float8OID,
+	"unknown":      pgtype.UnknownOID,
+	"inet":         pgtype.InetOID,
+	"_bool":        pgtype.BoolArrayOID,
+	"_int2":        pgtype.Int2ArrayOID,
+	"_int4":        pgtype.Int4ArrayOID,
+	"_text":        pgtype.TextArrayOID,
+	"_bytea":       pgtype.ByteaArrayOID,
+	"_bpchar":      pgtype.BPCharArrayOID,
+	"_varchar":     pgtype.VarcharArrayOID,
+	"_int8":        pgtype.Int8ArrayOID,
+	"_float4":      pgtype.Float4ArrayOID,
+	"_float8":      pgtype.Float8ArrayOID,
+	"bpchar":       pgtype.BPCharOID,
+	"varchar":      pgtype.VarcharOID,
+	"date":         pgtype.DateOID,
+	"timestamp":    pgtype.TimestampOID,
+	"_timestamp":   pgtype.TimestampArrayOID,
+	"_date":        pgtype.DateArrayOID,
+	"timestamptz":  pgtype.TimestamptzOID,
+	"_timestamptz": pgtype.TimestamptzArrayOID,
+	"interval":     intervalOID,
+	"_numeric":     numericArrayOID,
+	"numeric":      pgtype.NumericOID,
+	"uuid":         pgtype.UUIDOID,
+	"_uuid":        pgtype.UUIDArrayOID,
+	"jsonb":        pgtype.JSONBOID,
+}
+
+var connInfo = newConnInfo()
+
+func newConnInfo() *pgtype.ConnInfo {
+	ci := pgtype.NewConnInfo()
+	ci.InitializeDataTypes(typeOIDs)
+	return ci
+}
+
+// decodedArray is an array value whose elements were decoded
+type decodedArray struct {
+	dimensions []pgtype.ArrayDimension
+	elements   []interface{}
+}
+
+// normalize returns v in a form that can be compared by equalValue
+func normalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case *pgtype.Numeric:
+		r := new(big.Rat).SetInt(value.Int)
+		exp := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(value.Exp))), nil)
+		if value.Exp < 0 {
+			return r.Quo(r, new(big.Rat).SetInt(exp))
+		}
+		return r.Mul(r, new(big.Rat).SetInt(exp))
+	case pgtype.Value:
+		// arrays are returned as themselves, their elements are decoded values as well
+		rv := reflect.Indirect(reflect.ValueOf(value))
+		if rv.Kind() != reflect.Struct || !rv.FieldByName("Elements").IsValid() {
+			return v
+		}
+		a := &decodedArray{dimensions: rv.FieldByName("Dimensions").Interface().([]pgtype.ArrayDimension)}
+		elements := rv.FieldByName("Elements")
+		for i := 0; i < elements.Len(); i++ {
+			element := elements.Index(i).Addr().Interface().(pgtype.Value)
+			a.elements = append(a.elements, normalize(element.Get()))
+		}
+		return a
+	}
+	return v
+}
+
+func abs(i int32) int32 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// equalValue tells whether two values that were returned by DecodeValue are equal
+func equalValue(a, b interface{}) bool {
+	switch x := a.(type) {
+	case *big.Rat:
+		y, ok := b.(*big.Rat)
+		return ok && x.Cmp(y) == 0
+	case float32:
+		y, ok := b.(float32)
+		return ok && (x == y || math.IsNaN(float64(x)) && math.IsNaN(float64(y)))
+	case float64:
+		y, ok := b.(float64)
+		return ok && (x == y || math.IsNaN(x) && math.IsNaN(y))
+	case time.Time:
+		y, ok := b.(time.Time)
+		return ok && x.Equal(y)
+	case *decodedArray:
+		y, ok := b.(*decodedArray)
+		if !ok || !reflect.DeepEqual(x.dimensions, y.dimensions) || len(x.elements) != len(y.elements) {
+			return false
+		}
+		for i := range x.elements {
+			if !equalValue(x.elements[i], y.elements[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// DecodeValue decodes a value of a DataRow into a Go value by the type and format of its field.
+// NULL is decoded to nil, numeric to *big.Rat, or to a float64 when it is NaN or infinite, timestamps to time.Time and json to the values
+// that encoding/json unmarshals. Values of unknown types are decoded to strings or bytes.
+func DecodeValue(field pgproto3.FieldDescription, value []byte) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if pgtype.OID(field.DataTypeOID) == pgtype.NumericOID {
+		if f, ok := specialNumeric(field.Format, value); ok {
+			return f, nil
+		}
+	}
+	var v pgtype.Value
+	if dt, ok := connInfo.DataTypeForOID(pgtype.OID(field.DataTypeOID)); ok {
+		v = reflect.New(reflect.TypeOf(dt.Value).Elem()).Interface().(pgtype.Value)
+	}
+	// decoders take ownership of the value
+	src := append([]byte{}, value...)
+	switch field.Format {
+	case pgproto3.TextFormat:
+		if v == nil {
+			v = &pgtype.GenericText{}
+		}
+		decoder, ok := v.(pgtype.TextDecoder)
+		if !ok {
+			return nil, fmt.Errorf("type %d can not be decoded from text", field.DataTypeOID)
+		}
+		if err := decoder.DecodeText(connInfo, src); err != nil {
+			return nil, err
+		}
+	case pgproto3.BinaryFormat:
+		if v == nil {
+			v = &pgtype.GenericBinary{}
+		}
+		decoder, ok := v.(pgtype.BinaryDecoder)
+		if !ok {
+			return nil, fmt.Errorf("type %d can not be decoded from binary", field.DataTypeOID)
+		}
+		if err := decoder.DecodeBinary(connInfo, src); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format code %d", field.Format)
+	}
+	return normalize(v.Get()), nil
+}
+
+// Signs of the binary format of numeric that mark values that are not numbers
+const (
+	numericNaN    = 0xC000
+	numericPosInf = 0xD000
+	numericNegInf = 0xF000
+)
+
+// specialNumeric returns the numeric value that pgtype can not decode, NaN and the infinities
+func specialNumeric(format int16, value []byte) (float64, bool) {
+	if format == pgproto3.BinaryFormat {
+		if len(value) < 8 {
+			return 0, false
+		}
+		switch binary.BigEndian.Uint16(value[4:]) {
+		case numericNaN:
+			return math.NaN(), true
+		case numericPosInf:
+			return math.Inf(1), true
+		case numericNegInf:
+			return math.Inf(-1), true
+		}
+		return 0, false
+	}
+	switch string(value) {
+	case "NaN":
+		return math.NaN(), true
+	case "Infinity":
+		return math.Inf(1), true
+	case "-Infinity":
+		return math.Inf(-1), true
+	}
+	return 0, false
+}
+
+// Row is a type of Step that expects a DataRow whose values equal Values once both are decoded by the
+// types of the preceding RowDescription, so that 1.0 equals 1 for numeric, timestamps are compared as
+// instants and binary values are compared with their text form.
+type Row struct {
+	// Values are the expected values in text format, where nil is NULL
+	Values [][]byte
+	// Within is the maximum time to wait for the row. Zero means Story.StepTimeout
+	Within time.Duration
+}
+
+// Step is here just to identify Row as a Step implementation
+func (r *Row) Step() {}
+
+// Compare decodes the values of msg by fields and compares them with the expected values. Values are
+// compared as text when fields are unknown.
+func (r *Row) Compare(msg pgproto3.BackendMessage, fields []pgproto3.FieldDescription) error {
+	row, ok := msg.(*pgproto3.DataRow)
+	if !ok {
+		return fmt.Errorf("wrong type of message. expected: *pgproto3.DataRow. got %T", msg)
+	}
+	if len(row.Values) != len(r.Values) {
+		return fmt.Errorf("expected data row with %d values. got %d", len(r.Values), len(row.Values))
+	}
+	for i, expected := range r.Values {
+		field := pgproto3.FieldDescription{DataTypeOID: pgtype.TextOID}
+		if i < len(fields) {
+			field = fields[i]
+		}
+		actual, err := DecodeValue(field, row.Values[i])
+		if err != nil {
+			return fmt.Errorf("column #%d: failed to decode %q: %s", i, row.Values[i], err)
+		}
+		field.Format = pgproto3.TextFormat
+		want, err := DecodeValue(field, expected)
+		if err != nil {
+			return fmt.Errorf("column #%d: failed to decode expected %q: %s", i, expected, err)
+		}
+		if !equalValue(want, actual) {
+			return fmt.Errorf("column #%d: expected %s. got %s", i, formatCell(expected), formatCell(row.Values[i]))
+		}
+	}
+	return nil
+}
+
+// formatCell returns a value as a cell of a row in a transcript
+func formatCell(value []byte) string {
+	s := string(value)
+	switch {
+	case value == nil:
+		return "NULL"
+	case s == "" || s == "NULL" || strings.ContainsAny(s, "|\"\\\n") || strings.Trim(s, WhiteSpaceChars) != s:
+		return quote(s)
+	}
+	return s
+}
+
+// formatRow returns values as a row in a transcript
+func formatRow(values [][]byte) string {
+	cells := make([]string, 0, len(values))
+	for _, v := range values {
+		cells = append(cells, formatCell(v))
+	}
+	if len(cells) == 0 {
+		return string(TokenCellDelimiter)
+	}
+	return fmt.Sprintf("%c %s %c", TokenCellDelimiter, strings.Join(cells, fmt.Sprintf(" %c ", TokenCellDelimiter)), TokenCellDelimiter)
+}
+
+// RowSet is a type of Step that expects a DataRow for each of Rows, in any order
+type RowSet struct {
+	Rows []*Row
+}
+
+// Step is here just to identify RowSet as a Step implementation
+func (r *RowSet) Step() {}
+
+// rowsBlock is a result set that is defined as a table in a transcript
+type rowsBlock struct {
+	line      int
+	unordered bool
+	columns   []string
+	lines     []int
+	rows      []*Row
+}
+
+// parseRowsHeader parses the options that follow "<- rows" at line
+func parseRowsHeader(options []string, line int) (*rowsBlock, error) {
+	block := &rowsBlock{line: line}
+	for _, option := range options {
+		switch option {
+		case TokenOrdered:
+			block.unordered = false
+		case TokenUnordered:
+			block.unordered = true
+		default:
+			return nil, &UnexpectedTokenError{actual: option, line: line, expected: []string{TokenOrdered, TokenUnordered}}
+		}
+	}
+	return block, nil
+}
+
+// isSeparator tells whether txt is a line that separates the column names from the rows, e.g. |---|---|
+func isSeparator(txt string) bool {
+	return strings.Trim(txt, "|-+: \t") == "" && strings.Contains(txt, "-")
+}
+
+// add parses the table line txt. The first line holds the column names and the rest hold the values
+func (b *rowsBlock) add(txt string, line int) error {
+	if isSeparator(txt) {
+		return nil
+	}
+	parser := &tokenParser{bufio.NewReader(strings.NewReader(txt))}
+	values, err := parser.readRow()
+	if err != nil {
+		return fmt.Errorf("invalid row at line #%d: %s", line, err)
+	}
+	if b.columns == nil {
+		b.columns = []string{}
+		for _, v := range values {
+			if v == nil {
+				return fmt.Errorf("invalid column name NULL at line #%d", line)
+			}
+			b.columns = append(b.columns, string(v))
+		}
+		b.lines = append(b.lines, line)
+		return nil
+	}
+	if len(values) != len(b.columns) {
+		return fmt.Errorf("expected %d values at line #%d. got %d", len(b.columns), line, len(values))
+	}
+	b.rows = append(b.rows, &Row{Values: values})
+	b.lines = append(b.lines, line)
+	return nil
+}
+
+// steps returns the RowDescription, DataRow and CommandComplete steps of the block and their lines
+func (b *rowsBlock) steps() ([]Step, []int, error) {
+	if b.columns == nil {
+		return nil, nil, fmt.Errorf("expected column names after line #%d", b.line)
+	}
+	description := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{}}
+	for _, name := range b.columns {
+		description.Fields = append(description.Fields, pgproto3.FieldDescription{Name: name})
+	}
+	steps := []Step{&Response{description}}
+	lines := []int{b.lines[0]}
+	if b.unordered && len(b.rows) > 0 {
+		steps = append(steps, &RowSet{Rows: b.rows})
+		lines = append(lines, b.line)
+	} else {
+		for _, row := range b.rows {
+			steps = append(steps, row)
+		}
+		lines = append(lines, b.lines[1:]...)
+	}
+	steps = append(steps, &Response{&pgproto3.CommandComplete{}})
+	lines = append(lines, b.line)
+	return steps, lines, nil
+}
@@ -0,0 +1,62 @@
+package pg_stories
+
+import (
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+	"testing"
+)
+
+func TestRow_Compare(t *testing.T) {
+	int4Binary := make([]byte, 4)
+	binary.BigEndian.PutUint32(int4Binary, 42)
+	array := &pgtype.Int4Array{}
+	if err := array.Set([]int32{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	arrayBinary, err := array.EncodeBinary(connInfo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numericNaNBinary := make([]byte, 8)
+	binary.BigEndian.PutUint16(numericNaNBinary[4:], numericNaN)
+
+	tests := []struct {
+		name     string
+		field    pgproto3.FieldDescription
+		expected string
+		actual   []byte
+		equal    bool
+	}{
+		{"numeric scale", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "1", []byte("1.00"), true},
+		{"numeric differs", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "1", []byte("1.01"), false},
+		{"numeric nan", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "NaN", []byte("NaN"), true},
+		{"binary numeric nan", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID, Format: pgproto3.BinaryFormat}, "NaN", numericNaNBinary, true},
+		{"numeric infinity", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "-Infinity", []byte("-Infinity"), true},
+		{"numeric infinity differs", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "Infinity", []byte("-Infinity"), false},
+		{"numeric nan differs", pgproto3.FieldDescription{DataTypeOID: pgtype.NumericOID}, "0", []byte("NaN"), false},
+		{"float8 nan", pgproto3.FieldDescription{DataTypeOID: pgtype.Float8OID}, "NaN", []byte("NaN"), true},
+		{"float4 nan", pgproto3.FieldDescription{DataTypeOID: pgtype.Float4OID}, "NaN", []byte("NaN"), true},
+		{"binary int", pgproto3.FieldDescription{DataTypeOID: pgtype.Int4OID, Format: pgproto3.BinaryFormat}, "42", int4Binary, true},
+		{"bool", pgproto3.FieldDescription{DataTypeOID: pgtype.BoolOID}, "t", []byte("t"), true},
+		{"timestamptz zones", pgproto3.FieldDescription{DataTypeOID: pgtype.TimestamptzOID}, "2020-01-01 00:00:00+00", []byte("2020-01-01 02:00:00+02"), true},
+		{"uuid", pgproto3.FieldDescription{DataTypeOID: pgtype.UUIDOID}, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", []byte("A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11"), true},
+		{"json order", pgproto3.FieldDescription{DataTypeOID: pgtype.JSONOID}, `{"a": 1, "b": [true]}`, []byte(`{"b":[true],"a":1}`), true},
+		{"binary array", pgproto3.FieldDescription{DataTypeOID: pgtype.Int4ArrayOID, Format: pgproto3.BinaryFormat}, "{1,2}", arrayBinary, true},
+		{"array differs", pgproto3.FieldDescription{DataTypeOID: pgtype.Int4ArrayOID}, "{1,2}", []byte("{2,1}"), false},
+		{"unknown type", pgproto3.FieldDescription{DataTypeOID: 99999}, "baa", []byte("baa"), true},
+		{"null", pgproto3.FieldDescription{DataTypeOID: pgtype.TextOID}, "baa", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			row := &Row{Values: [][]byte{[]byte(test.expected)}}
+			err := row.Compare(&pgproto3.DataRow{Values: [][]byte{test.actual}}, []pgproto3.FieldDescription{test.field})
+			if test.equal && err != nil {
+				t.Fatal(err)
+			}
+			if !test.equal && err == nil {
+				t.Fatalf("expected %q not to equal %q", test.expected, test.actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runs counts the runs of all the stories, so every run has its own ID for reporters
+var runs uint64
+
+// runner holds the state of a single run of a story, so the same Story can run any number of times
+type runner struct {
+	story     *Story
+	session   *Session
+	logf      func(format string, args ...interface{})
+	stop      <-chan interface{}
+	validator *Validator
+	timeline  *timeline
+	// id identifies the run for reporters
+	id uint64
+	// observe is called after every step with the time it took, if set
+	observe func(i int, elapsed time.Duration, err error)
+	// fields describe the values of the rows that follow the last consumed RowDescription
+	fields []pgproto3.FieldDescription
+	// arrived and consumed count the ReadyForQuery messages that arrived and that were consumed by steps
+	arrived  int
+	consumed int
+	// txStatus is the transaction status of the last consumed ReadyForQuery
+	txStatus byte
+	// pending holds messages that were received and passed the filter but were not consumed yet
+	pending []pgproto3.BackendMessage
+	// current is the index of the step that is running
+	current int
+}
+
+func newRunner(s *Story, logf func(format string, args ...interface{}), stop <-chan interface{}) *runner {
+	r := &runner{
+		story:    s,
+		id:       atomic.AddUint64(&runs, 1),
+		session:  s.session(),
+		logf:     logf,
+		stop:     stop,
+		timeline: newTimeline(s),
+	}
+	if s.Validate {
+		r.validator = &Validator{}
+	}
+	return r
+}
+
+// stepDone notifies the Reporter that step i is done
+func (r *runner) stepDone(i int, direction string, msg pgproto3.Message, payload string, err error) {
+	s := r.story
+	if s.Reporter == nil {
+		return
+	}
+	event := StepEvent{
+		Story:     s.Name,
+		Run:       r.id,
+		Step:      i,
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      messageTypeName(msg),
+		Payload:   payload,
+		Err:       err,
+	}
+	if i < len(s.Lines) {
+		event.Line = s.Lines[i]
+	}
+	s.Reporter.StepDone(event)
+}
+
+// ignores tells whether msg is filtered out or ignored by the rules of the story when it arrives during the current step
+func (r *runner) ignores(msg pgproto3.BackendMessage) bool {
+	return (r.story.Filter != nil && !r.story.Filter(msg)) || r.story.Ignore.Ignores(r.current, msg)
+}
+
+// accept validates and covers msg and keeps it as pending unless it is ignored, in which case it is only recorded for
+// the report. Notifications are kept in the inbox of the session instead, and every ParameterStatus updates
+// the parameters of the session.
+func (r *runner) accept(msg pgproto3.BackendMessage) error {
+	if r.validator != nil {
+		if err := r.validator.Received(msg); err != nil {
+			return err
+		}
+	}
+	if r.story.Coverage != nil {
+		r.story.Coverage.Received(msg)
+	}
+	if p, ok := msg.(*pgproto3.ParameterStatus); ok {
+		r.session.params.set(p.Name, p.Value)
+	}
+	if n, ok := msg.(*pgproto3.NotificationResponse); ok {
+		r.session.inbox.add(n, r.arrived)
+		return nil
+	}
+	if r.ignores(msg) {
+		actual := describeResponse(msg)
+		r.logf("<<== %s (ignored)\n", actual)
+		r.timeline.ignore(r.current, TokenBackendMessage+" "+actual)
+		return nil
+	}
+	if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		r.arrived++
+	}
+	r.pending = append(r.pending, msg)
+	return nil
+}
+
+// poll accepts all the messages that were already received
+func (r *runner) poll() error {
+	for {
+		msg, ok := r.session.poll()
+		if !ok {
+			return nil
+		}
+		if err := r.accept(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// expectNotification consumes a notification that n matches from the inbox, waiting for one to arrive
+func (r *runner) expectNotification(i int, n *Notification) error {
+	return r.await(i, n.Within, func() (bool, error) {
+		entry, ok := r.session.inbox.take(n)
+		if !ok {
+			return false, nil
+		}
+		actual := r.received(i, entry.msg)
+		err := checkOrder(n.Order, entry.ready, r.consumed)
+		r.stepDone(i, TokenBackendMessage, entry.msg, actual, err)
+		return true, err
+	})
+}
+
+// expectParameter waits until the backend reports the value of p, unless it is already the last reported
+// value. Unless the story ignores ParameterStatus, it is expected in order like any other response.
+func (r *runner) expectParameter(i int, p *Parameter) error {
+	expected := &pgproto3.ParameterStatus{Name: p.Name, Value: p.Value}
+	if !r.ignores(expected) {
+		return r.expect(i, p.Within, (&Response{expected}).Compare)
+	}
+	err := r.await(i, p.Within, func() (bool, error) {
+		if r.session.params.check(p.Name, p.Value) != nil {
+			return false, nil
+		}
+		status := r.session.params.status(p.Name)
+		r.stepDone(i, TokenBackendMessage, status, r.received(i, status), nil)
+		return true, nil
+	})
+	if _, reported := r.session.params.get(p.Name); reported && err != nil {
+		// record the last reported value as the actual outcome of the step
+		r.received(i, r.session.params.status(p.Name))
+	}
+	return err
+}
+
+// assertParameter checks the last reported value of a parameter with the messages that were already received
+func (r *runner) assertParameter(i int, a *ParameterAssertion) error {
+	if err := r.poll(); err != nil {
+		return err
+	}
+	status := r.session.params.status(a.Name)
+	err := r.session.params.check(a.Name, a.Value)
+	r.stepDone(i, TokenBackendMessage, status, r.received(i, status), err)
+	return err
+}
+
+// next returns the next pending message, waiting up to timeout for one to arrive. Zero timeout waits forever.
+func (r *runner) next(timeout time.Duration) (pgproto3.BackendMessage, error) {
+	deadline := time.Now().Add(timeout)
+	for len(r.pending) == 0 {
+		remaining := time.Duration(0)
+		if timeout > 0 {
+			if remaining = time.Until(deadline); remaining <= 0 {
+				return nil, &StepTimeoutError{timeout}
+			}
+		}
+		msg, err := r.session.next(remaining, r.stop)
+		if _, ok := err.(*StepTimeoutError); ok {
+			return nil, &StepTimeoutError{timeout}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.accept(msg); err != nil {
+			return nil, err
+		}
+	}
+	msg := r.pending[0]
+	r.pending = r.pending[1:]
+	switch m := msg.(type) {
+	case *pgproto3.RowDescription:
+		r.fields = m.Fields
+	case *pgproto3.ReadyForQuery:
+		r.consumed++
+		r.txStatus = m.TxStatus
+	}
+	return msg, nil
+}
+
+// received logs and records msg as the actual outcome of step i
+func (r *runner) received(i int, msg pgproto3.BackendMessage) string {
+	actual := describeResponse(msg)
+	r.logf("<<== %s\n", actual)
+	r.timeline.record(i, TokenBackendMessage+" "+actual)
+	return actual
+}
+
+// send sends msg as step i. Unless pipelined, it fails if there are unconsumed messages from the backend
+func (r *runner) send(i int, msg pgproto3.FrontendMessage, pipelined bool) error {
+	if !pipelined {
+		if err := r.poll(); err != nil {
+			return err
+		}
+		if len(r.pending) > 0 {
+			return fmt.Errorf("backend messages exist in buffer")
+		}
+	}
+	actual := describeCommand(msg)
+	r.logf("==>> %s\n", actual)
+	r.timeline.record(i, TokenFrontendMessage+" "+actual)
+	if r.validator != nil {
+		r.validator.Sent(msg)
+	}
+	if r.story.Coverage != nil {
+		r.story.Coverage.Sent(msg)
+	}
+	err := r.session.Frontend.Send(msg)
+	r.stepDone(i, TokenFrontendMessage, msg, actual, err)
+	return err
+}
+
+// expect receives the message of step i within the provided time and checks it with compare
+func (r *runner) expect(i int, within time.Duration, compare func(pgproto3.BackendMessage) error) error {
+	timeout := r.story.StepTimeout
+	if within > 0 {
+		timeout = within
+	}
+	msg, err := r.next(timeout)
+	if err != nil {
+		r.stepDone(i, TokenBackendMessage, nil, "", err)
+		return err
+	}
+	actual := r.received(i, msg)
+	err = compare(msg)
+	r.stepDone(i, TokenBackendMessage, msg, actual, err)
+	return err
+}
+
+// expectRows receives a DataRow for each of the rows of step i, in any order
+func (r *runner) expectRows(i int, set *RowSet) error {
+	remaining := append([]*Row(nil), set.Rows...)
+	var received []string
+	for len(remaining) > 0 {
+		msg, err := r.next(r.story.StepTimeout)
+		if err != nil {
+			r.stepDone(i, TokenBackendMessage, nil, strings.Join(received, ", "), err)
+			return err
+		}
+		actual := describeResponse(msg)
+		r.logf("<<== %s\n", actual)
+		received = append(received, actual)
+		r.timeline.record(i, TokenBackendMessage+" "+strings.Join(received, ", "))
+		matched := -1
+		for j, row := range remaining {
+			if row.Compare(msg, r.fields) == nil {
+				matched = j
+				break
+			}
+		}
+		if matched < 0 {
+			err := fmt.Errorf("%s does not match any of the %d remaining rows", actual, len(remaining))
+			r.stepDone(i, TokenBackendMessage, msg, strings.Join(received, ", "), err)
+			return err
+		}
+		remaining = append(remaining[:matched], remaining[matched+1:]...)
+	}
+	r.stepDone(i, TokenBackendMessage, &pgproto3.DataRow{}, strings.Join(received, ", "), nil)
+	return nil
+}
+
+// await accepts messages for step i until done returns true, waiting up to within for them to arrive.
+// Zero within means Story.StepTimeout. done is called after every message and reports the step itself.
+func (r *runner) await(i int, within time.Duration, done func() (bool, error)) error {
+	timeout := r.story.StepTimeout
+	if within > 0 {
+		timeout = within
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := r.poll(); err != nil {
+			return err
+		}
+		if ok, err := done(); ok {
+			return err
+		}
+		remaining := time.Duration(0)
+		if timeout > 0 {
+			if remaining = time.Until(deadline); remaining <= 0 {
+				err := &StepTimeoutError{timeout}
+				r.stepDone(i, TokenBackendMessage, nil, "", err)
+				return err
+			}
+		}
+		msg, err := r.session.next(remaining, r.stop)
+		if _, ok := err.(*StepTimeoutError); ok {
+			continue
+		}
+		if err != nil {
+			r.stepDone(i, TokenBackendMessage, nil, "", err)
+			return err
+		}
+		if err := r.accept(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *runner) silence(i int, silence *Silence) error {
+	msg, err := r.next(silence.Duration)
+	if _, ok := err.(*StepTimeoutError); ok {
+		r.stepDone(i, TokenBackendMessage, nil, "", nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	actual := r.received(i, msg)
+	err = fmt.Errorf("expected no response within %s", silence.Duration)
+	r.stepDone(i, TokenBackendMessage, msg, actual, err)
+	return err
+}
+
+func (r *runner) step(i int, step Step) error {
+	switch s := step.(type) {
+	case *Command:
+		return r.send(i, s.FrontendMessage, false)
+	case *Pipelined:
+		return r.send(i, s.FrontendMessage, true)
+	case *Response:
+		if n, ok := s.BackendMessage.(*pgproto3.NotificationResponse); ok {
+			return r.expectNotification(i, &Notification{Channel: n.Channel, Payload: n.Payload, AnyPayload: n.Channel == ""})
+		}
+		if p, ok := s.BackendMessage.(*pgproto3.ParameterStatus); ok && p.Name != "" {
+			return r.expectParameter(i, &Parameter{Name: p.Name, Value: p.Value})
+		}
+		return r.expect(i, 0, s.Compare)
+	case *Notification:
+		return r.expectNotification(i, s)
+	case *Parameter:
+		return r.expectParameter(i, s)
+	case *ParameterAssertion:
+		return r.assertParameter(i, s)
+	case *Expectation:
+		if n, ok := s.BackendMessage.(*pgproto3.NotificationResponse); ok && len(s.Matchers) == 0 {
+			return r.expectNotification(i, &Notification{Channel: n.Channel, Payload: n.Payload, AnyPayload: n.Channel == "", Within: s.Within})
+		}
+		if p, ok := s.BackendMessage.(*pgproto3.ParameterStatus); ok && p.Name != "" && len(s.Matchers) == 0 {
+			return r.expectParameter(i, &Parameter{Name: p.Name, Value: p.Value, Within: s.Within})
+		}
+		return r.expect(i, s.Within, s.Compare)
+	case *Row:
+		return r.expect(i, s.Within, func(msg pgproto3.BackendMessage) error {
+			return s.Compare(msg, r.fields)
+		})
+	case *RowSet:
+		return r.expectRows(i, s)
+	case *Silence:
+		return r.silence(i, s)
+	}
+	return fmt.Errorf("unknown step type: %T", step)
+}
+
+// checkFinalTxStatus returns an error if the last ReadyForQuery of the story did not report Story.FinalTxStatus
+func (r *runner) checkFinalTxStatus() error {
+	expected := r.story.FinalTxStatus
+	switch {
+	case expected == 0:
+		return nil
+	case r.consumed == 0:
+		return fmt.Errorf("expected final transaction status %c. no ready for query was received", expected)
+	case r.txStatus != expected:
+		return fmt.Errorf("expected final transaction status %c. got %c", expected, r.txStatus)
+	}
+	return nil
+}
+
+func (r *runner) run() (err error) {
+	s := r.story
+	r.session.inbox.restart()
+	if s.Reporter != nil {
+		s.Reporter.StoryStarted(r.id, s.Name)
+	}
+
+	for i, step := range s.Steps {
+		r.current = i
+		r.timeline.start(i)
+		started := time.Now()
+		err = r.step(i, step)
+		if r.observe != nil {
+			r.observe(i, time.Since(started), err)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		r.current = len(s.Steps)
+		r.timeline.start(len(s.Steps))
+		err = r.poll()
+		if err == nil && len(r.pending) > 0 {
+			err = fmt.Errorf("expected missing step for the unconsumed messages")
+		}
+		if err == nil {
+			err = r.checkFinalTxStatus()
+		}
+	}
+
+	if err != nil {
+		r.poll()
+		err = r.timeline.fail(err, r.pending)
+		r.pending = nil
+	}
+	if s.Reporter != nil {
+		s.Reporter.StoryEnded(r.id, s.Name, err)
+	}
+	return
+}
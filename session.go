@@ -0,0 +1,201 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"sync"
+	"time"
+)
+
+// copyBackendMessage returns a copy of msg that does not share memory with the frontend,
+// which reuses its messages on every call to Receive.
+func copyBackendMessage(msg pgproto3.BackendMessage) pgproto3.BackendMessage {
+	// NotificationResponse is encoded without the PID, so it can't be decoded back
+	if n, ok := msg.(*pgproto3.NotificationResponse); ok {
+		c := *n
+		return &c
+	}
+	raw := msg.Encode(nil)
+	c := newBackendMessage(raw[0])
+	if c == nil || c.Decode(raw[5:]) != nil {
+		return msg
+	}
+	return c
+}
+
+// Session owns a connection to the backend and the single goroutine that receives messages from it.
+// Stories that run on the same Session, one after the other or concurrently on different Sessions,
+// don't leak goroutines: the receiving goroutine exits once the connection is closed.
+type Session struct {
+	// Frontend communicates with the backend over the connection of the session
+	Frontend *pgproto3.Frontend
+
+	conn     io.Closer
+	messages chan pgproto3.BackendMessage
+	closed   chan struct{}
+	closer   sync.Once
+	done     chan struct{}
+	err      error
+	inbox    inbox
+	params   parameters
+}
+
+// Parameters returns the last value that the backend reported for every run-time parameter, as
+// received by the stories that ran on the session
+func (s *Session) Parameters() map[string]string {
+	return s.params.all()
+}
+
+// Notifications removes and returns the notifications that arrived during the stories that ran on
+// the session and were not consumed by any of their steps
+func (s *Session) Notifications() []*pgproto3.NotificationResponse {
+	return s.inbox.drain()
+}
+
+// NewSession starts receiving messages from the backend on the other side of conn
+func NewSession(conn io.ReadWriteCloser) (*Session, error) {
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	if err != nil {
+		return nil, err
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	return newSession(frontend, conn), nil
+}
+
+// newSession starts receiving the messages of frontend and registers the session, so sessionOf
+// returns it. The caller must hold the lock of sessions.
+func newSession(frontend *pgproto3.Frontend, conn io.Closer) *Session {
+	s := &Session{
+		Frontend: frontend,
+		conn:     conn,
+		messages: make(chan pgproto3.BackendMessage, 100),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	sessions.m[frontend] = s
+	go s.receive()
+	go func() {
+		<-s.done
+		sessions.Lock()
+		delete(sessions.m, frontend)
+		sessions.Unlock()
+	}()
+	return s
+}
+
+func (s *Session) receive() {
+	defer close(s.done)
+	for {
+		msg, err := s.Frontend.Receive()
+		if err != nil {
+			s.err = err
+			return
+		}
+		select {
+		case s.messages <- copyBackendMessage(msg):
+		case <-s.closed:
+			s.err = io.ErrClosedPipe
+			return
+		}
+	}
+}
+
+// Close closes the connection and waits for the receiving goroutine to exit. Sessions that were
+// created for a Story with only a Frontend have no connection to close, and their receiving goroutine
+// exits once the connection is closed by its owner.
+func (s *Session) Close() error {
+	var err error
+	s.closer.Do(func() {
+		close(s.closed)
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+	})
+	if s.conn != nil {
+		<-s.done
+	}
+	return err
+}
+
+// sessions holds the Session of every Frontend, so a single goroutine receives its messages no matter
+// how many stories run on it
+var sessions = struct {
+	sync.Mutex
+	m map[*pgproto3.Frontend]*Session
+}{m: make(map[*pgproto3.Frontend]*Session)}
+
+// sessionOf returns the Session that receives the messages of frontend
+func sessionOf(frontend *pgproto3.Frontend) *Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if s, ok := sessions.m[frontend]; ok {
+		return s
+	}
+	return newSession(frontend, nil)
+}
+
+// poll returns the next message if one was already received
+func (s *Session) poll() (pgproto3.BackendMessage, bool) {
+	select {
+	case msg := <-s.messages:
+		return msg, true
+	default:
+		return nil, false
+	}
+}
+
+// next returns the next message from the backend. It returns StepTimeoutError if timeout is not
+// zero and no message arrives in time, and StopSignalError if a value is received from stop.
+func (s *Session) next(timeout time.Duration, stop <-chan interface{}) (pgproto3.BackendMessage, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.done:
+		// deliver the messages that were received before the error
+		if msg, ok := s.poll(); ok {
+			return msg, nil
+		}
+		return nil, s.err
+	case <-expired:
+		return nil, &StepTimeoutError{timeout}
+	case v := <-stop:
+		return nil, &StopSignalError{v}
+	}
+}
+
+// untilReady returns the messages received up to and including ReadyForQuery, or up to the error that
+// makes the backend discard the awaited Query, except for the ones that are rejected by filter. state
+// follows the messages that were sent. It returns HangError if ReadyForQuery does not arrive within timeout.
+func (s *Session) untilReady(timeout time.Duration, filter func(pgproto3.BackendMessage) bool, state *syncState) ([]pgproto3.BackendMessage, error) {
+	var messages []pgproto3.BackendMessage
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if timeout > 0 && remaining <= 0 {
+			return messages, &HangError{timeout}
+		}
+		if timeout <= 0 {
+			remaining = 0
+		}
+		msg, err := s.next(remaining, nil)
+		if _, ok := err.(*StepTimeoutError); ok {
+			return messages, &HangError{timeout}
+		}
+		if err != nil {
+			return messages, err
+		}
+		if filter == nil || filter(msg) {
+			messages = append(messages, msg)
+		}
+		if state.received(msg) {
+			return messages, nil
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+
+	t.Run("test close stops receiving", func(t *testing.T) {
+		frontendConn, backendConn := net.Pipe()
+		defer backendConn.Close()
+		session, err := NewSession(frontendConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan error, 1)
+		go func() {
+			closed <- session.Close()
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("expected Close to return once the receiving goroutine exits")
+		}
+		if _, err := session.next(time.Second, nil); err == nil {
+			t.Fatal("expected an error from a closed session")
+		}
+	})
+
+	t.Run("test close after a story", func(t *testing.T) {
+		story, err := initStory(append(startupSeq(),
+			&Command{&pgproto3.Query{String: SimpleQuery}},
+			&Response{&pgproto3.RowDescription{}},
+			&Response{&pgproto3.DataRow{}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		story.StepTimeout = time.Second
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+		go story.Session.Close()
+		select {
+		case <-story.Session.done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the receiving goroutine to exit once the session is closed")
+		}
+	})
+
+	t.Run("test stories share a session", func(t *testing.T) {
+		frontend := pipeFrontend(t, answerQueries(&pgproto3.ReadyForQuery{TxStatus: 'I'}))
+		steps := []Step{
+			&Command{&pgproto3.Query{String: SimpleQuery}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		}
+		first := &Story{Frontend: frontend, Steps: steps, StepTimeout: time.Second}
+		second := &Story{Session: sessionOf(frontend), Steps: steps, StepTimeout: time.Second}
+		if first.session() != second.session() {
+			t.Fatal("expected both stories to use the same session")
+		}
+		for _, story := range []*Story{first, second} {
+			if err := story.Run(t, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+}
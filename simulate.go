@@ -0,0 +1,466 @@
+package pg_stories
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"strings"
+)
+
+const (
+	// TokenSimulate is the directive that fills in the responses of a story that follow from its commands
+	TokenSimulate = "@simulate"
+)
+
+// SimulationError is returned by the Builder when the responses of a story with the simulate directive
+// differ from the responses that its commands lead to
+type SimulationError struct {
+	issues []LintIssue
+}
+
+func (e *SimulationError) Error() string {
+	msgs := make([]string, 0, len(e.issues))
+	for _, issue := range e.issues {
+		msgs = append(msgs, issue.String())
+	}
+	return "simulation failed: " + strings.Join(msgs, "; ")
+}
+
+// simSlot is a response that the simulator expects for a command. A slot either holds a response that
+// the command determines, or it is open for the responses that the story defines, e.g. the rows of Execute
+type simSlot struct {
+	// response is the determined response, nil for an open slot
+	response pgproto3.BackendMessage
+	// any tells whether an open slot accepts every type of response but ReadyForQuery
+	any bool
+	// accepts are the types of the responses that an open slot accepts, and ends are those that close it
+	accepts, ends string
+	// step is the index of the command that the slot is the response to
+	step int
+	// block tells whether a ReadyForQuery slot is sent in a transaction block
+	block bool
+	// undo reverts the changes of the command to the state of the backend, when it is skipped after an error
+	undo func()
+}
+
+// simulator models the state of the backend that the commands of a story lead to, and merges the
+// responses that they determine with the responses of the story
+type simulator struct {
+	story *Story
+	steps []Step
+	lines []int
+	// index holds the index in steps of every step of the story
+	index []int
+	// conflicts are the responses of the story that differ from the simulation, and missing are the
+	// determined responses that the story does not define
+	conflicts, missing []LintIssue
+	// queue holds the responses that the backend is expected to send next
+	queue []*simSlot
+	// statements holds the prepared statements by their name, and portals holds the queries of the
+	// open portals by their name
+	statements map[string]*pgproto3.Parse
+	portals    map[string]string
+	// status is the transaction status of the backend
+	status byte
+	// failed tells whether an error discards the messages until the next Sync
+	failed bool
+}
+
+// Simulate walks the commands of story and models the prepared statements and portals that they create,
+// the transaction status and the messages that are discarded after an error until Sync. It returns a copy of
+// story where the responses that follow from the commands are filled in (ParseComplete, BindComplete,
+// CloseComplete, ReadyForQuery and the errors of unknown statements and portals), so a story only needs to
+// define the responses that depend on data, such as rows and command tags. It also returns the responses
+// of story that differ from the simulation.
+//
+// Responses that the story defines for Execute, Describe and Query are assigned to them in order. The
+// story is expected to define the responses of a batch of commands before it sends the next batch.
+func Simulate(story *Story) (*Story, []LintIssue) {
+	sim := newSimulator(story)
+	simulated := *story
+	simulated.Steps, simulated.Lines = sim.steps, sim.lines
+	simulated.Ignore = make(IgnoreRules, 0, len(story.Ignore))
+	for _, rule := range story.Ignore {
+		if rule.From > 0 {
+			rule.From = sim.index[rule.From]
+		}
+		simulated.Ignore = append(simulated.Ignore, rule)
+	}
+	return &simulated, sim.conflicts
+}
+
+// CheckResponses returns the responses of story that differ from the simulation of its commands and the
+// determined responses that it does not define. See Simulate
+func CheckResponses(story *Story) []LintIssue {
+	sim := newSimulator(story)
+	return append(sim.conflicts, sim.missing...)
+}
+
+func newSimulator(story *Story) *simulator {
+	sim := &simulator{
+		story:      story,
+		statements: make(map[string]*pgproto3.Parse),
+		portals:    make(map[string]string),
+		status:     TxStatusIdle,
+	}
+	// responded tells whether a response of the story followed the last command
+	responded := false
+	for i, step := range story.Steps {
+		cmd, ok := commandOf(step)
+		if ok && responded {
+			sim.flush()
+			responded = false
+		}
+		sim.index = append(sim.index, len(sim.steps))
+		if ok {
+			sim.emit(step, i)
+			sim.command(cmd.FrontendMessage, i)
+			continue
+		}
+		if typ, ok := responseTypeOf(step); ok {
+			sim.respond(step, typ, i)
+			responded = true
+			continue
+		}
+		sim.emit(step, i)
+	}
+	sim.flush()
+	sim.index = append(sim.index, len(sim.steps))
+	return sim
+}
+
+// responseTypeOf returns the type of the response that step expects, if it is a response to a command.
+// Notifications, parameter statuses and notices can be sent at any time, so they are not
+func responseTypeOf(step Step) (byte, bool) {
+	switch step.(type) {
+	case *Row, *RowSet:
+		return 'D', true
+	}
+	res, ok := responseOf(step)
+	if !ok {
+		return 0, false
+	}
+	typ := backendType(res.BackendMessage)
+	return typ, !strings.ContainsRune("ANS", rune(typ))
+}
+
+// backendType returns the type byte of msg
+func backendType(msg pgproto3.BackendMessage) byte {
+	if raw := msg.Encode(nil); len(raw) > 0 {
+		return raw[0]
+	}
+	return 0
+}
+
+// line returns the line that defines step i of the story
+func (sim *simulator) line(i int) int {
+	if i < len(sim.story.Lines) {
+		return sim.story.Lines[i]
+	}
+	return 0
+}
+
+// emit appends step i of the story to the simulated steps
+func (sim *simulator) emit(step Step, i int) {
+	sim.steps = append(sim.steps, step)
+	sim.lines = append(sim.lines, sim.line(i))
+}
+
+// issue returns an issue at step i of the story
+func (sim *simulator) issue(i int, format string, args ...interface{}) LintIssue {
+	return LintIssue{Step: i, Line: sim.line(i), Message: fmt.Sprintf(format, args...)}
+}
+
+// fill appends the determined response of slot to the simulated steps
+func (sim *simulator) fill(slot *simSlot) {
+	sim.steps = append(sim.steps, &Response{BackendMessage: slot.response})
+	sim.lines = append(sim.lines, sim.line(slot.step))
+	cmd, _ := commandOf(sim.story.Steps[slot.step])
+	sim.missing = append(sim.missing, sim.issue(slot.step, "%s is not followed by %s",
+		messageTypeName(cmd.FrontendMessage), messageTypeName(slot.response)))
+}
+
+// flush fills in the determined responses that are left in the queue
+func (sim *simulator) flush() {
+	for _, slot := range sim.queue {
+		if slot.response != nil {
+			sim.fill(slot)
+		}
+	}
+	sim.queue = nil
+}
+
+// push adds a slot for the command at step i to the queue
+func (sim *simulator) push(slot *simSlot, i int) {
+	slot.step = i
+	sim.queue = append(sim.queue, slot)
+}
+
+// fail adds an error with code for the command at step i and discards the messages until Sync
+func (sim *simulator) fail(code string, i int) {
+	sim.push(&simSlot{response: &pgproto3.ErrorResponse{Code: code}}, i)
+	sim.failed = true
+	if sim.status == TxStatusInTransaction {
+		sim.status = TxStatusFailed
+	}
+}
+
+// ready adds the ReadyForQuery that ends the batch of the command at step i
+func (sim *simulator) ready(i int) {
+	sim.push(&simSlot{
+		response: &pgproto3.ReadyForQuery{TxStatus: sim.status},
+		block:    sim.status != TxStatusIdle,
+	}, i)
+}
+
+// transaction updates the transaction status with the SQL commands of query, and tells whether it is
+// allowed in a failed transaction block
+func (sim *simulator) transaction(query string) bool {
+	allowed := true
+	for _, sql := range strings.Split(query, ";") {
+		sql = strings.Trim(sql, WhiteSpaceChars+"\r\n")
+		switch {
+		case sql == "":
+		case endSQLPattern.MatchString(sql):
+			sim.status = TxStatusIdle
+		case sim.status == TxStatusFailed:
+			allowed = false
+		case beginSQLPattern.MatchString(sql):
+			sim.status = TxStatusInTransaction
+		}
+	}
+	return allowed
+}
+
+// allowed tells whether query can be prepared and bound in the current transaction status. A failed
+// transaction block only allows to end it
+func (sim *simulator) allowed(query string) bool {
+	return sim.status != TxStatusFailed || endSQLPattern.MatchString(strings.TrimSpace(query))
+}
+
+// command adds the responses of msg that is sent at step i to the queue
+func (sim *simulator) command(msg pgproto3.FrontendMessage, i int) {
+	if _, ok := msg.(*pgproto3.Sync); !ok && sim.failed {
+		return
+	}
+	switch m := msg.(type) {
+	case *pgproto3.StartupMessage:
+		sim.push(&simSlot{any: true}, i)
+		sim.ready(i)
+	case *pgproto3.Query:
+		delete(sim.statements, "")
+		delete(sim.portals, "")
+		if !sim.transaction(m.String) {
+			sim.push(&simSlot{response: &pgproto3.ErrorResponse{Code: "25P02"}}, i)
+		} else {
+			sim.push(&simSlot{any: true}, i)
+		}
+		sim.ready(i)
+	case *pgproto3.Parse:
+		prev, exists := sim.statements[m.Name]
+		if exists && m.Name != "" {
+			sim.fail("42P05", i)
+			return
+		}
+		if !sim.allowed(m.Query) {
+			sim.fail("25P02", i)
+			return
+		}
+		sim.statements[m.Name] = m
+		sim.push(&simSlot{response: &pgproto3.ParseComplete{}, undo: func() {
+			if exists {
+				sim.statements[m.Name] = prev
+			} else {
+				delete(sim.statements, m.Name)
+			}
+		}}, i)
+	case *pgproto3.Bind:
+		stmt, ok := sim.statements[m.PreparedStatement]
+		if !ok {
+			sim.fail("26000", i)
+			return
+		}
+		if len(m.Parameters) != parameterCount(stmt) {
+			sim.fail("08P01", i)
+			return
+		}
+		prev, exists := sim.portals[m.DestinationPortal]
+		if exists && m.DestinationPortal != "" {
+			sim.fail("42P03", i)
+			return
+		}
+		if !sim.allowed(stmt.Query) {
+			sim.fail("25P02", i)
+			return
+		}
+		sim.portals[m.DestinationPortal] = stmt.Query
+		sim.push(&simSlot{response: &pgproto3.BindComplete{}, undo: func() {
+			if exists {
+				sim.portals[m.DestinationPortal] = prev
+			} else {
+				delete(sim.portals, m.DestinationPortal)
+			}
+		}}, i)
+	case *pgproto3.Describe:
+		if m.ObjectType == 'S' {
+			if _, ok := sim.statements[m.Name]; !ok {
+				sim.fail("26000", i)
+				return
+			}
+			sim.push(&simSlot{accepts: "t", ends: "Tn"}, i)
+			return
+		}
+		if _, ok := sim.portals[m.Name]; !ok {
+			sim.fail("34000", i)
+			return
+		}
+		sim.push(&simSlot{ends: "Tn"}, i)
+	case *pgproto3.Execute:
+		query, ok := sim.portals[m.Portal]
+		if !ok {
+			sim.fail("34000", i)
+			return
+		}
+		if !sim.transaction(query) {
+			sim.fail("25P02", i)
+			return
+		}
+		sim.push(&simSlot{accepts: "DdGHW", ends: "CsI"}, i)
+	case *pgproto3.Close:
+		undo := func() {}
+		if m.ObjectType == 'S' {
+			if prev, ok := sim.statements[m.Name]; ok {
+				delete(sim.statements, m.Name)
+				undo = func() { sim.statements[m.Name] = prev }
+			}
+		} else if prev, ok := sim.portals[m.Name]; ok {
+			delete(sim.portals, m.Name)
+			undo = func() { sim.portals[m.Name] = prev }
+		}
+		sim.push(&simSlot{response: &pgproto3.CloseComplete{}, undo: undo}, i)
+	case *pgproto3.Sync:
+		sim.failed = false
+		if sim.status == TxStatusIdle {
+			// the implicit transaction of the batch ends, and so do its portals
+			sim.portals = make(map[string]string)
+		}
+		sim.ready(i)
+	}
+}
+
+// respond assigns the response at step i of the story, whose type is typ, to the slots in the queue.
+// The determined responses that precede it are filled in
+func (sim *simulator) respond(step Step, typ byte, i int) {
+	for len(sim.queue) > 0 {
+		if typ == 'E' {
+			if n := sim.skip(errorResponseOf(responseMessageOf(step)).Code); n > 0 {
+				for _, slot := range sim.queue[:n] {
+					if slot.response != nil {
+						sim.fill(slot)
+					}
+				}
+				sim.queue = sim.queue[n:]
+				continue
+			}
+		}
+		slot := sim.queue[0]
+		if slot.response != nil && backendType(slot.response) == typ {
+			sim.compare(slot, step, i)
+			sim.emit(step, i)
+			sim.queue = sim.queue[1:]
+			return
+		}
+		if typ == 'E' {
+			sim.emit(step, i)
+			sim.abort()
+			return
+		}
+		if slot.response != nil {
+			sim.fill(slot)
+			sim.queue = sim.queue[1:]
+			continue
+		}
+		if slot.any && typ != 'Z' || strings.IndexByte(slot.accepts, typ) >= 0 {
+			sim.emit(step, i)
+			return
+		}
+		sim.queue = sim.queue[1:]
+		if strings.IndexByte(slot.ends, typ) >= 0 {
+			sim.emit(step, i)
+			return
+		}
+	}
+	sim.emit(step, i)
+	if strings.IndexByte("123Z", typ) >= 0 {
+		sim.conflicts = append(sim.conflicts, sim.issue(i, "unexpected %s", messageTypeName(responseMessageOf(step))))
+	}
+}
+
+// responseMessageOf returns the message of a response step
+func responseMessageOf(step Step) pgproto3.BackendMessage {
+	if res, ok := responseOf(step); ok {
+		return res.BackendMessage
+	}
+	return &pgproto3.DataRow{}
+}
+
+// skip returns the number of slots to fill in before an error with code is received, when the batch at
+// the front of the queue already fails with a determined error. The error is that determined error if
+// code matches it, and otherwise it is in one of the following batches
+func (sim *simulator) skip(code string) int {
+	for i, slot := range sim.queue {
+		switch m := slot.response.(type) {
+		case *pgproto3.ReadyForQuery:
+			return 0
+		case *pgproto3.ErrorResponse:
+			if code == "" || code == m.Code {
+				return i
+			}
+			for j, next := range sim.queue[i:] {
+				if _, ok := next.response.(*pgproto3.ReadyForQuery); ok && i+j+1 < len(sim.queue) {
+					return i + j + 1
+				}
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// abort discards the slots of the commands after an error until the ReadyForQuery that ends the batch,
+// and reverts their changes
+func (sim *simulator) abort() {
+	for len(sim.queue) > 0 {
+		slot := sim.queue[0]
+		if ready, ok := slot.response.(*pgproto3.ReadyForQuery); ok {
+			if slot.block {
+				ready.TxStatus = TxStatusFailed
+				sim.status = TxStatusFailed
+			}
+			return
+		}
+		if slot.undo != nil {
+			slot.undo()
+		}
+		sim.queue = sim.queue[1:]
+	}
+	// the batch is not synced yet, so the commands that follow are discarded as well
+	sim.failed = true
+}
+
+// compare adds a conflict if the response at step i of the story differs from the determined response of slot
+func (sim *simulator) compare(slot *simSlot, step Step, i int) {
+	switch expected := slot.response.(type) {
+	case *pgproto3.ReadyForQuery:
+		actual := responseMessageOf(step).(*pgproto3.ReadyForQuery)
+		if actual.TxStatus != 0 && actual.TxStatus != expected.TxStatus {
+			sim.conflicts = append(sim.conflicts, sim.issue(i, "expected ready for query with transaction status %c. got %c",
+				expected.TxStatus, actual.TxStatus))
+		}
+	case *pgproto3.ErrorResponse:
+		actual := errorResponseOf(responseMessageOf(step))
+		if actual.Code != "" && actual.Code != expected.Code {
+			sim.conflicts = append(sim.conflicts, sim.issue(i, "expected error response with code %s. got %s",
+				expected.Code, actual.Code))
+		}
+	}
+}
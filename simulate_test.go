@@ -0,0 +1,236 @@
+package pg_stories
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	format := func(t *testing.T, steps []Step) string {
+		lines := make([]string, 0, len(steps))
+		for _, step := range steps {
+			line, err := FormatStep(step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	t.Run("test fill in responses", func(t *testing.T) {
+		story, _, err := createBuilder(t.Name(),
+			TokenSimulate,
+			`-> P "stmt" "SELECT $1" []`,
+			`-> B "" "stmt" ["1"]`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- D ["1"]`,
+			`<- C "SELECT 1"`,
+			`@ignore N`,
+			`-> B "" "baa" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`-> Q "BEGIN"`,
+			`<- C "BEGIN"`,
+			`-> Q "SELECT 1/0"`,
+			`<- E "22012"`,
+			`-> Q "ROLLBACK"`,
+			`<- C "ROLLBACK"`,
+		).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join([]string{
+			`-> P "stmt" "SELECT $1" []`,
+			`-> B "" "stmt" ["1"]`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- 1`,
+			`<- 2`,
+			`<- D ["1"]`,
+			`<- C "SELECT 1"`,
+			`<- Z I`,
+			`-> B "" "baa" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`-> Q "BEGIN"`,
+			`<- E "26000"`,
+			`<- Z I`,
+			`<- C "BEGIN"`,
+			`<- Z T`,
+			`-> Q "SELECT 1/0"`,
+			`<- E "22012"`,
+			`<- Z E`,
+			`-> Q "ROLLBACK"`,
+			`<- C "ROLLBACK"`,
+			`<- Z I`,
+		}, "\n")
+		if actual := format(t, story.Steps); actual != expected {
+			t.Fatalf("expected steps:\n%s\nactual:\n%s", expected, actual)
+		}
+		if len(story.Lines) != len(story.Steps) || story.Lines[4] != 3 || story.Lines[8] != 6 {
+			t.Fatalf("expected the filled in responses to be at the lines of their commands. got %v", story.Lines)
+		}
+		if len(story.Ignore) != 1 || story.Ignore[0].From != 9 {
+			t.Fatalf("expected the ignore rule to move with its step. got %v", story.Ignore)
+		}
+	})
+
+	t.Run("test errors discard messages until sync", func(t *testing.T) {
+		story, issues := Simulate(&Story{Steps: []Step{
+			parseStep(t, `-> P "" "SELECT 1/0" []`),
+			parseStep(t, `-> B "" "" []`),
+			parseStep(t, `-> E "" 0`),
+			parseStep(t, `-> P "stmt" "SELECT 1" []`),
+			parseStep(t, `-> S`),
+			parseStep(t, `<- 1`),
+			parseStep(t, `<- 2`),
+			parseStep(t, `<- E {code=22012}`),
+			parseStep(t, `-> B "" "stmt" []`),
+			parseStep(t, `-> S`),
+		}})
+		if len(issues) > 0 {
+			t.Fatalf("expected no issues. got %v", issues)
+		}
+		expected := strings.Join([]string{
+			`-> P "" "SELECT 1/0" []`,
+			`-> B "" "" []`,
+			`-> E "" 0`,
+			`-> P "stmt" "SELECT 1" []`,
+			`-> S`,
+			`<- 1`,
+			`<- 2`,
+			`<- E "22012"`,
+			`<- Z I`,
+			`-> B "" "stmt" []`,
+			`-> S`,
+			`<- E "26000"`,
+			`<- Z I`,
+		}, "\n")
+		if actual := format(t, story.Steps); actual != expected {
+			t.Fatalf("expected steps:\n%s\nactual:\n%s", expected, actual)
+		}
+	})
+
+	t.Run("test failed transaction block", func(t *testing.T) {
+		story, issues := Simulate(&Story{Steps: []Step{
+			parseStep(t, `-> Q "BEGIN"`),
+			parseStep(t, `<- C "BEGIN"`),
+			parseStep(t, `-> P "stmt" "SELECT 1" []`),
+			parseStep(t, `-> S`),
+			parseStep(t, `<- Z`),
+			parseStep(t, `-> Q "SELECT 1/0"`),
+			parseStep(t, `<- E "22012"`),
+			parseStep(t, `-> P "" "SELECT 1" []`),
+			parseStep(t, `-> S`),
+			parseStep(t, `<- Z`),
+			parseStep(t, `-> B "" "stmt" []`),
+			parseStep(t, `-> E "" 0`),
+			parseStep(t, `-> S`),
+			parseStep(t, `<- Z`),
+			parseStep(t, `-> Q "ROLLBACK"`),
+			parseStep(t, `<- C "ROLLBACK"`),
+		}})
+		if len(issues) > 0 {
+			t.Fatalf("expected no issues. got %v", issues)
+		}
+		expected := strings.Join([]string{
+			`-> Q "BEGIN"`,
+			`<- C "BEGIN"`,
+			`<- Z T`,
+			`-> P "stmt" "SELECT 1" []`,
+			`-> S`,
+			`<- 1`,
+			`<- Z`,
+			`-> Q "SELECT 1/0"`,
+			`<- E "22012"`,
+			`<- Z E`,
+			`-> P "" "SELECT 1" []`,
+			`-> S`,
+			`<- E "25P02"`,
+			`<- Z`,
+			`-> B "" "stmt" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`<- E "25P02"`,
+			`<- Z`,
+			`-> Q "ROLLBACK"`,
+			`<- C "ROLLBACK"`,
+			`<- Z I`,
+		}, "\n")
+		if actual := format(t, story.Steps); actual != expected {
+			t.Fatalf("expected steps:\n%s\nactual:\n%s", expected, actual)
+		}
+	})
+
+	t.Run("test error of a later batch", func(t *testing.T) {
+		story, issues := Simulate(&Story{Steps: []Step{
+			parseStep(t, `-> B "" "baa" []`),
+			parseStep(t, `-> E "" 0`),
+			parseStep(t, `-> S`),
+			parseStep(t, `-> Q "SELECT 1/0"`),
+			parseStep(t, `<- E "22012"`),
+		}})
+		if len(issues) > 0 {
+			t.Fatalf("expected no issues. got %v", issues)
+		}
+		expected := strings.Join([]string{
+			`-> B "" "baa" []`,
+			`-> E "" 0`,
+			`-> S`,
+			`-> Q "SELECT 1/0"`,
+			`<- E "26000"`,
+			`<- Z I`,
+			`<- E "22012"`,
+			`<- Z I`,
+		}, "\n")
+		if actual := format(t, story.Steps); actual != expected {
+			t.Fatalf("expected steps:\n%s\nactual:\n%s", expected, actual)
+		}
+	})
+
+	t.Run("test check responses", func(t *testing.T) {
+		story, _, err := createBuilder(t.Name(),
+			`-> Q "SELECT 1"`,
+			`<- D ["1"]`,
+			`<- C`,
+			`<- Z T`,
+			`-> P "" "SELECT 1" []`,
+			`-> B "" "" []`,
+			`-> S`,
+			`<- 1`,
+			`<- Z`,
+			`<- 3`,
+		).ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var issues []string
+		for _, issue := range CheckResponses(story) {
+			issues = append(issues, issue.String())
+		}
+		expected := []string{
+			`line #5: expected ready for query with transaction status I. got T`,
+			`line #11: unexpected CloseComplete`,
+			`line #7: Bind is not followed by BindComplete`,
+		}
+		if strings.Join(issues, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("expected issues:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(issues, "\n"))
+		}
+
+		_, _, err = createBuilder(t.Name(), TokenSimulate, `-> Q "SELECT 1"`, `<- C`, `<- Z T`).ParseNext()
+		if _, ok := err.(*SimulationError); !ok {
+			t.Fatalf("expected a simulation error. got %v", err)
+		}
+	})
+}
+
+// parseStep parses a step of a transcript
+func parseStep(t *testing.T, line string) Step {
+	step, err := (&Builder{}).parseStep(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return step
+}
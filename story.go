@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 	"testing"
+	"time"
 )
 
 // Step is the interface of every step in a Story
@@ -27,8 +28,80 @@ type Response struct {
 // Step is here just to identify Command as a Step implementation
 func (r *Response) Step() {}
 
+// Expectation is a type of Step that wraps a Response with constraints on its arrival
+type Expectation struct {
+	*Response
+	// Within is the maximum time to wait for the response. Zero means Story.StepTimeout
+	Within time.Duration
+	// Matchers check the received message after it is compared with the Response
+	Matchers []Matcher
+}
+
+// Compare compares msg with the underlying Response and then checks it with every Matcher
+func (e *Expectation) Compare(msg pgproto3.BackendMessage) error {
+	if err := e.Response.Compare(msg); err != nil {
+		return err
+	}
+	for _, m := range e.Matchers {
+		if err := m.Match(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pipelined is a type of Step that sends its Command without checking for unconsumed responses,
+// so several batches of commands can be sent back to back before their results are read
+type Pipelined struct {
+	*Command
+}
+
+// commandOf returns the Command that step sends, if any
+func commandOf(step Step) (*Command, bool) {
+	switch s := step.(type) {
+	case *Command:
+		return s, true
+	case *Pipelined:
+		return s.Command, true
+	}
+	return nil, false
+}
+
+// Silence is a type of Step that asserts that no response arrives for Duration, which must be positive
+type Silence struct {
+	Duration time.Duration
+}
+
+// Step is here just to identify Silence as a Step implementation
+func (s *Silence) Step() {}
+
+// Transaction statuses that are reported by ReadyForQuery
+const (
+	TxStatusIdle          = 'I'
+	TxStatusInTransaction = 'T'
+	TxStatusFailed        = 'E'
+)
+
+// StopSignalError is returned when a story is stopped by a kill signal
+type StopSignalError struct {
+	signal interface{}
+}
+
+func (e *StopSignalError) Error() string {
+	return fmt.Sprintf("received stop signal %#v", e.signal)
+}
+
+// StepTimeoutError is returned when an expected response does not arrive in time
+type StepTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *StepTimeoutError) Error() string {
+	return fmt.Sprintf("no response within %s", e.timeout)
+}
+
 // Compare checks if the value of the provided msg equals to the underlying BackendMessage.
-// In some cases it performs deep compare.
+// In some cases it performs deep compare of the fields that are set in the underlying BackendMessage.
 func (r *Response) Compare(msg pgproto3.BackendMessage) error {
 	expectedRaw := r.BackendMessage.Encode([]byte{})
 	actualRaw := msg.Encode([]byte{})
@@ -44,87 +117,133 @@ func (r *Response) Compare(msg pgproto3.BackendMessage) error {
 
 	switch r.BackendMessage.(type) {
 	case *pgproto3.ErrorResponse:
-		expectedCode := r.BackendMessage.(*pgproto3.ErrorResponse).Code
-		actualCode := msg.(*pgproto3.ErrorResponse).Code
-		if expectedCode != "" && expectedCode != actualCode {
-			return fmt.Errorf("expected error response with code: %s. got %s", expectedCode, actualCode)
+		return compareErrorFields("error response", errorResponseOf(r.BackendMessage), errorResponseOf(msg))
+	case *pgproto3.NoticeResponse:
+		return compareErrorFields("notice response", errorResponseOf(r.BackendMessage), errorResponseOf(msg))
+	case *pgproto3.CommandComplete:
+		expected := r.BackendMessage.(*pgproto3.CommandComplete).CommandTag
+		actual := msg.(*pgproto3.CommandComplete).CommandTag
+		if expected != "" && expected != actual {
+			return fmt.Errorf("expected command complete with tag: %s. got %s", expected, actual)
+		}
+	case *pgproto3.DataRow:
+		expected := r.BackendMessage.(*pgproto3.DataRow).Values
+		actual := msg.(*pgproto3.DataRow).Values
+		if expected != nil && !equalValues(expected, actual) {
+			return fmt.Errorf("expected data row with values: %q. got %q", expected, actual)
+		}
+	case *pgproto3.RowDescription:
+		return compareFields(r.BackendMessage.(*pgproto3.RowDescription).Fields, msg.(*pgproto3.RowDescription).Fields)
+	case *pgproto3.ParameterDescription:
+		expected := r.BackendMessage.(*pgproto3.ParameterDescription).ParameterOIDs
+		actual := msg.(*pgproto3.ParameterDescription).ParameterOIDs
+		if expected != nil && fmt.Sprint(expected) != fmt.Sprint(actual) {
+			return fmt.Errorf("expected parameter description with OIDs: %v. got %v", expected, actual)
+		}
+	case *pgproto3.ParameterStatus:
+		expected := r.BackendMessage.(*pgproto3.ParameterStatus)
+		actual := msg.(*pgproto3.ParameterStatus)
+		if expected.Name != "" && (expected.Name != actual.Name || expected.Value != actual.Value) {
+			return fmt.Errorf("expected parameter status %s=%s. got %s=%s", expected.Name, expected.Value, actual.Name, actual.Value)
+		}
+	case *pgproto3.ReadyForQuery:
+		expected := r.BackendMessage.(*pgproto3.ReadyForQuery).TxStatus
+		actual := msg.(*pgproto3.ReadyForQuery).TxStatus
+		if expected != 0 && expected != actual {
+			return fmt.Errorf("expected ready for query with transaction status %c. got %c", expected, actual)
+		}
+	case *pgproto3.NotificationResponse:
+		expected := r.BackendMessage.(*pgproto3.NotificationResponse)
+		actual := msg.(*pgproto3.NotificationResponse)
+		if expected.Channel != "" && (expected.Channel != actual.Channel || expected.Payload != actual.Payload) {
+			return fmt.Errorf("expected notification %s: %s. got %s: %s", expected.Channel, expected.Payload, actual.Channel, actual.Payload)
 		}
 	}
 
 	return nil
 }
 
+// equalValues compares values of data rows, where a nil value is NULL
+func equalValues(expected, actual [][]byte) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if (expected[i] == nil) != (actual[i] == nil) || string(expected[i]) != string(actual[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareFields compares the fields of row descriptions. Type OIDs and formats are
+// compared only when they are specified.
+func compareFields(expected, actual []pgproto3.FieldDescription) error {
+	if expected == nil {
+		return nil
+	}
+	if len(expected) != len(actual) {
+		return fmt.Errorf("expected row description with %d fields. got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i].Name != actual[i].Name {
+			return fmt.Errorf("expected field #%d to be named %s. got %s", i, expected[i].Name, actual[i].Name)
+		}
+		if expected[i].DataTypeOID != 0 && expected[i].DataTypeOID != actual[i].DataTypeOID {
+			return fmt.Errorf("expected field %s to be of type %d. got %d", expected[i].Name, expected[i].DataTypeOID, actual[i].DataTypeOID)
+		}
+		if expected[i].Format != 0 && expected[i].Format != actual[i].Format {
+			return fmt.Errorf("expected field %s to be in format %d. got %d", expected[i].Name, expected[i].Format, actual[i].Format)
+		}
+	}
+	return nil
+}
+
 // Story holds a sequence of Step and uses pgproto3.Frontend to communicate with the tested backend.
 type Story struct {
-	// Frontend is the component that communicates with the tested backend
+	// Name is the name of the story as it is reported
+	Name string
+	// Frontend is the component that communicates with the tested backend. It is ignored when Session is set
 	Frontend *pgproto3.Frontend
+	// Session owns the connection to the tested backend and receives its messages
+	Session *Session
 	// Steps is a sequence of Step that defines a story
 	Steps []Step
-	// Filter is a function that tells the runner which types of responses it should verify
+	// Lines holds the line in the transcript that defines each of the Steps, or 0 if there is none
+	Lines []int
+	// Filter is a function that tells the runner which types of responses it should verify.
+	// Messages that it rejects are treated like messages that are ignored by the Ignore rules
 	Filter func(pgproto3.BackendMessage) bool
+	// Ignore holds the rules that tell the runner which messages it should not verify
+	Ignore IgnoreRules
+	// Validate tells the runner to check that every message received from the backend obeys the
+	// rules of the protocol, including messages that are not covered by a Response step
+	Validate bool
+	// Coverage records the parts of the protocol that are exercised by the messages that the story sends
+	// and receives, including ignored messages. The same Coverage can be shared by the stories of a suite
+	Coverage *Coverage
+	// Reporter is notified on the progress of the story, in addition to t
+	Reporter Reporter
+	// StepTimeout is the maximum time to wait for every response. Zero waits forever
+	StepTimeout time.Duration
+	// FinalTxStatus is the transaction status that the last ReadyForQuery of the story must report,
+	// one of TxStatusIdle, TxStatusInTransaction and TxStatusFailed. Zero is not checked
+	FinalTxStatus byte
 }
 
-// Run is running the Steps and fails the provided t on error. Because it uses go routines
-// and waits infinitely for expected responses, it also listens the provided chan for kill signals.
-// Most common use of c is a timeout error that should be generated by the caller of Run.
-func (s *Story) Run(t *testing.T, c <-chan interface{}) (err error) {
-
-	success := make(chan bool)
-	errors := make(chan error)
-	responseBuffer := make(chan pgproto3.BackendMessage, 100)
-
-	go func() {
-		for {
-			b, err := s.Frontend.Receive()
-			if err != nil {
-				errors <- err
-				return
-			}
-			if s.Filter == nil || s.Filter(b) {
-				responseBuffer <- b
-			}
-		}
-	}()
-
-	go func() {
-		for _, step := range s.Steps {
-			var e error
-			switch step.(type) {
-			case *Command:
-				if len(responseBuffer) > 0 {
-					e = fmt.Errorf("backend messages exist in buffer")
-					break
-				}
-				msg := step.(*Command).FrontendMessage
-				t.Logf("==>> %#v\n", msg)
-				e = s.Frontend.Send(msg)
-			case *Response:
-				msg := <-responseBuffer
-				t.Logf("<<== %#v\n", msg)
-				e = step.(*Response).Compare(msg)
-			}
-			if e != nil {
-				errors <- e
-				return
-			}
-		}
-		if len(responseBuffer) > 0 {
-			errors <- fmt.Errorf("expected missing step for: %#v", <-responseBuffer)
-			return
-		}
-		success <- true
-	}()
-
-	select {
-	case e := <-errors:
-		err = e
-		break
-	case <-success:
-		break
-	case v := <-c:
-		err = fmt.Errorf("received stop signal %#v", v)
-		break
+// session returns the Session to run the story on
+func (s *Story) session() *Session {
+	if s.Session != nil {
+		return s.Session
 	}
+	return sessionOf(s.Frontend)
+}
 
-	return
+// Run is running the Steps and fails the provided t on error. Because it waits infinitely for expected
+// responses, unless StepTimeout is set, it also listens the provided chan for kill signals.
+// Most common use of c is a timeout error that should be generated by the caller of Run.
+// The returned error is a *StoryError that reports the whole story.
+// Run can be called any number of times, also concurrently on stories with different sessions.
+func (s *Story) Run(t *testing.T, c <-chan interface{}) error {
+	return newRunner(s, t.Logf, c).run()
 }
@@ -1,8 +1,11 @@
 package pg_stories
 
 import (
+	"encoding/binary"
+	"flag"
 	"github.com/jackc/pgx/pgproto3"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -35,35 +38,460 @@ func startupSeq() []Step {
 	}
 }
 
-func filterStartupMessages(msg pgproto3.BackendMessage) bool {
-	switch msg.(type) {
-	case *pgproto3.ParameterStatus:
-		return false
-	case *pgproto3.BackendKeyData:
-		return false
-	case *pgproto3.NotificationResponse:
-		return false
+var postgres = flag.String("postgres", "", "address of a postgres server to run the stories against, e.g. 127.0.0.1:5432. "+
+	"Defaults to the in-memory backend")
+
+// dial connects to the postgres server of the -postgres flag, or through net.Pipe to a memoryBackend
+func dial() (net.Conn, error) {
+	if *postgres != "" {
+		return net.Dial("tcp", *postgres)
 	}
-	return true
+	frontendConn, backendConn := net.Pipe()
+	go func() {
+		serveMemoryBackend(backendConn)
+		backendConn.Close()
+	}()
+	return frontendConn, nil
 }
 
-func initStory(steps []Step) (*Story, error) {
-	conn, err := net.Dial("tcp", "127.0.0.1:5432")
+// connectSession returns a session over a connection that dial opens. The caller closes it.
+func connectSession() (*Session, error) {
+	conn, err := dial()
 	if err != nil {
 		return nil, err
 	}
+	return NewSession(conn)
+}
 
-	frontend, err := pgproto3.NewFrontend(conn, conn)
+// initStory returns a story of steps over a session that connectSession opens. The caller closes
+// the session of the story.
+func initStory(steps []Step) (*Story, error) {
+	session, err := connectSession()
 	if err != nil {
 		return nil, err
 	}
 	return &Story{
-		Steps:    steps,
-		Frontend: frontend,
-		Filter:   filterStartupMessages,
+		Steps:   steps,
+		Session: session,
+		Ignore:  IgnoreRules{Ignore('S', 'K')},
 	}, nil
 }
 
+// pipeFrontend returns a frontend that is connected through net.Pipe to a backend served by serve
+func pipeFrontend(t testing.TB, serve func(*pgproto3.Backend) error) *pgproto3.Frontend {
+	frontendConn, backendConn := net.Pipe()
+	frontend, err := pgproto3.NewFrontend(frontendConn, frontendConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := pgproto3.NewBackend(backendConn, backendConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		serve(backend)
+		backendConn.Close()
+	}()
+	return frontend
+}
+
+// notificationResponse is a NotificationResponse that is encoded with the PID of the notifying
+// backend, as pgproto3.NotificationResponse omits it
+type notificationResponse pgproto3.NotificationResponse
+
+func (*notificationResponse) Backend() {}
+
+func (n *notificationResponse) Decode(src []byte) error {
+	return (*pgproto3.NotificationResponse)(n).Decode(src)
+}
+
+func (n *notificationResponse) Encode(dst []byte) []byte {
+	dst = append(dst, 'A', 0, 0, 0, 0)
+	dst = append(dst, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], n.PID)
+	dst = append(append(dst, n.Channel...), 0)
+	dst = append(append(dst, n.Payload...), 0)
+	binary.BigEndian.PutUint32(dst[1:5], uint32(len(dst)-1))
+	return dst
+}
+
+// answerQueries returns a serve function for pipeFrontend that answers every Query with responses
+func answerQueries(responses ...pgproto3.BackendMessage) func(*pgproto3.Backend) error {
+	return func(backend *pgproto3.Backend) error {
+		for {
+			msg, err := backend.Receive()
+			if err != nil {
+				return err
+			}
+			if _, ok := msg.(*pgproto3.Query); !ok {
+				continue
+			}
+			for _, res := range responses {
+				if err := backend.Send(res); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func TestStory_Run(t *testing.T) {
+
+	t.Run("test failure report", func(t *testing.T) {
+		builder := NewBuilder(strings.NewReader(strings.Join([]string{
+			`=== report`,
+			`-> Q "SELECT * FROM (VALUES('baa')) t;"`,
+			``,
+			`<- T`,
+			`<- D ["baa"]`,
+			`<- C`,
+			`<- Z`,
+			`===`,
+		}, "\n")))
+		story, _, err := builder.ParseNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		story.Frontend = pipeFrontend(t, answerQueries(
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "column1"}}},
+			&pgproto3.DataRow{Values: [][]byte{[]byte("foo")}},
+			&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		))
+		err = story.Run(t, nil)
+		storyErr, ok := err.(*StoryError)
+		if !ok {
+			t.Fatalf("expected: StoryError. got: %T", err)
+		}
+		if storyErr.Step() != 2 || storyErr.Line() != 5 {
+			t.Fatalf("expected step #2 at line 5 to fail. actual: step #%d at line %d", storyErr.Step(), storyErr.Line())
+		}
+		if !strings.Contains(err.Error(), `<- D ["foo"]`) {
+			t.Fatalf("expected report to contain the actual data row. actual:\n%s", err)
+		}
+	})
+
+	t.Run("test ignore rules", func(t *testing.T) {
+		frontend := pipeFrontend(t, answerQueries(
+			&pgproto3.NoticeResponse{Severity: "NOTICE", Code: "00000", Message: "baa"},
+			&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		))
+		story := &Story{
+			Frontend: frontend,
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.NoticeResponse{}},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{}},
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			Ignore:      IgnoreRules{{Types: []byte{'N'}, From: 4}},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		story.Steps = append(story.Steps, &Response{&pgproto3.ReadyForQuery{}})
+		story.StepTimeout = time.Millisecond * 20
+		err := story.Run(t, nil)
+		if _, ok := err.(*StoryError); !ok {
+			t.Fatalf("expected: StoryError. got: %T", err)
+		}
+		if !strings.Contains(err.Error(), "ignored messages:\n<- N {code=00000, severity=NOTICE, message=baa}") {
+			t.Fatalf("expected report to list the ignored notice. actual:\n%s", err)
+		}
+	})
+
+	t.Run("test step timeout", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries()),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Expectation{Response: &Response{&pgproto3.ReadyForQuery{}}, Within: time.Millisecond * 20},
+			},
+		}
+		err := story.Run(t, nil)
+		storyErr, ok := err.(*StoryError)
+		if !ok {
+			t.Fatalf("expected: StoryError. got: %T", err)
+		}
+		if _, ok := storyErr.Cause().(*StepTimeoutError); !ok {
+			t.Fatalf("expected: StepTimeoutError. got: %T", storyErr.Cause())
+		}
+	})
+
+	t.Run("test silence", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(&pgproto3.ReadyForQuery{TxStatus: 'I'})),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.ReadyForQuery{}},
+				&Silence{Duration: time.Millisecond * 20},
+			},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test run twice", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(&pgproto3.ReadyForQuery{TxStatus: 'I'})),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			StepTimeout: time.Second,
+		}
+		for i := 0; i < 2; i++ {
+			if err := story.Run(t, nil); err != nil {
+				t.Fatalf("run #%d: %s", i, err)
+			}
+		}
+	})
+
+	t.Run("test stop signal", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries()),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: SimpleQuery}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+		}
+		sigKill := make(chan interface{}, 1)
+		sigKill <- "stop"
+		err := story.Run(t, sigKill)
+		storyErr, ok := err.(*StoryError)
+		if !ok {
+			t.Fatalf("expected: StoryError. got: %T", err)
+		}
+		if _, ok := storyErr.Cause().(*StopSignalError); !ok {
+			t.Fatalf("expected: StopSignalError. got: %T", storyErr.Cause())
+		}
+	})
+
+	t.Run("test pipeline", func(t *testing.T) {
+		steps := []Step{
+			&Pipelined{&Command{&pgproto3.Query{String: SimpleQuery}}},
+			&Pipelined{&Command{&pgproto3.Query{String: SimpleQuery}}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		}
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(
+				&pgproto3.CommandComplete{CommandTag: "SELECT 1"},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			)),
+			Steps:       steps,
+			StepTimeout: time.Second,
+			Validate:    true,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test decoded rows", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(
+				&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "n", DataTypeOID: 1700}}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte("1.0")}},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			)),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: "SELECT 1.0"}},
+				&Response{&pgproto3.RowDescription{}},
+				&Row{Values: [][]byte{[]byte("1")}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test unordered rows", func(t *testing.T) {
+		story := &Story{
+			Frontend: pipeFrontend(t, answerQueries(
+				&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: "id", DataTypeOID: 23}}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte("2")}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte("1")}},
+				&pgproto3.CommandComplete{CommandTag: "SELECT 2"},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			)),
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: "SELECT 1 UNION SELECT 2"}},
+				&Response{&pgproto3.RowDescription{}},
+				&RowSet{Rows: []*Row{{Values: [][]byte{[]byte("1")}}, {Values: [][]byte{[]byte("2")}}}},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{}},
+			},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+		story.Steps[2] = &RowSet{Rows: []*Row{{Values: [][]byte{[]byte("1")}}, {Values: [][]byte{[]byte("3")}}}}
+		err := story.Run(t, nil)
+		storyErr, ok := err.(*StoryError)
+		if !ok || storyErr.Step() != 2 {
+			t.Fatalf("expected step #2 to fail. got %v", err)
+		}
+	})
+
+	t.Run("test notifications", func(t *testing.T) {
+		frontend := pipeFrontend(t, answerQueries(
+			&pgproto3.CommandComplete{CommandTag: "NOTIFY"},
+			&notificationResponse{Channel: "baa", Payload: "first"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			&notificationResponse{Channel: "baa", Payload: "second"},
+		))
+		story := &Story{
+			Frontend: frontend,
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: "NOTIFY baa"}},
+				&Notification{Channel: "baa", Payload: "first", Order: BeforeReady},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{}},
+				&Notification{Channel: "baa", Payload: "second", Order: AfterReady},
+			},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		story.Steps = []Step{
+			&Command{&pgproto3.Query{String: "NOTIFY baa"}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Notification{Channel: "baa", Payload: "second", Order: BeforeReady},
+		}
+		err := story.Run(t, nil)
+		storyErr, ok := err.(*StoryError)
+		if !ok || storyErr.Step() != 2 {
+			t.Fatalf("expected step #2 to fail on order. got %v", err)
+		}
+
+		story.Steps = []Step{
+			&Command{&pgproto3.Query{String: "NOTIFY baa"}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+			&Notification{Channel: "other", AnyPayload: true, Within: time.Millisecond * 20},
+		}
+		err = story.Run(t, nil)
+		if storyErr, ok := err.(*StoryError); !ok || storyErr.Step() != 3 {
+			t.Fatalf("expected step #3 to time out. got %v", err)
+		}
+		// the second notification of the last run may still be on its way
+		if n := len(sessionOf(frontend).Notifications()); n < 2 {
+			t.Fatalf("expected unconsumed notifications in the inbox. got %d", n)
+		}
+	})
+
+	t.Run("test transaction status", func(t *testing.T) {
+		frontend := pipeFrontend(t, answerQueries(
+			&pgproto3.CommandComplete{CommandTag: "BEGIN"},
+			&pgproto3.ReadyForQuery{TxStatus: TxStatusInTransaction},
+		))
+		story := &Story{
+			Frontend: frontend,
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: "BEGIN"}},
+				&Response{&pgproto3.CommandComplete{}},
+				&Response{&pgproto3.ReadyForQuery{TxStatus: TxStatusInTransaction}},
+			},
+			FinalTxStatus: TxStatusInTransaction,
+			StepTimeout:   time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		story.Steps[2] = &Response{&pgproto3.ReadyForQuery{TxStatus: TxStatusIdle}}
+		err := story.Run(t, nil)
+		if storyErr, ok := err.(*StoryError); !ok || storyErr.Step() != 2 {
+			t.Fatalf("expected step #2 to fail. got %v", err)
+		}
+
+		story.Steps[2] = &Response{&pgproto3.ReadyForQuery{}}
+		story.FinalTxStatus = TxStatusIdle
+		err = story.Run(t, nil)
+		if storyErr, ok := err.(*StoryError); !ok || !strings.Contains(storyErr.Error(), "final transaction status") {
+			t.Fatalf("expected the final transaction status to fail the story. got %v", err)
+		}
+	})
+
+	t.Run("test parameters", func(t *testing.T) {
+		frontend := pipeFrontend(t, answerQueries(
+			&pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+			&pgproto3.CommandComplete{CommandTag: "SET"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		))
+		story := &Story{
+			Frontend: frontend,
+			Steps: []Step{
+				&Command{&pgproto3.Query{String: "SET TimeZone TO 'UTC'"}},
+				&Response{&pgproto3.CommandComplete{}},
+				&ParameterAssertion{Name: "TimeZone", Value: "UTC"},
+				&Response{&pgproto3.ReadyForQuery{}},
+				&Parameter{Name: "TimeZone", Value: "UTC"},
+			},
+			Ignore:      IgnoreRules{Ignore('S')},
+			StepTimeout: time.Second,
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+		if params := sessionOf(frontend).Parameters(); params["TimeZone"] != "UTC" {
+			t.Fatalf("expected the session to track TimeZone. got %v", params)
+		}
+
+		// unless it is ignored the reported parameter is expected in order
+		story.Ignore = nil
+		story.Steps = []Step{
+			&Command{&pgproto3.Query{String: "SET TimeZone TO 'UTC'"}},
+			&Parameter{Name: "TimeZone", Value: "UTC"},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		}
+		if err := story.Run(t, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		story.Ignore = IgnoreRules{Ignore('S')}
+		story.Steps = []Step{
+			&Command{&pgproto3.Query{String: "SET TimeZone TO 'UTC'"}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+			&ParameterAssertion{Name: "TimeZone", Value: "Europe/Berlin"},
+		}
+		err := story.Run(t, nil)
+		if storyErr, ok := err.(*StoryError); !ok || storyErr.Step() != 3 {
+			t.Fatalf("expected step #3 to fail. got %v", err)
+		}
+
+		story.Steps = []Step{
+			&Command{&pgproto3.Query{String: "SET TimeZone TO 'UTC'"}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+			&Parameter{Name: "DateStyle", Value: "ISO, MDY", Within: time.Millisecond * 20},
+		}
+		err = story.Run(t, nil)
+		if storyErr, ok := err.(*StoryError); !ok || storyErr.Step() != 3 {
+			t.Fatalf("expected step #3 to time out. got %v", err)
+		}
+	})
+
+}
+
 func TestExtendedSequences(t *testing.T) {
 
 	F_Q_Query := func(sql string) *Command {
@@ -300,8 +728,9 @@ func TestExtendedSequences(t *testing.T) {
 				B_1_ParseComplete,
 				B_Z_ReadyForQuery,
 				F_Q_Query(SimpleQuery),
-				F_B_Bind(UnnamedStmt, UnnamedPortal, [][]byte{[]byte("baa")}),
-				F_S_Sync,
+				// the responses to the query may arrive while the batch is sent
+				&Pipelined{F_B_Bind(UnnamedStmt, UnnamedPortal, [][]byte{[]byte("baa")})},
+				&Pipelined{F_S_Sync},
 				B_T_RowDescription,
 				B_D_DataRow,
 				B_C_CommandComplete,
@@ -393,7 +822,8 @@ func TestExtendedSequences(t *testing.T) {
 				F_E_Execute(UnnamedPortal, 1),
 				F_E_Execute(UnnamedPortal, 1),
 				F_H_flush,
-				F_S_Sync,
+				// the responses that were flushed may arrive before Sync is sent
+				&Pipelined{F_S_Sync},
 				B_1_ParseComplete,
 				B_2_BindComplete,
 				B_D_DataRow,
@@ -411,6 +841,7 @@ func TestExtendedSequences(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			defer story.Session.Close()
 			sigKill := make(chan interface{})
 			timer := time.NewTimer(time.Second * 2)
 			go func() {
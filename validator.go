@@ -0,0 +1,143 @@
+package pg_stories
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"sync"
+)
+
+// cycle holds the state of the messages sent up to and including a Sync or a Query
+type cycle struct {
+	// synced tells whether the cycle was closed by Sync, Query or StartupMessage
+	synced bool
+	// simple tells whether the cycle is a simple query
+	simple bool
+	// described tells whether RowDescription was received for the current statement of a simple query
+	described bool
+	// failed tells whether an ErrorResponse was received during an extended query
+	failed bool
+	// executes holds the MaxRows of every Execute that was not completed yet
+	executes []uint32
+}
+
+// Validator checks that the messages received from the backend obey the rules of the protocol,
+// based on the messages that were sent to it. A zero Validator is ready to use and it is safe
+// to use it from the sending and the receiving goroutines at the same time.
+type Validator struct {
+	mu     sync.Mutex
+	cycles []*cycle
+}
+
+func (v *Validator) open() *cycle {
+	if len(v.cycles) == 0 || v.cycles[len(v.cycles)-1].synced {
+		v.cycles = append(v.cycles, &cycle{})
+	}
+	return v.cycles[len(v.cycles)-1]
+}
+
+// Sent updates the state of the validator with msg that is sent to the backend.
+// It should be called before the message is actually sent.
+func (v *Validator) Sent(msg pgproto3.FrontendMessage) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sent(msg)
+}
+
+func (v *Validator) sent(msg pgproto3.FrontendMessage) {
+	switch m := msg.(type) {
+	case *RawMessage:
+		// interpret the raw bytes the same way the backend would
+		for raw := []byte(*m); len(raw) >= 5; {
+			n := int(binary.BigEndian.Uint32(raw[1:5])) + 1
+			if n < 5 || n > len(raw) {
+				break
+			}
+			switch raw[0] {
+			case 'Q':
+				v.sent(&pgproto3.Query{})
+			case 'S':
+				v.sent(&pgproto3.Sync{})
+			case 'E':
+				var execute pgproto3.Execute
+				if execute.Decode(raw[5:n]) == nil {
+					v.sent(&execute)
+				}
+			}
+			raw = raw[n:]
+		}
+	case *pgproto3.Query:
+		c := v.open()
+		c.synced = true
+		c.simple = len(c.executes) == 0
+	case *pgproto3.Sync, *pgproto3.StartupMessage:
+		v.open().synced = true
+	case *pgproto3.Execute:
+		c := v.open()
+		c.executes = append(c.executes, m.MaxRows)
+	}
+}
+
+// Received checks that msg is allowed by the protocol at this point and returns
+// a ProtocolViolationError if it is not.
+func (v *Validator) Received(msg pgproto3.BackendMessage) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto3.NoticeResponse, *pgproto3.NotificationResponse, *pgproto3.ParameterStatus:
+		return nil
+	case *pgproto3.ErrorResponse:
+		if m.Severity == "FATAL" || m.Severity == "PANIC" {
+			v.cycles = nil
+			return nil
+		}
+	}
+
+	if len(v.cycles) == 0 {
+		return &ProtocolViolationError{fmt.Sprintf("%T received without pending commands", msg)}
+	}
+	c := v.cycles[0]
+
+	if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		if !c.synced {
+			return &ProtocolViolationError{"ReadyForQuery received without pending Sync"}
+		}
+		v.cycles = v.cycles[1:]
+		return nil
+	}
+
+	if c.failed {
+		return &ProtocolViolationError{fmt.Sprintf("%T received after ErrorResponse before Sync", msg)}
+	}
+
+	if c.simple {
+		switch msg.(type) {
+		case *pgproto3.RowDescription:
+			c.described = true
+		case *pgproto3.DataRow:
+			if !c.described {
+				return &ProtocolViolationError{"DataRow received before RowDescription in simple query"}
+			}
+		case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse, *pgproto3.ErrorResponse:
+			c.described = false
+		}
+		return nil
+	}
+
+	switch msg.(type) {
+	case *pgproto3.ErrorResponse:
+		c.failed = true
+		c.executes = nil
+	case *pgproto3.PortalSuspended:
+		if len(c.executes) == 0 || c.executes[0] == 0 {
+			return &ProtocolViolationError{"PortalSuspended received for Execute without MaxRows"}
+		}
+		c.executes = c.executes[1:]
+	case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse:
+		if len(c.executes) > 0 {
+			c.executes = c.executes[1:]
+		}
+	}
+	return nil
+}
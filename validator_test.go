@@ -0,0 +1,102 @@
+package pg_stories
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"testing"
+)
+
+func validate(steps ...Step) error {
+	v := &Validator{}
+	for _, step := range steps {
+		switch s := step.(type) {
+		case *Command:
+			v.Sent(s.FrontendMessage)
+		case *Response:
+			if err := v.Received(s.BackendMessage); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+
+	t.Run("test valid extended query", func(t *testing.T) {
+		err := validate(
+			&Command{&pgproto3.Parse{}},
+			&Command{&pgproto3.Bind{}},
+			&Command{&pgproto3.Execute{MaxRows: 1}},
+			&Command{&pgproto3.Execute{}},
+			&Command{&pgproto3.Sync{}},
+			&Response{&pgproto3.ParseComplete{}},
+			&Response{&pgproto3.BindComplete{}},
+			&Response{&pgproto3.DataRow{}},
+			&Response{&pgproto3.PortalSuspended{}},
+			&Response{&pgproto3.DataRow{}},
+			&Response{&pgproto3.CommandComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test ready for query without sync", func(t *testing.T) {
+		err := validate(
+			&Command{&pgproto3.Parse{}},
+			&Response{&pgproto3.ParseComplete{}},
+			&Response{&pgproto3.ReadyForQuery{}},
+		)
+		if _, ok := err.(*ProtocolViolationError); !ok {
+			t.Fatalf("expected: ProtocolViolationError. got: %T", err)
+		}
+	})
+
+	t.Run("test data row before row description", func(t *testing.T) {
+		err := validate(
+			&Command{&pgproto3.Query{String: SimpleQuery}},
+			&Response{&pgproto3.DataRow{}},
+		)
+		if _, ok := err.(*ProtocolViolationError); !ok {
+			t.Fatalf("expected: ProtocolViolationError. got: %T", err)
+		}
+	})
+
+	t.Run("test skip until sync after error", func(t *testing.T) {
+		err := validate(
+			&Command{&pgproto3.Bind{}},
+			&Command{&pgproto3.Execute{}},
+			&Command{&pgproto3.Sync{}},
+			&Response{&pgproto3.ErrorResponse{Code: ErrorInvalidSqlStatementName}},
+			&Response{&pgproto3.CommandComplete{}},
+		)
+		if _, ok := err.(*ProtocolViolationError); !ok {
+			t.Fatalf("expected: ProtocolViolationError. got: %T", err)
+		}
+	})
+
+	t.Run("test portal suspended without max rows", func(t *testing.T) {
+		err := validate(
+			&Command{&pgproto3.Execute{}},
+			&Command{&pgproto3.Sync{}},
+			&Response{&pgproto3.DataRow{}},
+			&Response{&pgproto3.PortalSuspended{}},
+		)
+		if _, ok := err.(*ProtocolViolationError); !ok {
+			t.Fatalf("expected: ProtocolViolationError. got: %T", err)
+		}
+	})
+
+	t.Run("test raw sync", func(t *testing.T) {
+		raw := RawMessage((&pgproto3.Sync{}).Encode(nil))
+		err := validate(
+			&Command{&raw},
+			&Response{&pgproto3.ReadyForQuery{}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+}